@@ -0,0 +1,230 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"hubcorner/internal/database"
+)
+
+// command is an admin command, run as `hubcorner <name> [args]`
+type command struct {
+	usage string
+	run   func(db *sql.DB, args []string) error
+}
+
+// commands lists the admin commands by name
+var commands = map[string]command{
+	"check-names":   {"report communities whose names break the naming rules", checkNames},
+	"check-votes":   {"quarantine votes that look like manipulation", checkVotes},
+	"discard-votes": {"<vote id>... delete quarantined votes", discardVotes},
+	"flagged-votes": {"list the quarantined votes waiting for review", flaggedVotes},
+	"grant-admin":   {"<username> make a user a site admin", setAdmin(true)},
+	"rebuild-karma": {"recompute every user's karma from the votes", rebuildKarma},
+	"reconcile":     {"[-dry-run] recount vote, comment and post counts and fix any that drifted", reconcile},
+	"release-votes": {"<vote id>... count quarantined votes again", releaseVotes},
+	"revoke-admin":  {"<username> remove a user's admin rights", setAdmin(false)},
+}
+
+// runCommand runs the named admin command
+func runCommand(db *sql.DB, name string, args []string) error {
+	if name == "help" {
+		printUsage()
+		return nil
+	}
+
+	cmd, ok := commands[name]
+	if !ok {
+		printUsage()
+		return fmt.Errorf("unknown command")
+	}
+	return cmd.run(db, args)
+}
+
+// printUsage lists the admin commands on stderr
+func printUsage() {
+	var commandNames []string
+	for name := range commands {
+		commandNames = append(commandNames, name)
+	}
+	sort.Strings(commandNames)
+
+	fmt.Fprintln(os.Stderr, "Usage: hubcorner [flags] [command]")
+	fmt.Fprintln(os.Stderr, "Without a command, hubcorner starts the web server. Commands:")
+	for _, name := range commandNames {
+		fmt.Fprintf(os.Stderr, "  %-16s %s\n", name, commands[name].usage)
+	}
+}
+
+// checkNames reports existing communities whose names break the naming rules
+func checkNames(db *sql.DB, args []string) error {
+	problems, err := database.CheckCommunityNames(db)
+	if err != nil {
+		return err
+	}
+	if len(problems) == 0 {
+		fmt.Println("All community names are valid.")
+		return nil
+	}
+
+	for _, p := range problems {
+		fmt.Printf("%d\tc/%s\t%s\n", p.ID, p.Name, p.Problem)
+	}
+	fmt.Printf("%d problem(s) found. Rename these communities in the database.\n", len(problems))
+	return nil
+}
+
+// setAdmin returns a command that grants or revokes admin rights
+func setAdmin(admin bool) func(db *sql.DB, args []string) error {
+	return func(db *sql.DB, args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("expected a username")
+		}
+		if err := database.SetAdmin(db, args[0], admin); err != nil {
+			return err
+		}
+		if admin {
+			fmt.Printf("%s is now an admin.\n", args[0])
+		} else {
+			fmt.Printf("%s is no longer an admin.\n", args[0])
+		}
+		return nil
+	}
+}
+
+// rebuildKarma recomputes the karma totals, in case they have drifted from the votes
+func rebuildKarma(db *sql.DB, args []string) error {
+	if err := database.RebuildKarma(db); err != nil {
+		return err
+	}
+	fmt.Println("Karma rebuilt from the votes.")
+	return nil
+}
+
+// checkVotes runs the vote analyser once
+func checkVotes(db *sql.DB, args []string) error {
+	results, err := database.CheckVotes(db)
+	if err != nil {
+		return err
+	}
+	if summary := summarizeVoteCheck(results); summary != "" {
+		fmt.Println(summary)
+	} else {
+		fmt.Println("No suspicious votes found.")
+	}
+	fmt.Println("Review quarantined votes with flagged-votes.")
+	return nil
+}
+
+// summarizeVoteCheck describes the votes a vote check quarantined, or
+// returns "" if it quarantined none
+func summarizeVoteCheck(results []database.VoteCheckResult) string {
+	var parts []string
+	total := 0
+	for _, r := range results {
+		if r.Quarantined > 0 {
+			parts = append(parts, fmt.Sprintf("%s %d", r.Reason, r.Quarantined))
+			total += r.Quarantined
+		}
+	}
+	if total == 0 {
+		return ""
+	}
+	return fmt.Sprintf("quarantined %d vote(s): %s", total, strings.Join(parts, ", "))
+}
+
+// flaggedVotes lists the quarantined votes
+func flaggedVotes(db *sql.DB, args []string) error {
+	votes, err := database.GetQuarantinedVotes(db)
+	if err != nil {
+		return err
+	}
+	if len(votes) == 0 {
+		fmt.Println("No votes are quarantined.")
+		return nil
+	}
+
+	for _, v := range votes {
+		fmt.Printf("%d\t%s\t%s %d\t%+d\t%s\t%s\t%s\n", v.ID, v.Reason, v.ItemType, v.ItemID, v.VoteType, v.Voter, v.IPRange, v.CreatedAt)
+	}
+	fmt.Printf("%d vote(s) quarantined. Count them again with release-votes, or delete them with discard-votes.\n", len(votes))
+	return nil
+}
+
+// releaseVotes counts quarantined votes again
+func releaseVotes(db *sql.DB, args []string) error {
+	ids, err := parseVoteIDs(args)
+	if err != nil {
+		return err
+	}
+	n, err := database.ReleaseVotes(db, ids)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Released %d vote(s).\n", n)
+	return nil
+}
+
+// discardVotes deletes quarantined votes
+func discardVotes(db *sql.DB, args []string) error {
+	ids, err := parseVoteIDs(args)
+	if err != nil {
+		return err
+	}
+	n, err := database.DiscardVotes(db, ids)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Discarded %d vote(s).\n", n)
+	return nil
+}
+
+// parseVoteIDs parses the vote IDs given to a command
+func parseVoteIDs(args []string) ([]int, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("expected vote IDs")
+	}
+	var ids []int
+	for _, arg := range args {
+		id, err := strconv.Atoi(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid vote ID %q", arg)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// reconcile recounts the denormalized counts and fixes the ones that
+// drifted, or with -dry-run only reports them
+func reconcile(db *sql.DB, args []string) error {
+	fix := true
+	for _, arg := range args {
+		if arg != "-dry-run" && arg != "--dry-run" {
+			return fmt.Errorf("unknown argument %q", arg)
+		}
+		fix = false
+	}
+
+	drifts, err := database.Reconcile(db, fix)
+	for _, d := range drifts {
+		fmt.Printf("%s %d\t%s\tstored %d, counted %d\n", d.Table, d.ID, d.Column, d.Stored, d.Counted)
+	}
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case len(drifts) == 0:
+		fmt.Println("All counts match.")
+	case fix:
+		fmt.Printf("Fixed %d count(s). Run rebuild-karma if vote counts were off.\n", len(drifts))
+	default:
+		fmt.Printf("%d count(s) differ. Run reconcile without -dry-run to fix them.\n", len(drifts))
+	}
+	return nil
+}
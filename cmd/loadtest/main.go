@@ -0,0 +1,144 @@
+// Command loadtest sends concurrent votes and page views to a running
+// HubCorner server and reports how many succeeded and how long they took.
+// It is used to check how the server holds up under concurrent writes:
+//
+//	go run ./cmd/loadtest -url http://localhost:8080 -post 1 -clients 50 -requests 2000
+//
+// Each request comes from a new client, as if that many people voted at
+// once. Use it against a test database, as the votes are real.
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// result is the outcome of one request
+type result struct {
+	vote    bool
+	status  int // 0 if the request failed before a response
+	elapsed time.Duration
+}
+
+func main() {
+	baseURL := flag.String("url", "http://localhost:8080", "server to test")
+	postID := flag.Int("post", 1, "post to vote on and view")
+	clients := flag.Int("clients", 50, "requests in flight at once")
+	requests := flag.Int("requests", 2000, "total requests to send")
+	readShare := flag.Float64("reads", 0.5, "share of requests that view the post page instead of voting")
+	flag.Parse()
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	voteURL := strings.TrimRight(*baseURL, "/") + "/posts/vote"
+	pageURL := fmt.Sprintf("%s/posts/%d", strings.TrimRight(*baseURL, "/"), *postID)
+
+	jobs := make(chan int)
+	results := make(chan result, *requests)
+	var wg sync.WaitGroup
+	for i := 0; i < *clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range jobs {
+				// Spread the reads evenly through the run
+				vote := float64(n%100) >= *readShare*100
+				results <- send(client, vote, voteURL, pageURL, *postID)
+			}
+		}()
+	}
+
+	start := time.Now()
+	for n := 0; n < *requests; n++ {
+		jobs <- n
+	}
+	close(jobs)
+	wg.Wait()
+	close(results)
+	report(results, time.Since(start))
+}
+
+// send makes one request as a new client: a vote, or a view of the post page
+func send(client *http.Client, vote bool, voteURL, pageURL string, postID int) result {
+	var req *http.Request
+	var err error
+	if vote {
+		form := url.Values{"post_id": {strconv.Itoa(postID)}, "vote_type": {"1"}}
+		req, err = http.NewRequest(http.MethodPost, voteURL, strings.NewReader(form.Encode()))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.Header.Set("Accept", "application/json")
+		}
+	} else {
+		req, err = http.NewRequest(http.MethodGet, pageURL, nil)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	req.AddCookie(&http.Cookie{Name: "client_id", Value: newClientID()})
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return result{vote: vote, elapsed: time.Since(start)}
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return result{vote: vote, status: resp.StatusCode, elapsed: time.Since(start)}
+}
+
+// newClientID returns a random client ID, like the ones the server hands out
+func newClientID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// report prints the status codes and latencies of votes and page views
+func report(results <-chan result, total time.Duration) {
+	kinds := map[bool]string{true: "votes", false: "page views"}
+	statuses := map[bool]map[int]int{true: {}, false: {}}
+	latencies := map[bool][]time.Duration{}
+	count := 0
+	for r := range results {
+		statuses[r.vote][r.status]++
+		latencies[r.vote] = append(latencies[r.vote], r.elapsed)
+		count++
+	}
+
+	fmt.Printf("%d requests in %v (%.0f/s)\n", count, total.Round(time.Millisecond), float64(count)/total.Seconds())
+	for _, vote := range []bool{true, false} {
+		l := latencies[vote]
+		if len(l) == 0 {
+			continue
+		}
+		sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+		percentile := func(p float64) time.Duration {
+			return l[int(p*float64(len(l)-1))].Round(time.Millisecond)
+		}
+
+		var codes []string
+		for status, n := range statuses[vote] {
+			label := strconv.Itoa(status)
+			if status == 0 {
+				label = "failed"
+			}
+			codes = append(codes, fmt.Sprintf("%s: %d", label, n))
+		}
+		sort.Strings(codes)
+		fmt.Printf("%-10s %5d  %s  p50 %v  p95 %v  p99 %v\n", kinds[vote], len(l), strings.Join(codes, ", "),
+			percentile(0.50), percentile(0.95), percentile(0.99))
+	}
+}
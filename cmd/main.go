@@ -1,83 +1,262 @@
 package main
 
 import (
+	"crypto/tls"
 	"database/sql"
+	"flag"
 	"fmt"
 	"html/template"
 	"log"
+	"net"
 	"net/http"
-	"os"
 	"path/filepath"
 	"time"
 
+	"hubcorner/internal/assets"
+	"hubcorner/internal/cache"
+	"hubcorner/internal/certs"
+	"hubcorner/internal/compress"
 	"hubcorner/internal/database"
 	"hubcorner/internal/handlers"
-	"hubcorner/internal/models"
+	"hubcorner/internal/render"
+	"hubcorner/internal/security"
+	"hubcorner/web"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
 func main() {
-	// Initialize the database
+	dev := flag.Bool("dev", false, "load templates and static files from ./web and reload templates on change")
+	commentDepth := flag.Int("comment-depth", handlers.DefaultCommentDepth, "levels of replies a post page shows before \"continue this thread\" links")
+	commentReplies := flag.Int("comment-replies", handlers.DefaultCommentReplies, "replies to each comment a post page shows before \"load more\" links")
+	fuzzScores := flag.Bool("fuzz-scores", false, "show scores blurred by a few points, to make vote manipulation harder to measure")
+	voteCheck := flag.Duration("vote-check", 15*time.Minute, "how often to check votes for manipulation, or 0 to only check with the check-votes command")
+	reconcileInterval := flag.Duration("reconcile", 0, "how often to recount vote, comment and post counts and fix any that drifted, or 0 to only reconcile with the reconcile command")
+	cacheSize := flag.Int("cache-size", 1000, "entries kept in each of the listing, markdown and Last-Modified caches, or 0 to cache nothing")
+	cacheTTL := flag.Duration("cache-ttl", 30*time.Second, "how long cached listings are fresh, after which they are served for as long again while they are refreshed, or 0 to keep them until a write changes them")
+	sharedMaxAge := flag.Duration("shared-max-age", 0, "how long shared caches such as nginx may keep the pages they get for visitors without a cookie")
+	cspReportOnly := flag.Bool("csp-report-only", false, "only report what the Content-Security-Policy would block, to "+security.ReportPath+", instead of blocking it")
+	addr := flag.String("addr", ":8080", "address to listen on, for HTTPS if -tls-cert is given")
+	tlsCert := flag.String("tls-cert", "", "PEM certificate file, followed by any intermediate certificates, to serve HTTPS with; it is reloaded when it changes")
+	tlsKey := flag.String("tls-key", "", "PEM private key file of -tls-cert")
+	redirectAddr := flag.String("redirect-addr", "", "with -tls-cert, an address such as :80 to also listen on for plain HTTP, redirecting it to HTTPS")
+	acmeDir := flag.String("acme-dir", "", "with -redirect-addr, a directory to serve ACME HTTP-01 challenges from, for certbot --webroot")
+	flag.Parse()
+	if *commentDepth < 1 || *commentReplies < 1 {
+		log.Fatal("-comment-depth and -comment-replies must be at least 1")
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		log.Fatal("-tls-cert and -tls-key must be given together")
+	}
+	if *redirectAddr != "" && *tlsCert == "" {
+		log.Fatal("-redirect-addr needs -tls-cert and -tls-key")
+	}
+
+	// Initialize the database: writes go through db, reads through reads
 	dbPath := filepath.Join(".", "hubcorner.db")
-	db, err := sql.Open("sqlite3", dbPath)
+	db, reads, err := database.Open(dbPath)
 	if err != nil {
 		log.Fatalf("Failed to open database: %v", err)
 	}
 	defer db.Close()
+	defer reads.Close()
 
 	// Initialize database schema
 	if err := database.InitDB(db); err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
 
+	// Run an admin command instead of the server if one is given
+	if flag.NArg() > 0 {
+		if err := runCommand(db, flag.Arg(0), flag.Args()[1:]); err != nil {
+			log.Fatalf("%s: %v", flag.Arg(0), err)
+		}
+		return
+	}
+
+	// Check votes for manipulation in the background
+	if *voteCheck > 0 {
+		go checkVotesEvery(db, *voteCheck)
+	}
+	if *reconcileInterval > 0 {
+		go reconcileEvery(db, *reconcileInterval)
+	}
+
+	var fuzzer *handlers.ScoreFuzzer
+	if *fuzzScores {
+		fuzzer = handlers.NewScoreFuzzer()
+	}
+
+	// Cache listings for a while, and rendered markdown for as long as there
+	// is room, as it is cached by its source. Versions dates the ETags of
+	// responses for their Last-Modified.
+	var listings, bodies *cache.Cache
+	var versions cache.Store
+	if *cacheSize > 0 {
+		listings = cache.New(cache.NewLRU(*cacheSize), *cacheTTL, *cacheTTL)
+		bodies = cache.New(cache.NewLRU(*cacheSize), 0, 0)
+		versions = cache.NewLRU(*cacheSize)
+	}
+
 	// Create a new server instance
 	server := &http.Server{
-		Addr:         ":8080",
-		Handler:      setupRoutes(db),
+		Addr:         *addr,
+		Handler:      compress.Handler(security.Headers(*cspReportOnly, setupRoutes(db, reads, *dev, *commentDepth, *commentReplies, fuzzer, listings, bodies, versions, *sharedMaxAge))),
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 10 * time.Second,
 	}
 
 	// Start the server
-	fmt.Println("Server started at http://localhost:8080")
-	log.Fatal(server.ListenAndServe())
+	if *tlsCert == "" {
+		fmt.Printf("Server started at http://localhost%s\n", *addr)
+		log.Fatal(server.ListenAndServe())
+	}
+
+	// Serve HTTPS, and HTTP/2, with a certificate that is reloaded when it
+	// is renewed
+	reloader, err := certs.NewReloader(*tlsCert, *tlsKey)
+	if err != nil {
+		log.Fatalf("Failed to load TLS certificate: %v", err)
+	}
+	server.TLSConfig = &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	if *redirectAddr != "" {
+		_, httpsPort, err := net.SplitHostPort(*addr)
+		if err != nil {
+			log.Fatalf("Invalid -addr: %v", err)
+		}
+		redirect := &http.Server{
+			Addr:         *redirectAddr,
+			Handler:      certs.Redirect(httpsPort, *acmeDir),
+			ReadTimeout:  10 * time.Second,
+			WriteTimeout: 10 * time.Second,
+		}
+		go func() {
+			log.Fatal(redirect.ListenAndServe())
+		}()
+	}
+
+	fmt.Printf("Server started at https://localhost%s\n", *addr)
+	log.Fatal(server.ListenAndServeTLS("", ""))
+}
+
+// checkVotesEvery runs the vote analyser at an interval, logging the votes it quarantines
+func checkVotesEvery(db *sql.DB, interval time.Duration) {
+	for range time.Tick(interval) {
+		results, err := database.CheckVotes(db)
+		if err != nil {
+			log.Printf("Error checking votes: %v", err)
+			continue
+		}
+		if summary := summarizeVoteCheck(results); summary != "" {
+			log.Printf("Vote check: %s", summary)
+		}
+	}
 }
 
-func setupRoutes(db *sql.DB) http.Handler {
+// reconcileEvery fixes drifted counts at an interval, logging what it fixed
+func reconcileEvery(db *sql.DB, interval time.Duration) {
+	for range time.Tick(interval) {
+		drifts, err := database.Reconcile(db, true)
+		for _, d := range drifts {
+			log.Printf("Reconcile: fixed %s %d %s, stored %d, counted %d", d.Table, d.ID, d.Column, d.Stored, d.Counted)
+		}
+		if err != nil {
+			log.Printf("Error reconciling counts: %v", err)
+		}
+	}
+}
+
+func setupRoutes(db, reads *sql.DB, dev bool, commentDepth, commentReplies int, fuzzer *handlers.ScoreFuzzer, listings, bodies *cache.Cache, versions cache.Store, sharedMaxAge time.Duration) http.Handler {
 	mux := http.NewServeMux()
 
 	// Serve static files
-	fs := http.FileServer(http.Dir("./web/static"))
-	mux.Handle("/static/", http.StripPrefix("/static/", fs))
+	static, err := assets.New(web.Static(dev), "/static/", dev)
+	if err != nil {
+		log.Fatalf("Failed to load static files: %v", err)
+	}
+	mux.Handle("/static/", http.StripPrefix("/static", static))
 
 	// Create template cache
-	tmpl, err := template.ParseGlob("./web/templates/*.html")
+	funcs := template.FuncMap{
+		"asset": static.URL,
+		"score": fuzzer.Score,
+	}
+	if bodies != nil {
+		funcs["markdown"] = render.CachedMarkdown(bodies)
+	}
+	tmpl, err := render.New(web.Templates(dev), funcs, dev)
 	if err != nil {
 		log.Fatalf("Failed to parse templates: %v", err)
 	}
 
 	// Initialize handlers
 	h := handlers.NewHandler(db, tmpl)
+	h.Reads = reads
+	h.CommentDepth = commentDepth
+	h.CommentReplies = commentReplies
+	h.Fuzzer = fuzzer
+	h.Cache = listings
+
+	// Pages and API reads get ETags. Shared caches can keep the pages
+	// visitors see; pages about the client's own items stay private.
+	page := func(next http.HandlerFunc) http.HandlerFunc {
+		return handlers.Conditional(sharedMaxAge, versions, next)
+	}
+	private := func(next http.HandlerFunc) http.HandlerFunc {
+		return handlers.Conditional(0, versions, next)
+	}
 
 	// Front page
-	mux.HandleFunc("/", h.FrontPage)
+	mux.HandleFunc("/", page(h.FrontPage))
 
 	// Community routes
-	mux.HandleFunc("/communities", h.ListCommunities)
-	mux.HandleFunc("/communities/new", h.NewCommunity)
+	mux.HandleFunc("/communities", page(h.ListCommunities))
+	mux.HandleFunc("/communities/new", page(h.NewCommunity))
 	mux.HandleFunc("/communities/create", h.CreateCommunity)
-	mux.HandleFunc("/c/", h.ViewCommunity)
+	mux.HandleFunc("/c/", page(h.ViewCommunity))
 
 	// Post routes
-	mux.HandleFunc("/posts/new", h.NewPost)
+	mux.HandleFunc("/posts/new", page(h.NewPost))
 	mux.HandleFunc("/posts/create", h.CreatePost)
-	mux.HandleFunc("/posts/", h.ViewPost)
+	mux.HandleFunc("/posts/", page(h.ViewPost))
 	mux.HandleFunc("/posts/vote", h.VotePost)
+	mux.HandleFunc("/posts/save", h.MarkItem)
+	mux.HandleFunc("/posts/unsave", h.MarkItem)
+	mux.HandleFunc("/posts/hide", h.MarkItem)
+	mux.HandleFunc("/posts/unhide", h.MarkItem)
+	mux.HandleFunc("/polls/vote", h.VotePoll)
+
+	// Account routes
+	mux.HandleFunc("/account", private(h.Account))
+	mux.HandleFunc("/account/privacy", h.ProfilePrivacy)
+	mux.HandleFunc("/u/", page(h.UserProfile))
+	mux.HandleFunc("/saved", private(h.SavedItems))
+	mux.HandleFunc("/hidden", private(h.HiddenItems))
+
+	// Admin console
+	mux.HandleFunc("/admin", private(h.Admin))
+	mux.HandleFunc("/admin/", private(h.Admin))
 
 	// Comment routes
 	mux.HandleFunc("/comments/create", h.CreateComment)
 	mux.HandleFunc("/comments/vote", h.VoteComment)
+	mux.HandleFunc("/comments/save", h.MarkItem)
+	mux.HandleFunc("/comments/unsave", h.MarkItem)
+	mux.HandleFunc("/comments/hide", h.MarkItem)
+	mux.HandleFunc("/comments/unhide", h.MarkItem)
+
+	// JSON API routes
+	mux.HandleFunc("/api/saved", private(h.SavedItems))
+	mux.HandleFunc("/api/hidden", private(h.HiddenItems))
+	mux.HandleFunc("/api/polls/", page(h.PollResults))
+	mux.HandleFunc("/api/u/", page(h.UserProfile))
+
+	// Reports of content the Content-Security-Policy blocked
+	mux.Handle(security.ReportPath, security.NewReports())
 
 	return mux
 }
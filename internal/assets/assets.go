@@ -0,0 +1,209 @@
+// Package assets serves static files under content-hashed URLs
+package assets
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"hubcorner/internal/compress"
+)
+
+// contentTypes are the types of the kinds of files the site serves, so they
+// don't depend on the mime.types of the machine it runs on
+var contentTypes = map[string]string{
+	".css":         "text/css; charset=utf-8",
+	".js":          "text/javascript; charset=utf-8",
+	".json":        "application/json",
+	".map":         "application/json",
+	".webmanifest": "application/manifest+json",
+	".txt":         "text/plain; charset=utf-8",
+	".svg":         "image/svg+xml",
+	".png":         "image/png",
+	".jpg":         "image/jpeg",
+	".jpeg":        "image/jpeg",
+	".gif":         "image/gif",
+	".webp":        "image/webp",
+	".ico":         "image/x-icon",
+	".woff":        "font/woff",
+	".woff2":       "font/woff2",
+}
+
+// Server serves static files and builds their URLs
+type Server struct {
+	prefix    string
+	files     map[string]*file  // asset name -> file, nil in dev mode
+	disk      http.Handler      // serves the files in dev mode
+	hashed    map[string]string // asset name -> hashed name
+	originals map[string]string // hashed name -> asset name
+}
+
+// file is a static file held in memory, with compressed copies of it
+type file struct {
+	name        string
+	contentType string
+	etag        string
+	data        []byte
+	encoded     map[string][]byte // encoding -> compressed data, if smaller
+}
+
+// New creates a static file server for fsys mounted at prefix (e.g. "/static/").
+// The files are read into memory and compressed with brotli and gzip once,
+// here. When dev is set, they are read from fsys on every request instead,
+// and URLs are not hashed, so edited files are picked up without a restart.
+func New(fsys fs.FS, prefix string, dev bool) (*Server, error) {
+	s := &Server{
+		prefix:    prefix,
+		hashed:    make(map[string]string),
+		originals: make(map[string]string),
+	}
+	if dev {
+		s.disk = http.FileServer(http.FS(noDirs{fsys}))
+		return s, nil
+	}
+
+	s.files = make(map[string]*file)
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		digest := sha256.Sum256(data)
+		sum := hex.EncodeToString(digest[:])
+		hashedName := hashName(name, sum[:12])
+		s.hashed[name] = hashedName
+		s.originals[hashedName] = name
+
+		f := &file{
+			name:        name,
+			contentType: contentType(name, data),
+			etag:        sum[:32],
+			data:        data,
+			encoded:     make(map[string][]byte),
+		}
+		if compress.Compressible(f.contentType) {
+			for _, encoding := range []string{compress.Brotli, compress.Gzip} {
+				encoded, err := compress.Encode(encoding, data)
+				if err != nil {
+					return err
+				}
+				if len(encoded) < len(data) {
+					f.encoded[encoding] = encoded
+				}
+			}
+		}
+		s.files[name] = f
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// contentType returns the Content-Type of a file from its extension, or
+// from its contents if the extension is unknown
+func contentType(name string, data []byte) string {
+	ext := strings.ToLower(path.Ext(name))
+	if t, ok := contentTypes[ext]; ok {
+		return t
+	}
+	if t := mime.TypeByExtension(ext); t != "" {
+		return t
+	}
+	return http.DetectContentType(data)
+}
+
+// hashName inserts hash before the file extension: css/styles.css -> css/styles.<hash>.css
+func hashName(name, hash string) string {
+	ext := path.Ext(name)
+	return strings.TrimSuffix(name, ext) + "." + hash + ext
+}
+
+// URL returns the public URL of a static asset, e.g. URL("css/styles.css")
+func (s *Server) URL(name string) string {
+	name = strings.TrimPrefix(name, "/")
+	if hashedName, ok := s.hashed[name]; ok {
+		return s.prefix + hashedName
+	}
+	return s.prefix + name
+}
+
+// ServeHTTP serves a static file. It expects the prefix to be stripped already.
+// Hashed URLs never change content, so they can be cached forever. Other
+// URLs are revalidated with their ETag. Directories are not listed.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	if s.disk != nil {
+		w.Header().Set("Cache-Control", "no-cache")
+		if t, ok := contentTypes[strings.ToLower(path.Ext(name))]; ok {
+			w.Header().Set("Content-Type", t)
+		}
+		s.disk.ServeHTTP(w, r)
+		return
+	}
+
+	if original, ok := s.originals[name]; ok {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		name = original
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	f, ok := s.files[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	f.serve(w, r)
+}
+
+// serve writes the file, compressed if the client accepts an encoding it
+// has a compressed copy in. Conditional and range requests are handled by
+// http.ServeContent.
+func (f *file) serve(w http.ResponseWriter, r *http.Request) {
+	header := w.Header()
+	header.Set("Content-Type", f.contentType)
+	if len(f.encoded) > 0 && !strings.Contains(strings.Join(header.Values("Vary"), ","), "Accept-Encoding") {
+		header.Add("Vary", "Accept-Encoding")
+	}
+
+	data, etag := f.data, f.etag
+	if encoding := compress.Negotiate(r.Header.Get("Accept-Encoding")); f.encoded[encoding] != nil {
+		data, etag = f.encoded[encoding], etag+"-"+encoding
+		header.Set("Content-Encoding", encoding)
+	}
+	header.Set("ETag", `"`+etag+`"`)
+	http.ServeContent(w, r, f.name, time.Time{}, bytes.NewReader(data))
+}
+
+// noDirs hides the directories of a file system, so that http.FileServer
+// answers 404 for them instead of listing their files
+type noDirs struct {
+	fs.FS
+}
+
+func (d noDirs) Open(name string) (fs.File, error) {
+	f, err := d.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		f.Close()
+		return nil, fs.ErrNotExist
+	}
+	return f, nil
+}
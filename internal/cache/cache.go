@@ -0,0 +1,202 @@
+// Package cache keeps the results of expensive reads, such as post listings
+// and rendered markdown, between requests.
+//
+// A Cache reads through to a load function on a miss. Concurrent misses for
+// the same key share one load. Entries go stale after a maximum age, or
+// when a write marks them stale, and a stale entry is still served while a
+// single background load refreshes it. Writes that must show up at once
+// invalidate entries instead, so the next read waits for a fresh load.
+package cache
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entry is a cached value and when it was loaded
+type Entry struct {
+	Value interface{}
+	// Loaded is when the load that produced Value started, so a write made
+	// during the load still makes the entry stale
+	Loaded time.Time
+}
+
+// Store holds cache entries. LRU keeps them in the memory of one server; a
+// store shared between servers, such as memcached or Redis, can implement
+// Store by encoding the values, though invalidations stay per server.
+type Store interface {
+	Get(key string) (Entry, bool)
+	Set(key string, e Entry)
+}
+
+// Cache is a read-through cache over a Store. A nil Cache caches nothing:
+// Get always loads.
+type Cache struct {
+	store Store
+	// An entry is fresh for maxAge after it was loaded, or forever if
+	// maxAge is 0, and can be served stale for staleFor after that
+	maxAge   time.Duration
+	staleFor time.Duration
+
+	mu sync.Mutex
+	// invalidated and staled hold, by key prefix, when entries under the
+	// prefix were last invalidated and marked stale
+	invalidated map[string]time.Time
+	staled      map[string]time.Time
+	// loads are the loads in progress, by key
+	loads map[string]*call
+}
+
+// call is a load in progress, which concurrent misses wait for
+type call struct {
+	started time.Time
+	done    chan struct{}
+	value   interface{}
+	err     error
+}
+
+// New creates a Cache over store whose entries are fresh for maxAge, and
+// can be served while they are refreshed for staleFor after that
+func New(store Store, maxAge, staleFor time.Duration) *Cache {
+	return &Cache{
+		store:       store,
+		maxAge:      maxAge,
+		staleFor:    staleFor,
+		invalidated: make(map[string]time.Time),
+		staled:      make(map[string]time.Time),
+		loads:       make(map[string]*call),
+	}
+}
+
+// Get returns the value cached under key, calling load to get it if there
+// is none. A stale value is returned as it is, and refreshed in the
+// background. The value is shared with other callers and must not be
+// modified.
+func (c *Cache) Get(key string, load func() (interface{}, error)) (interface{}, error) {
+	if c == nil {
+		return load()
+	}
+
+	e, ok := c.store.Get(key)
+	if ok {
+		switch c.state(key, e) {
+		case fresh:
+			return e.Value, nil
+		case stale:
+			go func() {
+				if _, err := c.load(key, load); err != nil {
+					log.Printf("Error refreshing cached %s: %v", key, err)
+				}
+			}()
+			return e.Value, nil
+		}
+	}
+	return c.load(key, load)
+}
+
+// Invalidate drops the entries whose keys start with prefix, so the next
+// Get of each waits for a fresh load
+func (c *Cache) Invalidate(prefix string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.invalidated[prefix] = time.Now()
+	c.mu.Unlock()
+}
+
+// MarkStale marks the entries whose keys start with prefix as stale, so
+// they are refreshed but can be served in the meantime
+func (c *Cache) MarkStale(prefix string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.staled[prefix] = time.Now()
+	c.mu.Unlock()
+}
+
+// entryState is whether an entry can be served
+type entryState int
+
+const (
+	fresh entryState = iota
+	stale
+	expired
+)
+
+// state works out whether e, cached under key, is fresh, stale or expired
+func (c *Cache) state(key string, e Entry) entryState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !e.Loaded.After(c.invalidatedAt(key)) {
+		return expired
+	}
+	age := time.Since(e.Loaded)
+	if c.maxAge > 0 && age >= c.maxAge+c.staleFor {
+		return expired
+	}
+	if c.maxAge > 0 && age >= c.maxAge {
+		return stale
+	}
+	for prefix, at := range c.staled {
+		if strings.HasPrefix(key, prefix) && !e.Loaded.After(at) {
+			return stale
+		}
+	}
+	return fresh
+}
+
+// invalidatedAt returns when key was last invalidated, or the zero time.
+// c.mu must be held.
+func (c *Cache) invalidatedAt(key string) time.Time {
+	var last time.Time
+	for prefix, at := range c.invalidated {
+		if strings.HasPrefix(key, prefix) && at.After(last) {
+			last = at
+		}
+	}
+	return last
+}
+
+// load calls fn and caches its value under key, unless a load of key is
+// already in progress, in which case it waits for that one instead. A load
+// that started before key was last invalidated may have read the data from
+// before the write, so it is left to finish on its own and a new one starts.
+func (c *Cache) load(key string, fn func() (interface{}, error)) (interface{}, error) {
+	c.mu.Lock()
+	if l, ok := c.loads[key]; ok && l.started.After(c.invalidatedAt(key)) {
+		c.mu.Unlock()
+		<-l.done
+		return l.value, l.err
+	}
+	l := &call{started: time.Now(), done: make(chan struct{})}
+	c.loads[key] = l
+	c.mu.Unlock()
+
+	// Release the waiters even if fn panics
+	defer func() {
+		c.mu.Lock()
+		if c.loads[key] == l {
+			delete(c.loads, key)
+		}
+		c.mu.Unlock()
+		close(l.done)
+	}()
+
+	l.value, l.err = fn()
+	if l.err == nil {
+		c.mu.Lock()
+		superseded := c.loads[key] != l
+		c.mu.Unlock()
+		// A newer load replaces this one's value; if it has already
+		// stored it, this one's is older and must not overwrite it
+		if !superseded {
+			c.store.Set(key, Entry{Value: l.value, Loaded: l.started})
+		}
+	}
+	return l.value, l.err
+}
@@ -0,0 +1,149 @@
+package cache
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// value returns a load function that returns v and counts its calls
+func value(v string, calls *int32) func() (interface{}, error) {
+	return func() (interface{}, error) {
+		atomic.AddInt32(calls, 1)
+		return v, nil
+	}
+}
+
+func TestGetCaches(t *testing.T) {
+	c := New(NewLRU(10), 0, 0)
+	var calls int32
+	for i := 0; i < 3; i++ {
+		v, err := c.Get("k", value("a", &calls))
+		if err != nil || v != "a" {
+			t.Fatalf("Get = %v, %v", v, err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("loaded %d times, want 1", calls)
+	}
+
+	c.Invalidate("k")
+	if v, _ := c.Get("k", value("b", &calls)); v != "b" {
+		t.Errorf("after Invalidate: Get = %v, want b", v)
+	}
+}
+
+func TestConcurrentMissesShareLoad(t *testing.T) {
+	c := New(NewLRU(10), 0, 0)
+	release := make(chan struct{})
+	var calls int32
+	load := func() (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return "a", nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Get("k", load)
+		}()
+	}
+	// Let the goroutines reach the load before it returns
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if calls != 1 {
+		t.Errorf("loaded %d times, want 1", calls)
+	}
+}
+
+// A Get after an invalidation must not be given the result of a load that
+// started before it, which may have read the data from before the write
+func TestInvalidateDuringLoad(t *testing.T) {
+	c := New(NewLRU(10), 0, 0)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	oldLoad := func() (interface{}, error) {
+		close(started)
+		<-release
+		return "old", nil
+	}
+
+	oldResult := make(chan interface{})
+	go func() {
+		v, _ := c.Get("posts:hot", oldLoad)
+		oldResult <- v
+	}()
+	<-started
+
+	// A write lands while the old load is still reading
+	time.Sleep(time.Millisecond)
+	c.Invalidate("posts:")
+
+	var calls int32
+	newResult := make(chan interface{})
+	go func() {
+		v, _ := c.Get("posts:hot", value("new", &calls))
+		newResult <- v
+	}()
+	select {
+	case v := <-newResult:
+		if v != "new" {
+			t.Fatalf("Get after Invalidate = %v, want new", v)
+		}
+	case <-time.After(5 * time.Second):
+		close(release)
+		t.Fatalf("Get after Invalidate waited for the load that started before it")
+	}
+	if calls != 1 {
+		t.Errorf("the load after Invalidate ran %d times, want 1", calls)
+	}
+
+	// The old load finishes, but doesn't replace the newer value
+	close(release)
+	if v := <-oldResult; v != "old" {
+		t.Errorf("the Get that started the old load = %v, want old", v)
+	}
+	if v, _ := c.Get("posts:hot", value("newer", &calls)); v != "new" {
+		t.Errorf("Get once both loads are done = %v, want new", v)
+	}
+}
+
+func TestMarkStale(t *testing.T) {
+	c := New(NewLRU(10), 0, 0)
+	var calls int32
+	c.Get("k", value("a", &calls))
+	time.Sleep(time.Millisecond)
+	c.MarkStale("k")
+
+	refreshed := make(chan struct{})
+	v, _ := c.Get("k", func() (interface{}, error) {
+		defer close(refreshed)
+		return "b", nil
+	})
+	if v != "a" {
+		t.Errorf("stale Get = %v, want the stale value a", v)
+	}
+	<-refreshed
+	// The refresh stores its value once the load returns
+	time.Sleep(20 * time.Millisecond)
+	if v, _ := c.Get("k", value("c", &calls)); v != "b" {
+		t.Errorf("Get after the refresh = %v, want b", v)
+	}
+}
+
+func TestNilCache(t *testing.T) {
+	var c *Cache
+	var calls int32
+	c.Get("k", value("a", &calls))
+	c.Get("k", value("a", &calls))
+	c.Invalidate("k")
+	c.MarkStale("k")
+	if calls != 2 {
+		t.Errorf("a nil Cache loaded %d times, want 2", calls)
+	}
+}
@@ -0,0 +1,50 @@
+package certs
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// acmePrefix is where ACME clients such as certbot put HTTP-01 challenges
+const acmePrefix = "/.well-known/acme-challenge/"
+
+// Redirect redirects plain HTTP requests to the same URL over HTTPS on
+// httpsPort. If acmeDir is not empty, the HTTP-01 challenge files an ACME
+// client writes there are served as they are, so certificates can be
+// renewed with certbot's --webroot option while HTTPS is up.
+func Redirect(httpsPort, acmeDir string) http.Handler {
+	var challenges http.Handler
+	if acmeDir != "" {
+		challenges = http.StripPrefix(acmePrefix, http.FileServer(http.Dir(acmeDir)))
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if challenges != nil && strings.HasPrefix(r.URL.Path, acmePrefix) && !strings.HasSuffix(r.URL.Path, "/") {
+			challenges.ServeHTTP(w, r)
+			return
+		}
+
+		// Whatever port the request was for, HTTPS is on httpsPort
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		} else {
+			host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+		}
+		if strings.Contains(host, ":") {
+			// An IPv6 address
+			host = "[" + host + "]"
+		}
+		if httpsPort != "443" {
+			host += ":" + httpsPort
+		}
+
+		// 308 keeps the method and body of a form post, which 301 may not
+		status := http.StatusPermanentRedirect
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			status = http.StatusMovedPermanently
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), status)
+	})
+}
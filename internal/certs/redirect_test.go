@@ -0,0 +1,87 @@
+package certs
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRedirect(t *testing.T) {
+	tests := []struct {
+		name       string
+		httpsPort  string
+		method     string
+		host       string
+		target     string
+		wantStatus int
+		wantURL    string
+	}{
+		{"get", "443", "GET", "example.com", "/c/golang?sort=new", 301, "https://example.com/c/golang?sort=new"},
+		{"head", "443", "HEAD", "example.com", "/", 301, "https://example.com/"},
+		{"form post keeps its method", "443", "POST", "example.com", "/comments/create", 308, "https://example.com/comments/create"},
+		{"port of the request is dropped", "443", "GET", "example.com:80", "/posts/1", 301, "https://example.com/posts/1"},
+		{"other port of the request is dropped", "443", "GET", "example.com:8080", "/posts/1", 301, "https://example.com/posts/1"},
+		{"https port other than 443", "8443", "GET", "example.com:8080", "/posts/1", 301, "https://example.com:8443/posts/1"},
+		{"ipv4 address", "8443", "GET", "192.0.2.1", "/", 301, "https://192.0.2.1:8443/"},
+		{"ipv6 address", "8443", "GET", "[2001:db8::1]:80", "/", 301, "https://[2001:db8::1]:8443/"},
+		{"ipv6 address on 443", "443", "GET", "[2001:db8::1]", "/", 301, "https://[2001:db8::1]/"},
+		{"escaped path", "443", "GET", "example.com", "/u/caf%C3%A9", 301, "https://example.com/u/caf%C3%A9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.target, nil)
+			r.Host = tt.host
+			w := httptest.NewRecorder()
+			Redirect(tt.httpsPort, "").ServeHTTP(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := w.Header().Get("Location"); got != tt.wantURL {
+				t.Errorf("Location = %q, want %q", got, tt.wantURL)
+			}
+		})
+	}
+}
+
+func TestRedirectACME(t *testing.T) {
+	dir := t.TempDir()
+	challenges := filepath.Join(dir, ".well-known", "acme-challenge")
+	if err := os.MkdirAll(challenges, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(challenges, "token123"), []byte("token123.key"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(handler http.Handler, path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		r.Host = "example.com"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	// Challenge files are served over plain HTTP
+	handler := Redirect("443", challenges)
+	w := get(handler, "/.well-known/acme-challenge/token123")
+	if w.Code != http.StatusOK || w.Body.String() != "token123.key" {
+		t.Errorf("challenge: status %d, body %q; want the file", w.Code, w.Body.String())
+	}
+	if w := get(handler, "/.well-known/acme-challenge/missing"); w.Code != http.StatusNotFound {
+		t.Errorf("missing challenge: status %d, want 404", w.Code)
+	}
+
+	// The directory isn't listed; it redirects like any other page
+	if w := get(handler, "/.well-known/acme-challenge/"); w.Code != http.StatusMovedPermanently {
+		t.Errorf("challenge directory: status %d, want a redirect", w.Code)
+	}
+
+	// Without an ACME directory, challenges redirect too
+	if w := get(Redirect("443", ""), "/.well-known/acme-challenge/token123"); w.Code != http.StatusMovedPermanently {
+		t.Errorf("challenge without -acme-dir: status %d, want a redirect", w.Code)
+	}
+}
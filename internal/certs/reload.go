@@ -0,0 +1,93 @@
+// Package certs serves HTTPS with a certificate from files that are
+// renewed in place, and redirects plain HTTP to HTTPS
+package certs
+
+import (
+	"crypto/tls"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// checkInterval is how often the certificate files are checked for changes
+const checkInterval = 10 * time.Second
+
+// Reloader serves the certificate in a pair of PEM files, and loads it
+// again when either file changes, so a renewed certificate is picked up
+// without a restart. Use its GetCertificate in a tls.Config.
+type Reloader struct {
+	certFile, keyFile string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modified  time.Time // newest modification time of the files loaded
+	checkedAt time.Time
+}
+
+// NewReloader loads the certificate in certFile, with any intermediate
+// certificates after it, and its private key in keyFile
+func NewReloader(certFile, keyFile string) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile}
+	modified, err := r.lastModified()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(modified); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate returns the current certificate, first loading it again
+// if the files have changed. While the new files can't be loaded, for
+// example because only one of them has been replaced yet, the previous
+// certificate is served.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.checkedAt) >= checkInterval {
+		r.checkedAt = time.Now()
+		modified, err := r.lastModified()
+		if err == nil && !modified.Equal(r.modified) {
+			err = r.load(modified)
+			if err == nil {
+				log.Printf("Loaded new TLS certificate from %s", r.certFile)
+			}
+		}
+		if err != nil {
+			log.Printf("Error reloading TLS certificate, still serving the previous one: %v", err)
+		}
+	}
+	return r.cert, nil
+}
+
+// load loads the certificate files, which were last modified at modified.
+// The caller must hold r.mu or own r exclusively.
+func (r *Reloader) load(modified time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert = &cert
+	r.modified = modified
+	r.checkedAt = time.Now()
+	return nil
+}
+
+// lastModified returns the newest modification time of the two files,
+// following symlinks such as certbot's live directory has
+func (r *Reloader) lastModified() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
@@ -0,0 +1,153 @@
+package certs
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testPair is a self-signed certificate and its key, PEM encoded
+type testPair struct {
+	der          []byte // the certificate, to compare with what is served
+	certPEM, key []byte
+}
+
+// newTestPair creates a self-signed certificate for localhost
+func newTestPair(t *testing.T, serial int64) testPair {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testPair{
+		der:     der,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		key:     pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+// writePair writes a certificate and key to the files, and dates them
+// modified, as a renewal a while after the last one would
+func writePair(t *testing.T, certFile, keyFile string, certPEM, keyPEM []byte, modified time.Time) {
+	t.Helper()
+	for name, data := range map[string][]byte{certFile: certPEM, keyFile: keyPEM} {
+		if err := ioutil.WriteFile(name, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(name, modified, modified); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// served returns the certificate the reloader serves now. Setting
+// checkedAt back stands in for waiting out checkInterval.
+func served(t *testing.T, r *Reloader, skipWait bool) []byte {
+	t.Helper()
+	if skipWait {
+		r.mu.Lock()
+		r.checkedAt = time.Time{}
+		r.mu.Unlock()
+	}
+	cert, err := r.GetCertificate(&tls.ClientHelloInfo{ServerName: "localhost"})
+	if err != nil {
+		t.Fatalf("GetCertificate: %v", err)
+	}
+	return cert.Certificate[0]
+}
+
+func TestReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "fullchain.pem")
+	keyFile := filepath.Join(dir, "privkey.pem")
+	first, second, third := newTestPair(t, 1), newTestPair(t, 2), newTestPair(t, 3)
+	start := time.Now().Add(-time.Hour)
+
+	writePair(t, certFile, keyFile, first.certPEM, first.key, start)
+	r, err := NewReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("NewReloader: %v", err)
+	}
+	if !bytes.Equal(served(t, r, false), first.der) {
+		t.Fatalf("not serving the first certificate")
+	}
+
+	// Renewed files are served once the files are checked again
+	writePair(t, certFile, keyFile, second.certPEM, second.key, start.Add(time.Minute))
+	if !bytes.Equal(served(t, r, false), first.der) {
+		t.Errorf("files were checked again before checkInterval")
+	}
+	if !bytes.Equal(served(t, r, true), second.der) {
+		t.Fatalf("not serving the renewed certificate")
+	}
+
+	// While only the certificate has been replaced, its key doesn't match
+	// and the previous pair is kept
+	writePair(t, certFile, keyFile, third.certPEM, second.key, start.Add(2*time.Minute))
+	if !bytes.Equal(served(t, r, true), second.der) {
+		t.Errorf("not serving the previous certificate while the key doesn't match")
+	}
+
+	// Files that aren't PEM at all keep the previous pair too
+	writePair(t, certFile, keyFile, []byte("not a certificate"), []byte("not a key"), start.Add(3*time.Minute))
+	if !bytes.Equal(served(t, r, true), second.der) {
+		t.Errorf("not serving the previous certificate while the files are invalid")
+	}
+
+	// Once both files are in place, the new pair is served
+	writePair(t, certFile, keyFile, third.certPEM, third.key, start.Add(4*time.Minute))
+	if !bytes.Equal(served(t, r, true), third.der) {
+		t.Errorf("not serving the new certificate once both files are replaced")
+	}
+
+	// A missing file keeps the current pair
+	if err := os.Remove(keyFile); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(served(t, r, true), third.der) {
+		t.Errorf("not serving the current certificate while the key file is missing")
+	}
+}
+
+func TestNewReloaderErrors(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "fullchain.pem")
+	keyFile := filepath.Join(dir, "privkey.pem")
+	if _, err := NewReloader(certFile, keyFile); err == nil {
+		t.Errorf("NewReloader with missing files: no error")
+	}
+
+	pair, other := newTestPair(t, 1), newTestPair(t, 2)
+	writePair(t, certFile, keyFile, pair.certPEM, other.key, time.Now())
+	if _, err := NewReloader(certFile, keyFile); err == nil {
+		t.Errorf("NewReloader with a key that doesn't match: no error")
+	}
+}
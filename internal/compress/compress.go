@@ -0,0 +1,241 @@
+// Package compress compresses responses with brotli or gzip, whichever the
+// client prefers
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Encodings this package produces, in order of preference
+const (
+	Brotli = "br"
+	Gzip   = "gzip"
+)
+
+// minSize is the smallest response worth compressing; smaller ones can
+// grow, and fit in a packet either way
+const minSize = 1024
+
+// Compression levels for responses compressed as they are sent, which
+// trade some size for speed. Files compressed once, by Encode, get the
+// best compression.
+const (
+	brotliLevel = 5
+	gzipLevel   = 6
+)
+
+// Negotiate returns the encoding to use for a request with the given
+// Accept-Encoding header: brotli or gzip, preferring the one with the
+// higher q-value and then brotli, or "" if the client accepts neither
+func Negotiate(acceptEncoding string) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		if len(fields) > 1 && strings.HasPrefix(strings.TrimSpace(fields[1]), "q=") {
+			parsed, err := strconv.ParseFloat(strings.TrimPrefix(strings.TrimSpace(fields[1]), "q="), 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+
+		var candidates []string
+		switch name {
+		case Brotli, Gzip:
+			candidates = []string{name}
+		case "*":
+			candidates = []string{Brotli, Gzip}
+		}
+		for _, encoding := range candidates {
+			if q > bestQ || (q == bestQ && q > 0 && encoding == Brotli) {
+				best, bestQ = encoding, q
+			}
+		}
+	}
+	return best
+}
+
+// Compressible reports whether a response with the given Content-Type is
+// worth compressing. Images other than SVG, fonts and archives are
+// compressed already.
+func Compressible(contentType string) bool {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	switch {
+	case strings.HasPrefix(mediaType, "text/"):
+		return true
+	case mediaType == "application/javascript", mediaType == "application/json",
+		mediaType == "application/manifest+json", mediaType == "application/xml",
+		mediaType == "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+// Encode compresses data with an encoding at the best compression, for
+// files that are compressed once and served many times
+func Encode(encoding string, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case Brotli:
+		w = brotli.NewWriterLevel(&buf, brotli.BestCompression)
+	case Gzip:
+		gw, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+		if err != nil {
+			return nil, err
+		}
+		w = gw
+	default:
+		return data, nil
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Writers are reused between responses, as setting one up allocates a lot
+var (
+	brotliWriters = sync.Pool{New: func() interface{} {
+		return brotli.NewWriterLevel(nil, brotliLevel)
+	}}
+	gzipWriters = sync.Pool{New: func() interface{} {
+		w, _ := gzip.NewWriterLevel(nil, gzipLevel)
+		return w
+	}}
+)
+
+// Handler compresses the responses of next for clients that accept brotli
+// or gzip. Responses that are small, of a type that doesn't compress, or
+// already encoded, such as precompressed static files, are sent as they are.
+func Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := Negotiate(r.Header.Get("Accept-Encoding"))
+		// Ranges refer to the uncompressed bytes the handler sends
+		if encoding == "" || r.Method == http.MethodHead || r.Header.Get("Range") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &responseWriter{ResponseWriter: w, encoding: encoding}
+		defer cw.Close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// responseWriter compresses a response on its way to the client. It holds
+// back the header until the first write, when it can tell whether the
+// response is worth compressing.
+type responseWriter struct {
+	http.ResponseWriter
+	encoding string
+
+	status      int
+	wroteHeader bool // whether the header was passed on
+	compressor  io.WriteCloser
+}
+
+func (cw *responseWriter) WriteHeader(status int) {
+	if cw.status == 0 {
+		cw.status = status
+	}
+}
+
+func (cw *responseWriter) Write(b []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	if !cw.wroteHeader {
+		cw.start(len(b))
+	}
+	if cw.compressor != nil {
+		return cw.compressor.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// start decides whether to compress the response, whose first write is
+// size bytes, and passes on the header
+func (cw *responseWriter) start(size int) {
+	cw.wroteHeader = true
+	header := cw.Header()
+	if header.Get("Content-Type") == "" {
+		// Let net/http sniff the type, as it would without compression
+		cw.ResponseWriter.WriteHeader(cw.status)
+		return
+	}
+	length := size
+	if cl, err := strconv.Atoi(header.Get("Content-Length")); err == nil {
+		length = cl
+	}
+	if cw.status != http.StatusOK || header.Get("Content-Encoding") != "" ||
+		!Compressible(header.Get("Content-Type")) || length < minSize {
+		cw.ResponseWriter.WriteHeader(cw.status)
+		return
+	}
+
+	header.Set("Content-Encoding", cw.encoding)
+	header.Del("Content-Length")
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		// The compressed bytes differ, so they can't share a strong ETag
+		header.Set("ETag", "W/"+etag)
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+
+	switch cw.encoding {
+	case Brotli:
+		bw := brotliWriters.Get().(*brotli.Writer)
+		bw.Reset(cw.ResponseWriter)
+		cw.compressor = bw
+	case Gzip:
+		gw := gzipWriters.Get().(*gzip.Writer)
+		gw.Reset(cw.ResponseWriter)
+		cw.compressor = gw
+	}
+}
+
+// Close finishes the compressed stream, or passes on the header of a
+// response that was never written to
+func (cw *responseWriter) Close() {
+	if !cw.wroteHeader {
+		if cw.status != 0 {
+			cw.ResponseWriter.WriteHeader(cw.status)
+		}
+		return
+	}
+	switch c := cw.compressor.(type) {
+	case *brotli.Writer:
+		c.Close()
+		brotliWriters.Put(c)
+	case *gzip.Writer:
+		c.Close()
+		gzipWriters.Put(c)
+	}
+}
+
+// Flush sends what has been compressed so far, for handlers that stream
+func (cw *responseWriter) Flush() {
+	switch c := cw.compressor.(type) {
+	case *brotli.Writer:
+		c.Flush()
+	case *gzip.Writer:
+		c.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,66 @@
+package database
+
+import (
+	"database/sql"
+)
+
+// communityRows are the statements that delete what belongs to a community,
+// in an order that leaves no row referring to a deleted one. Each takes the
+// community's ID once.
+var communityRows = []string{
+	// Crossposts in other communities stay, without their original
+	"UPDATE posts SET crosspost_parent_id = NULL WHERE crosspost_parent_id IN (SELECT id FROM posts WHERE community_id = ?)",
+	"DELETE FROM votes WHERE item_type = 'comment' AND item_id IN (SELECT c.id FROM comments c JOIN posts p ON c.post_id = p.id WHERE p.community_id = ?)",
+	"DELETE FROM votes WHERE item_type = 'post' AND item_id IN (SELECT id FROM posts WHERE community_id = ?)",
+	"DELETE FROM saved_items WHERE item_type = 'comment' AND item_id IN (SELECT c.id FROM comments c JOIN posts p ON c.post_id = p.id WHERE p.community_id = ?)",
+	"DELETE FROM saved_items WHERE item_type = 'post' AND item_id IN (SELECT id FROM posts WHERE community_id = ?)",
+	"DELETE FROM hidden_items WHERE item_type = 'comment' AND item_id IN (SELECT c.id FROM comments c JOIN posts p ON c.post_id = p.id WHERE p.community_id = ?)",
+	"DELETE FROM hidden_items WHERE item_type = 'post' AND item_id IN (SELECT id FROM posts WHERE community_id = ?)",
+	"DELETE FROM comments WHERE post_id IN (SELECT id FROM posts WHERE community_id = ?)",
+	"DELETE FROM poll_votes WHERE post_id IN (SELECT id FROM posts WHERE community_id = ?)",
+	"DELETE FROM poll_options WHERE post_id IN (SELECT id FROM posts WHERE community_id = ?)",
+	"DELETE FROM polls WHERE post_id IN (SELECT id FROM posts WHERE community_id = ?)",
+	"DELETE FROM posts WHERE community_id = ?",
+	"DELETE FROM flair_templates WHERE community_id = ?",
+	"DELETE FROM user_flair WHERE community_id = ?",
+	"DELETE FROM community_rules WHERE community_id = ?",
+	"DELETE FROM community_moderators WHERE community_id = ?",
+	"DELETE FROM subscriptions WHERE community_id = ?",
+	"DELETE FROM communities WHERE id = ?",
+}
+
+// DeleteCommunity deletes a community with its posts, their comments and
+// polls, and everything else that belongs to it, in the caller's
+// transaction, so the deletion can be logged in the same one. The votes on
+// its posts and comments are deleted too, and taken out of their authors'
+// karma. It returns sql.ErrNoRows if there is no such community.
+func DeleteCommunity(tx *sql.Tx, id int) error {
+	var exists int
+	if err := tx.QueryRow("SELECT 1 FROM communities WHERE id = ?", id).Scan(&exists); err != nil {
+		return err
+	}
+
+	_, err := tx.Exec(`
+	UPDATE identities SET
+		post_karma = post_karma - COALESCE((
+			SELECT SUM(v.vote_type) FROM votes v JOIN posts p ON v.item_id = p.id
+			WHERE v.item_type = 'post' AND v.quarantined = 0 AND p.author_id = identities.id AND p.community_id = ?), 0),
+		comment_karma = comment_karma - COALESCE((
+			SELECT SUM(v.vote_type) FROM votes v JOIN comments c ON v.item_id = c.id JOIN posts p ON c.post_id = p.id
+			WHERE v.item_type = 'comment' AND v.quarantined = 0 AND c.author_id = identities.id AND p.community_id = ?), 0)
+	WHERE id IN (
+		SELECT author_id FROM posts WHERE community_id = ?
+		UNION
+		SELECT c.author_id FROM comments c JOIN posts p ON c.post_id = p.id WHERE p.community_id = ?)`,
+		id, id, id, id)
+	if err != nil {
+		return err
+	}
+
+	for _, query := range communityRows {
+		if _, err := tx.Exec(query, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -2,7 +2,12 @@ package database
 
 import (
 	"database/sql"
+	"errors"
 	"log"
+
+	"hubcorner/internal/names"
+
+	"github.com/mattn/go-sqlite3"
 )
 
 // InitDB initializes the database schema
@@ -71,14 +76,429 @@ func InitDB(db *sql.DB) error {
 		return err
 	}
 
+	// Create identities table. An identity is created for every client_id
+	// cookie; it becomes an account once a username is chosen.
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS identities (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		client_id TEXT NOT NULL UNIQUE,
+		username TEXT UNIQUE COLLATE NOCASE,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`)
+	if err != nil {
+		log.Printf("Error creating identities table: %v", err)
+		return err
+	}
+
+	// Community settings
+	communityColumns := []struct{ name, definition string }{
+		{"sidebar", "TEXT DEFAULT ''"},
+		{"banner_url", "TEXT DEFAULT ''"},
+		{"icon_url", "TEXT DEFAULT ''"},
+		{"type", "TEXT NOT NULL DEFAULT 'public'"},            // 'public', 'restricted' or 'private'
+		{"allowed_post_types", "TEXT NOT NULL DEFAULT 'any'"}, // 'any', 'text' or 'link'
+		{"min_account_age_days", "INTEGER NOT NULL DEFAULT 0"},
+		{"allow_anonymous", "INTEGER NOT NULL DEFAULT 1"},
+		{"min_karma", "INTEGER DEFAULT NULL"}, // NULL for no karma requirement
+	}
+	for _, column := range communityColumns {
+		if err := addColumn(db, "communities", column.name, column.definition); err != nil {
+			log.Printf("Error adding communities.%s column: %v", column.name, err)
+			return err
+		}
+	}
+
+	// Link posts store their target URL; text posts leave it empty
+	if err := addColumn(db, "posts", "url", "TEXT DEFAULT ''"); err != nil {
+		log.Printf("Error adding posts.url column: %v", err)
+		return err
+	}
+
+	// Create community rules table
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS community_rules (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		community_id INTEGER NOT NULL,
+		position INTEGER NOT NULL,
+		text TEXT NOT NULL,
+		FOREIGN KEY (community_id) REFERENCES communities(id)
+	)`)
+	if err != nil {
+		log.Printf("Error creating community_rules table: %v", err)
+		return err
+	}
+
+	// Create community moderators table. The creator of a community is its first moderator.
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS community_moderators (
+		community_id INTEGER NOT NULL,
+		identity_id INTEGER NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (community_id, identity_id),
+		FOREIGN KEY (community_id) REFERENCES communities(id),
+		FOREIGN KEY (identity_id) REFERENCES identities(id)
+	)`)
+	if err != nil {
+		log.Printf("Error creating community_moderators table: %v", err)
+		return err
+	}
+
+	// Create subscriptions table. Subscriptions belong to an identity, whether
+	// or not it has chosen a username.
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS subscriptions (
+		identity_id INTEGER NOT NULL,
+		community_id INTEGER NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (identity_id, community_id),
+		FOREIGN KEY (identity_id) REFERENCES identities(id),
+		FOREIGN KEY (community_id) REFERENCES communities(id)
+	)`)
+	if err != nil {
+		log.Printf("Error creating subscriptions table: %v", err)
+		return err
+	}
+
+	// Create saved and hidden items tables. Both hold posts and comments per identity.
+	for _, table := range []string{"saved_items", "hidden_items"} {
+		_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS ` + table + ` (
+			identity_id INTEGER NOT NULL,
+			item_type TEXT NOT NULL,  -- 'post' or 'comment'
+			item_id INTEGER NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (identity_id, item_type, item_id),
+			FOREIGN KEY (identity_id) REFERENCES identities(id)
+		)`)
+		if err != nil {
+			log.Printf("Error creating %s table: %v", table, err)
+			return err
+		}
+	}
+
+	// Community names are unique by their canonical key, so names that differ
+	// only in case or lookalike characters cannot both exist
+	if err := addColumn(db, "communities", "name_key", "TEXT"); err != nil {
+		log.Printf("Error adding communities.name_key column: %v", err)
+		return err
+	}
+	_, err = db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_communities_name_key ON communities(name_key)")
+	if err != nil {
+		log.Printf("Error creating communities name_key index: %v", err)
+		return err
+	}
+	if err := backfillNameKeys(db); err != nil {
+		log.Printf("Error filling in community name keys: %v", err)
+		return err
+	}
+
+	// Create flair templates table. Moderators define the post flair of their community.
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS flair_templates (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		community_id INTEGER NOT NULL,
+		text TEXT NOT NULL,
+		color TEXT NOT NULL DEFAULT '#e0e0e0',
+		mod_only INTEGER NOT NULL DEFAULT 0,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (community_id) REFERENCES communities(id)
+	)`)
+	if err != nil {
+		log.Printf("Error creating flair_templates table: %v", err)
+		return err
+	}
+
+	// Create user flair table, one flair per identity per community
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS user_flair (
+		community_id INTEGER NOT NULL,
+		identity_id INTEGER NOT NULL,
+		text TEXT NOT NULL,
+		PRIMARY KEY (community_id, identity_id),
+		FOREIGN KEY (community_id) REFERENCES communities(id),
+		FOREIGN KEY (identity_id) REFERENCES identities(id)
+	)`)
+	if err != nil {
+		log.Printf("Error creating user_flair table: %v", err)
+		return err
+	}
+
+	// Later columns of posts, comments and identities. Older posts and
+	// comments have no author.
+	itemColumns := []struct{ table, name, definition string }{
+		{"posts", "flair_id", "INTEGER REFERENCES flair_templates(id)"},
+		{"posts", "author_id", "INTEGER REFERENCES identities(id)"},
+		{"comments", "author_id", "INTEGER REFERENCES identities(id)"},
+		// A crosspost refers to the original post it shares
+		{"posts", "crosspost_parent_id", "INTEGER REFERENCES posts(id)"},
+		// Pinned posts are shown above the sorted listing of their community,
+		// or of the front page; locked posts accept no new comments
+		{"posts", "pinned_at", "TIMESTAMP DEFAULT NULL"},
+		{"posts", "front_pinned_at", "TIMESTAMP DEFAULT NULL"},
+		{"posts", "locked", "INTEGER NOT NULL DEFAULT 0"},
+		// Admins manage the whole site; they are granted with the grant-admin command
+		{"identities", "is_admin", "INTEGER NOT NULL DEFAULT 0"},
+		// Users can keep their post and comment history off their profile
+		{"identities", "hide_posts", "INTEGER NOT NULL DEFAULT 0"},
+		{"identities", "hide_comments", "INTEGER NOT NULL DEFAULT 0"},
+		// Votes remember the network they came from, and whether the vote
+		// analyser has taken them out of the counts (see votecheck.go)
+		{"votes", "ip_range", "TEXT NOT NULL DEFAULT ''"},
+		{"votes", "quarantined", "INTEGER NOT NULL DEFAULT 0"},
+		{"votes", "reviewed", "INTEGER NOT NULL DEFAULT 0"},
+		{"votes", "flag_reason", "TEXT DEFAULT NULL"},
+		// Admins can lock a community, which then takes no new posts or
+		// comments, or quarantine it, which keeps it out of the community
+		// list and the site-wide feeds
+		{"communities", "locked", "INTEGER NOT NULL DEFAULT 0"},
+		{"communities", "quarantined", "INTEGER NOT NULL DEFAULT 0"},
+	}
+	for _, column := range itemColumns {
+		if err := addColumn(db, column.table, column.name, column.definition); err != nil {
+			log.Printf("Error adding %s.%s column: %v", column.table, column.name, err)
+			return err
+		}
+	}
+
+	// Karma totals are kept up to date as votes come in. When the columns
+	// are first added, they are filled in from the votes so far.
+	hasKarma, err := hasColumn(db, "identities", "post_karma")
+	if err != nil {
+		log.Printf("Error checking identities columns: %v", err)
+		return err
+	}
+	if !hasKarma {
+		for _, column := range []string{"post_karma", "comment_karma"} {
+			if err := addColumn(db, "identities", column, "INTEGER NOT NULL DEFAULT 0"); err != nil {
+				log.Printf("Error adding identities.%s column: %v", column, err)
+				return err
+			}
+		}
+		if err := RebuildKarma(db); err != nil {
+			log.Printf("Error computing karma: %v", err)
+			return err
+		}
+	}
+
+	// Comment and post counts are kept up to date as comments and posts
+	// are created, like the vote counts, and checked by Reconcile. When the
+	// columns are first added, they are counted from the rows so far.
+	countColumns := []struct{ table, name string }{
+		{"posts", "comment_count"},
+		{"communities", "post_count"},
+	}
+	for _, column := range countColumns {
+		exists, err := hasColumn(db, column.table, column.name)
+		if err != nil {
+			log.Printf("Error checking %s columns: %v", column.table, err)
+			return err
+		}
+		if exists {
+			continue
+		}
+		if err := addColumn(db, column.table, column.name, "INTEGER NOT NULL DEFAULT 0"); err != nil {
+			log.Printf("Error adding %s.%s column: %v", column.table, column.name, err)
+			return err
+		}
+		if err := fillCounter(db, column.table, column.name); err != nil {
+			log.Printf("Error counting %s.%s: %v", column.table, column.name, err)
+			return err
+		}
+	}
+
+	// Create polls tables. A poll post has one row in polls and 2 to 10 options.
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS polls (
+		post_id INTEGER PRIMARY KEY,
+		closes_at TIMESTAMP DEFAULT NULL,
+		results_visibility TEXT NOT NULL DEFAULT 'after_vote', -- 'after_vote' or 'after_close'
+		FOREIGN KEY (post_id) REFERENCES posts(id)
+	)`)
+	if err != nil {
+		log.Printf("Error creating polls table: %v", err)
+		return err
+	}
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS poll_options (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		post_id INTEGER NOT NULL,
+		position INTEGER NOT NULL,
+		text TEXT NOT NULL,
+		FOREIGN KEY (post_id) REFERENCES polls(post_id)
+	)`)
+	if err != nil {
+		log.Printf("Error creating poll_options table: %v", err)
+		return err
+	}
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS poll_votes (
+		post_id INTEGER NOT NULL,
+		identity_id INTEGER NOT NULL,
+		option_id INTEGER NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (post_id, identity_id),
+		FOREIGN KEY (post_id) REFERENCES polls(post_id),
+		FOREIGN KEY (identity_id) REFERENCES identities(id),
+		FOREIGN KEY (option_id) REFERENCES poll_options(id)
+	)`)
+	if err != nil {
+		log.Printf("Error creating poll_votes table: %v", err)
+		return err
+	}
+
+	// Create moderation log table. Entries keep the community's name, as
+	// they outlive communities that admins delete.
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS mod_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		identity_id INTEGER NOT NULL,
+		community_id INTEGER DEFAULT NULL, -- NULL for site-wide actions
+		community_name TEXT NOT NULL DEFAULT '',
+		action TEXT NOT NULL,
+		target TEXT NOT NULL DEFAULT '', -- what was acted on, as shown in the log
+		link TEXT NOT NULL DEFAULT '',   -- where the target can be seen
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (identity_id) REFERENCES identities(id)
+	)`)
+	if err != nil {
+		log.Printf("Error creating mod_log table: %v", err)
+		return err
+	}
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS idx_mod_log_community ON mod_log(community_id)")
+	if err != nil {
+		log.Printf("Error creating mod_log community index: %v", err)
+		return err
+	}
+
+	// Create site bans table. A ban is of an identity or of a network; banned
+	// clients can read the site, but not post, comment or vote.
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS site_bans (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		identity_id INTEGER UNIQUE,
+		ip_range TEXT UNIQUE, -- in CIDR notation
+		reason TEXT NOT NULL DEFAULT '',
+		created_by INTEGER,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		expires_at TIMESTAMP DEFAULT NULL, -- NULL for a permanent ban
+		FOREIGN KEY (identity_id) REFERENCES identities(id),
+		FOREIGN KEY (created_by) REFERENCES identities(id),
+		CHECK ((identity_id IS NULL) != (ip_range IS NULL))
+	)`)
+	if err != nil {
+		log.Printf("Error creating site_bans table: %v", err)
+		return err
+	}
+
+	// Create announcements table. Admins post announcements, shown above
+	// every page until they are removed.
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS announcements (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		message TEXT NOT NULL, -- markdown
+		created_by INTEGER,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (created_by) REFERENCES identities(id)
+	)`)
+	if err != nil {
+		log.Printf("Error creating announcements table: %v", err)
+		return err
+	}
+
+	// Foreign keys are enforced since connections are opened with Open.
+	// Rows written before that may still refer to rows that don't exist.
+	var broken int
+	if err := db.QueryRow("SELECT COUNT(*) FROM pragma_foreign_key_check").Scan(&broken); err != nil {
+		log.Printf("Error checking foreign keys: %v", err)
+		return err
+	}
+	if broken > 0 {
+		log.Printf("Warning: %d row(s) refer to rows that do not exist; run PRAGMA foreign_key_check in sqlite3 for details", broken)
+	}
+
 	return nil
 }
 
+// backfillNameKeys sets name_key for communities created before it existed,
+// and for those whose key was made by an older version of names.Key. When
+// two old names share a key, the newer one keeps no key or its old one; the
+// check-names command reports it so an admin can rename it.
+func backfillNameKeys(db *sql.DB) error {
+	rows, err := db.Query("SELECT id, name, name_key FROM communities ORDER BY id ASC")
+	if err != nil {
+		return err
+	}
+	type community struct {
+		id   int
+		name string
+	}
+	var pending []community
+	for rows.Next() {
+		var c community
+		var key sql.NullString
+		if err := rows.Scan(&c.id, &c.name, &key); err != nil {
+			rows.Close()
+			return err
+		}
+		if !key.Valid || key.String != names.Key(c.name) {
+			pending = append(pending, c)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, c := range pending {
+		_, err := db.Exec("UPDATE communities SET name_key = ? WHERE id = ?", names.Key(c.name), c.id)
+		if err != nil && !isUniqueViolation(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// isUniqueViolation reports whether err is a SQLite UNIQUE constraint failure
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+}
+
+// addColumn adds a column to an existing table unless it is already there,
+// so databases created by older versions pick up new columns
+func addColumn(db *sql.DB, table, column, definition string) error {
+	exists, err := hasColumn(db, table, column)
+	if err != nil || exists {
+		return err
+	}
+	_, err = db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	return err
+}
+
+// hasColumn reports whether a table has a column
+func hasColumn(db *sql.DB, table, column string) (bool, error) {
+	rows, err := db.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
 // GetCommunities retrieves all communities from the database
 func GetCommunities(db *sql.DB) ([]map[string]interface{}, error) {
 	rows, err := db.Query(`
-	SELECT id, name, description, created_at,
-	       (SELECT COUNT(*) FROM posts WHERE community_id = communities.id) as post_count
+	SELECT id, name, description, created_at, post_count
 	FROM communities
 	ORDER BY name ASC
 	`)
@@ -109,13 +529,90 @@ func GetCommunities(db *sql.DB) ([]map[string]interface{}, error) {
 
 // CreateCommunity adds a new community to the database
 func CreateCommunity(db *sql.DB, name, description string) (int64, error) {
-	result, err := db.Exec("INSERT INTO communities (name, description) VALUES (?, ?)", name, description)
+	result, err := WriteExec(db, "INSERT INTO communities (name, name_key, description) VALUES (?, ?, ?)", name, names.Key(name), description)
 	if err != nil {
 		return 0, err
 	}
 	return result.LastInsertId()
 }
 
+// NameProblem describes an existing community whose name breaks the naming rules
+type NameProblem struct {
+	ID      int
+	Name    string
+	Problem string
+}
+
+// CheckCommunityNames reports existing communities whose names are invalid,
+// reserved, or look like the name of an older community
+func CheckCommunityNames(db *sql.DB) ([]NameProblem, error) {
+	rows, err := db.Query("SELECT id, name, name_key FROM communities ORDER BY id ASC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var problems []NameProblem
+	owners := make(map[string]string) // name key -> first community name with that key
+	for rows.Next() {
+		var id int
+		var name string
+		var nameKey sql.NullString
+		if err := rows.Scan(&id, &name, &nameKey); err != nil {
+			return nil, err
+		}
+
+		key := names.Key(name)
+		if err := names.Validate(name); err != nil {
+			problems = append(problems, NameProblem{ID: id, Name: name, Problem: err.Error()})
+		}
+		if owner, ok := owners[key]; ok {
+			problems = append(problems, NameProblem{ID: id, Name: name, Problem: "Looks like the older community c/" + owner})
+		} else {
+			owners[key] = name
+		}
+		if nameKey.Valid && nameKey.String != key {
+			problems = append(problems, NameProblem{ID: id, Name: name, Problem: "Stored name key is out of date"})
+		}
+	}
+	return problems, rows.Err()
+}
+
+// ErrNoSuchUser is returned when no identity has the given username
+var ErrNoSuchUser = errors.New("no user with that username")
+
+// SetAdmin grants or revokes admin rights for the identity with a username
+func SetAdmin(db *sql.DB, username string, admin bool) error {
+	result, err := WriteExec(db, "UPDATE identities SET is_admin = ? WHERE username = ?", admin, username)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNoSuchUser
+	}
+	return nil
+}
+
+// RebuildKarma recomputes the post and comment karma of every identity from
+// the votes table. Karma is the sum of the votes on an identity's posts or
+// comments, leaving out quarantined votes; CastVote keeps it current
+// between rebuilds.
+func RebuildKarma(db *sql.DB) error {
+	_, err := WriteExec(db, `
+	UPDATE identities SET
+		post_karma = COALESCE((
+			SELECT SUM(v.vote_type) FROM votes v JOIN posts p ON v.item_id = p.id
+			WHERE v.item_type = 'post' AND v.quarantined = 0 AND p.author_id = identities.id), 0),
+		comment_karma = COALESCE((
+			SELECT SUM(v.vote_type) FROM votes v JOIN comments c ON v.item_id = c.id
+			WHERE v.item_type = 'comment' AND v.quarantined = 0 AND c.author_id = identities.id), 0)`)
+	return err
+}
+
 // GetCommunity retrieves a single community by ID
 func GetCommunity(db *sql.DB, id int) (map[string]interface{}, error) {
 	var name, description, createdAt string
@@ -155,8 +652,7 @@ func GetPosts(db *sql.DB, communityID int) ([]map[string]interface{}, error) {
 	if communityID > 0 {
 		query = `
 		SELECT p.id, p.title, p.content, p.community_id, p.created_at, p.upvotes, p.downvotes, 
-		       c.name as community_name,
-		       (SELECT COUNT(*) FROM comments WHERE post_id = p.id) as comment_count
+		       c.name as community_name, p.comment_count
 		FROM posts p
 		JOIN communities c ON p.community_id = c.id
 		WHERE p.community_id = ?
@@ -166,8 +662,7 @@ func GetPosts(db *sql.DB, communityID int) ([]map[string]interface{}, error) {
 	} else {
 		query = `
 		SELECT p.id, p.title, p.content, p.community_id, p.created_at, p.upvotes, p.downvotes, 
-		       c.name as community_name,
-		       (SELECT COUNT(*) FROM comments WHERE post_id = p.id) as comment_count
+		       c.name as community_name, p.comment_count
 		FROM posts p
 		JOIN communities c ON p.community_id = c.id
 		ORDER BY (p.upvotes - p.downvotes) DESC, p.created_at DESC
@@ -203,13 +698,20 @@ func GetPosts(db *sql.DB, communityID int) ([]map[string]interface{}, error) {
 	return posts, nil
 }
 
-// CreatePost adds a new post to the database
-func CreatePost(db *sql.DB, title, content string, communityID int) (int64, error) {
-	result, err := db.Exec("INSERT INTO posts (title, content, community_id) VALUES (?, ?, ?)", title, content, communityID)
-	if err != nil {
-		return 0, err
-	}
-	return result.LastInsertId()
+// CreatePost adds a new post to the database and counts it in its community
+func CreatePost(db *sql.DB, title, content string, communityID int) (id int64, err error) {
+	err = WriteTx(db, func(tx *sql.Tx) error {
+		result, err := tx.Exec("INSERT INTO posts (title, content, community_id) VALUES (?, ?, ?)", title, content, communityID)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE communities SET post_count = post_count + 1 WHERE id = ?", communityID); err != nil {
+			return err
+		}
+		id, err = result.LastInsertId()
+		return err
+	})
+	return id, err
 }
 
 // GetPost retrieves a single post by ID
@@ -237,220 +739,24 @@ func GetPost(db *sql.DB, id int) (map[string]interface{}, error) {
 	}, nil
 }
 
-// GetComments retrieves comments for a post
-func GetComments(db *sql.DB, postID int) ([]map[string]interface{}, error) {
-	rows, err := db.Query(`
-	SELECT id, content, post_id, parent_id, created_at, upvotes, downvotes
-	FROM comments
-	WHERE post_id = ?
-	ORDER BY (upvotes - downvotes) DESC, created_at ASC
-	`, postID)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var comments []map[string]interface{}
-	for rows.Next() {
-		var id, postID, upvotes, downvotes int
-		var content, createdAt string
-		var parentID sql.NullInt64
-		if err := rows.Scan(&id, &content, &postID, &parentID, &createdAt, &upvotes, &downvotes); err != nil {
-			return nil, err
-		}
-
-		var parentIDValue interface{}
-		if parentID.Valid {
-			parentIDValue = parentID.Int64
+// CreateComment adds a new comment to the database and counts it in its post
+func CreateComment(db *sql.DB, content string, postID int, parentID *int) (id int64, err error) {
+	err = WriteTx(db, func(tx *sql.Tx) error {
+		var result sql.Result
+		var err error
+		if parentID != nil {
+			result, err = tx.Exec("INSERT INTO comments (content, post_id, parent_id) VALUES (?, ?, ?)", content, postID, parentID)
 		} else {
-			parentIDValue = nil
+			result, err = tx.Exec("INSERT INTO comments (content, post_id) VALUES (?, ?)", content, postID)
 		}
-
-		comments = append(comments, map[string]interface{}{
-			"id":         id,
-			"content":    content,
-			"post_id":    postID,
-			"parent_id":  parentIDValue,
-			"created_at": createdAt,
-			"upvotes":    upvotes,
-			"downvotes":  downvotes,
-			"score":      upvotes - downvotes,
-		})
-	}
-	return comments, nil
-}
-
-// CreateComment adds a new comment to the database
-func CreateComment(db *sql.DB, content string, postID int, parentID *int) (int64, error) {
-	var result sql.Result
-	var err error
-
-	if parentID != nil {
-		result, err = db.Exec("INSERT INTO comments (content, post_id, parent_id) VALUES (?, ?, ?)", content, postID, parentID)
-	} else {
-		result, err = db.Exec("INSERT INTO comments (content, post_id) VALUES (?, ?)", content, postID)
-	}
-
-	if err != nil {
-		return 0, err
-	}
-	return result.LastInsertId()
-}
-
-// VotePost handles voting on a post
-func VotePost(db *sql.DB, postID int, clientID string, voteType int) error {
-	tx, err := db.Begin()
-	if err != nil {
-		return err
-	}
-	defer func() {
-		if err != nil {
-			tx.Rollback()
-			return
-		}
-		err = tx.Commit()
-	}()
-
-	// Check if user already voted on this post
-	var existingVoteType int
-	var voteExists bool
-	err = tx.QueryRow("SELECT vote_type FROM votes WHERE item_type = 'post' AND item_id = ? AND client_id = ?", postID, clientID).Scan(&existingVoteType)
-	if err == nil {
-		voteExists = true
-	} else if err != sql.ErrNoRows {
-		return err
-	}
-
-	if voteExists {
-		// If vote type is the same, remove the vote (toggle off)
-		if existingVoteType == voteType {
-			_, err = tx.Exec("DELETE FROM votes WHERE item_type = 'post' AND item_id = ? AND client_id = ?", postID, clientID)
-			if err != nil {
-				return err
-			}
-
-			// Update post vote counts
-			if voteType == 1 {
-				_, err = tx.Exec("UPDATE posts SET upvotes = upvotes - 1 WHERE id = ?", postID)
-			} else {
-				_, err = tx.Exec("UPDATE posts SET downvotes = downvotes - 1 WHERE id = ?", postID)
-			}
-			if err != nil {
-				return err
-			}
-		} else {
-			// If vote type is different, update the vote
-			_, err = tx.Exec("UPDATE votes SET vote_type = ? WHERE item_type = 'post' AND item_id = ? AND client_id = ?", voteType, postID, clientID)
-			if err != nil {
-				return err
-			}
-
-			// Update post vote counts
-			if voteType == 1 {
-				_, err = tx.Exec("UPDATE posts SET upvotes = upvotes + 1, downvotes = downvotes - 1 WHERE id = ?", postID)
-			} else {
-				_, err = tx.Exec("UPDATE posts SET upvotes = upvotes - 1, downvotes = downvotes + 1 WHERE id = ?", postID)
-			}
-			if err != nil {
-				return err
-			}
-		}
-	} else {
-		// Insert new vote
-		_, err = tx.Exec("INSERT INTO votes (item_type, item_id, client_id, vote_type) VALUES ('post', ?, ?, ?)", postID, clientID, voteType)
 		if err != nil {
 			return err
 		}
-
-		// Update post vote counts
-		if voteType == 1 {
-			_, err = tx.Exec("UPDATE posts SET upvotes = upvotes + 1 WHERE id = ?", postID)
-		} else {
-			_, err = tx.Exec("UPDATE posts SET downvotes = downvotes + 1 WHERE id = ?", postID)
-		}
-		if err != nil {
+		if _, err := tx.Exec("UPDATE posts SET comment_count = comment_count + 1 WHERE id = ?", postID); err != nil {
 			return err
 		}
-	}
-
-	return nil
-}
-
-// VoteComment handles voting on a comment
-func VoteComment(db *sql.DB, commentID int, clientID string, voteType int) error {
-	tx, err := db.Begin()
-	if err != nil {
+		id, err = result.LastInsertId()
 		return err
-	}
-	defer func() {
-		if err != nil {
-			tx.Rollback()
-			return
-		}
-		err = tx.Commit()
-	}()
-
-	// Check if user already voted on this comment
-	var existingVoteType int
-	var voteExists bool
-	err = tx.QueryRow("SELECT vote_type FROM votes WHERE item_type = 'comment' AND item_id = ? AND client_id = ?", commentID, clientID).Scan(&existingVoteType)
-	if err == nil {
-		voteExists = true
-	} else if err != sql.ErrNoRows {
-		return err
-	}
-
-	if voteExists {
-		// If vote type is the same, remove the vote (toggle off)
-		if existingVoteType == voteType {
-			_, err = tx.Exec("DELETE FROM votes WHERE item_type = 'comment' AND item_id = ? AND client_id = ?", commentID, clientID)
-			if err != nil {
-				return err
-			}
-
-			// Update comment vote counts
-			if voteType == 1 {
-				_, err = tx.Exec("UPDATE comments SET upvotes = upvotes - 1 WHERE id = ?", commentID)
-			} else {
-				_, err = tx.Exec("UPDATE comments SET downvotes = downvotes - 1 WHERE id = ?", commentID)
-			}
-			if err != nil {
-				return err
-			}
-		} else {
-			// If vote type is different, update the vote
-			_, err = tx.Exec("UPDATE votes SET vote_type = ? WHERE item_type = 'comment' AND item_id = ? AND client_id = ?", voteType, commentID, clientID)
-			if err != nil {
-				return err
-			}
-
-			// Update comment vote counts
-			if voteType == 1 {
-				_, err = tx.Exec("UPDATE comments SET upvotes = upvotes + 1, downvotes = downvotes - 1 WHERE id = ?", commentID)
-			} else {
-				_, err = tx.Exec("UPDATE comments SET upvotes = upvotes - 1, downvotes = downvotes + 1 WHERE id = ?", commentID)
-			}
-			if err != nil {
-				return err
-			}
-		}
-	} else {
-		// Insert new vote
-		_, err = tx.Exec("INSERT INTO votes (item_type, item_id, client_id, vote_type) VALUES ('comment', ?, ?, ?)", commentID, clientID, voteType)
-		if err != nil {
-			return err
-		}
-
-		// Update comment vote counts
-		if voteType == 1 {
-			_, err = tx.Exec("UPDATE comments SET upvotes = upvotes + 1 WHERE id = ?", commentID)
-		} else {
-			_, err = tx.Exec("UPDATE comments SET downvotes = downvotes + 1 WHERE id = ?", commentID)
-		}
-		if err != nil {
-			return err
-		}
-	}
-
-	return nil
+	})
+	return id, err
 }
@@ -0,0 +1,93 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"runtime"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Connection settings. WAL lets readers carry on while a write is in
+// progress. The busy timeout makes a connection wait for a lock held by
+// another process, such as an admin command, instead of failing at once.
+const (
+	busyTimeout  = 2000 // milliseconds
+	writeRetries = 3    // extra attempts for a write transaction that finds the database busy
+)
+
+// Open opens the SQLite database at path with two pools: a writer with a
+// single connection, so writes from the server queue up and run one at a
+// time, and a pool of read-only connections for everything else. Foreign
+// keys are enforced on both. Write transactions take the write lock when
+// they begin, so two of them can never deadlock upgrading a read lock.
+func Open(path string) (writer, reader *sql.DB, err error) {
+	writer, err = sql.Open("sqlite3", fmt.Sprintf("%s?_journal_mode=WAL&_busy_timeout=%d&_foreign_keys=1&_txlock=immediate", path, busyTimeout))
+	if err != nil {
+		return nil, nil, err
+	}
+	writer.SetMaxOpenConns(1)
+	// The writer switches the database to WAL before any reader opens it
+	if err := writer.Ping(); err != nil {
+		writer.Close()
+		return nil, nil, err
+	}
+
+	reader, err = sql.Open("sqlite3", fmt.Sprintf("%s?_busy_timeout=%d&_foreign_keys=1&_query_only=1", path, busyTimeout))
+	if err != nil {
+		writer.Close()
+		return nil, nil, err
+	}
+	readers := runtime.NumCPU()
+	if readers < 4 {
+		readers = 4
+	}
+	reader.SetMaxOpenConns(readers)
+	reader.SetMaxIdleConns(readers)
+	return writer, reader, nil
+}
+
+// WriteTx runs fn in a transaction on the writer and commits it, or rolls
+// it back if fn returns an error. If the database is still busy after the
+// busy timeout, the whole transaction is tried again after a short wait,
+// so fn must not have effects outside the transaction.
+func WriteTx(db *sql.DB, fn func(tx *sql.Tx) error) error {
+	for attempt := 0; ; attempt++ {
+		err := runTx(db, fn)
+		if !IsBusy(err) || attempt == writeRetries {
+			return err
+		}
+		time.Sleep(time.Duration(50<<attempt) * time.Millisecond)
+	}
+}
+
+// WriteExec runs a single write statement through WriteTx
+func WriteExec(db *sql.DB, query string, args ...interface{}) (result sql.Result, err error) {
+	err = WriteTx(db, func(tx *sql.Tx) error {
+		result, err = tx.Exec(query, args...)
+		return err
+	})
+	return result, err
+}
+
+// runTx runs fn in one transaction
+func runTx(db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// IsBusy reports whether err means the database was locked by another
+// connection for longer than the busy timeout
+func IsBusy(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && (sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked)
+}
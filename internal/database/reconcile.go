@@ -0,0 +1,113 @@
+package database
+
+import (
+	"database/sql"
+)
+
+// reconcileBatch is how many rows Reconcile checks in one transaction, so
+// it never holds the write lock for long
+const reconcileBatch = 500
+
+// counter is a count kept in a column for speed, and the query that
+// counts it from the source table. The query refers to the row as table.id.
+type counter struct {
+	table  string
+	column string
+	count  string
+}
+
+// counters lists the denormalized counts. Vote counts leave out
+// quarantined votes.
+var counters = []counter{
+	{"posts", "upvotes", "SELECT COUNT(*) FROM votes WHERE item_type = 'post' AND item_id = posts.id AND vote_type = 1 AND quarantined = 0"},
+	{"posts", "downvotes", "SELECT COUNT(*) FROM votes WHERE item_type = 'post' AND item_id = posts.id AND vote_type = -1 AND quarantined = 0"},
+	{"posts", "comment_count", "SELECT COUNT(*) FROM comments WHERE post_id = posts.id"},
+	{"comments", "upvotes", "SELECT COUNT(*) FROM votes WHERE item_type = 'comment' AND item_id = comments.id AND vote_type = 1 AND quarantined = 0"},
+	{"comments", "downvotes", "SELECT COUNT(*) FROM votes WHERE item_type = 'comment' AND item_id = comments.id AND vote_type = -1 AND quarantined = 0"},
+	{"communities", "post_count", "SELECT COUNT(*) FROM posts WHERE community_id = communities.id"},
+}
+
+// Drift is a stored count that differs from the count of its source rows
+type Drift struct {
+	Table   string
+	ID      int
+	Column  string
+	Stored  int
+	Counted int
+}
+
+// Reconcile recounts every denormalized count from its source table and
+// reports the ones that have drifted. With fix, it also corrects them. Rows
+// are checked in batches of reconcileBatch, each in its own transaction.
+func Reconcile(db *sql.DB, fix bool) ([]Drift, error) {
+	var drifts []Drift
+	for _, c := range counters {
+		lastID := 0
+		for {
+			batch, next, err := reconcileCounter(db, c, lastID, fix)
+			if err != nil {
+				return drifts, err
+			}
+			drifts = append(drifts, batch...)
+			if next == lastID {
+				break
+			}
+			lastID = next
+		}
+	}
+	return drifts, nil
+}
+
+// reconcileCounter checks one batch of a counter, the rows after lastID,
+// and returns the drifted rows and the last ID it checked
+func reconcileCounter(db *sql.DB, c counter, lastID int, fix bool) (drifts []Drift, next int, err error) {
+	err = WriteTx(db, func(tx *sql.Tx) error {
+		drifts, next = nil, lastID
+
+		rows, err := tx.Query("SELECT id, "+c.column+", ("+c.count+") FROM "+c.table+" WHERE id > ? ORDER BY id LIMIT ?",
+			lastID, reconcileBatch)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			d := Drift{Table: c.table, Column: c.column}
+			if err := rows.Scan(&d.ID, &d.Stored, &d.Counted); err != nil {
+				rows.Close()
+				return err
+			}
+			next = d.ID
+			if d.Stored != d.Counted {
+				drifts = append(drifts, d)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		if fix {
+			for _, d := range drifts {
+				_, err := tx.Exec("UPDATE "+c.table+" SET "+c.column+" = ? WHERE id = ?", d.Counted, d.ID)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, lastID, err
+	}
+	return drifts, next, nil
+}
+
+// fillCounter sets a newly added count column from its source table
+func fillCounter(db *sql.DB, table, column string) error {
+	for _, c := range counters {
+		if c.table == table && c.column == column {
+			_, err := db.Exec("UPDATE " + c.table + " SET " + c.column + " = (" + c.count + ")")
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,276 @@
+package database
+
+import (
+	"database/sql"
+)
+
+// Votes are checked for signs of manipulation by CheckVotes. A suspicious
+// vote is quarantined: it stays in the votes table but no longer counts
+// in the item's upvotes and downvotes or in its author's karma, until an
+// admin reviews it with ReleaseVotes or DiscardVotes. Released votes are
+// marked reviewed and never flagged again.
+
+// Thresholds of the vote rules
+const (
+	// A burst is this many votes the same way on one item from one IP
+	// range within burstWindow of each other
+	burstVotes  = 5
+	burstWindow = "10 minutes"
+	// Only votes this recent are checked for bursts
+	burstLookback = "-7 days"
+	// A single-author voter has cast at least this many votes, all on the
+	// posts and comments of one author
+	singleAuthorVotes = 10
+	// A ring is two identities who have each upvoted the other at least
+	// this many times, making up at least half of each one's upvotes
+	ringVotes = 5
+)
+
+// authoredVotes is a common table expression of the unreviewed votes on
+// posts and comments that have an author, with the author's identity ID
+const authoredVotes = `authored AS (
+	SELECT v.id, v.client_id, v.vote_type, v.quarantined, p.author_id
+	FROM votes v JOIN posts p ON v.item_type = 'post' AND v.item_id = p.id
+	WHERE v.reviewed = 0 AND p.author_id IS NOT NULL
+	UNION ALL
+	SELECT v.id, v.client_id, v.vote_type, v.quarantined, c.author_id
+	FROM votes v JOIN comments c ON v.item_type = 'comment' AND v.item_id = c.id
+	WHERE v.reviewed = 0 AND c.author_id IS NOT NULL
+)`
+
+// voteRule finds suspicious votes. Its query returns the IDs of votes to
+// quarantine; votes already quarantined still count towards the pattern,
+// so a voter who keeps going is caught again.
+type voteRule struct {
+	reason string
+	query  string
+	args   []interface{}
+}
+
+// voteRules are applied in order; a vote is quarantined by the first rule
+// that flags it
+var voteRules = []voteRule{
+	{
+		reason: "ring",
+		query: `WITH ` + authoredVotes + `,
+		upvotes AS (
+			SELECT a.id, a.quarantined, i.id AS voter_id, a.author_id
+			FROM authored a JOIN identities i ON i.client_id = a.client_id
+			WHERE a.vote_type = 1
+		),
+		pairs AS (
+			SELECT voter_id, author_id, COUNT(*) AS n FROM upvotes
+			WHERE voter_id != author_id GROUP BY voter_id, author_id
+		),
+		totals AS (SELECT voter_id, COUNT(*) AS n FROM upvotes GROUP BY voter_id)
+		SELECT u.id FROM upvotes u
+		JOIN pairs ab ON ab.voter_id = u.voter_id AND ab.author_id = u.author_id
+		JOIN pairs ba ON ba.voter_id = u.author_id AND ba.author_id = u.voter_id
+		JOIN totals ta ON ta.voter_id = u.voter_id
+		JOIN totals tb ON tb.voter_id = u.author_id
+		WHERE u.quarantined = 0 AND ab.n >= ? AND ba.n >= ? AND ab.n * 2 >= ta.n AND ba.n * 2 >= tb.n`,
+		args: []interface{}{ringVotes, ringVotes},
+	},
+	{
+		reason: "single_author",
+		query: `WITH ` + authoredVotes + `
+		SELECT a.id FROM authored a
+		JOIN (
+			SELECT client_id FROM authored GROUP BY client_id
+			HAVING COUNT(*) >= ? AND COUNT(DISTINCT author_id) = 1
+		) s ON s.client_id = a.client_id
+		WHERE a.quarantined = 0`,
+		args: []interface{}{singleAuthorVotes},
+	},
+	{
+		reason: "burst",
+		query: `SELECT v.id FROM votes v
+		WHERE v.quarantined = 0 AND v.reviewed = 0 AND v.ip_range != ''
+		  AND v.created_at > datetime('now', ?)
+		  AND (SELECT COUNT(*) FROM votes w
+		       WHERE w.item_type = v.item_type AND w.item_id = v.item_id
+		         AND w.ip_range = v.ip_range AND w.vote_type = v.vote_type AND w.reviewed = 0
+		         AND w.created_at BETWEEN datetime(v.created_at, '-` + burstWindow + `')
+		                              AND datetime(v.created_at, '+` + burstWindow + `')) >= ?`,
+		args: []interface{}{burstLookback, burstVotes},
+	},
+}
+
+// VoteCheckResult is the number of votes one rule quarantined
+type VoteCheckResult struct {
+	Reason      string
+	Quarantined int
+}
+
+// CheckVotes applies the vote rules and quarantines the votes they flag,
+// all in one write transaction
+func CheckVotes(db *sql.DB) ([]VoteCheckResult, error) {
+	var results []VoteCheckResult
+	err := WriteTx(db, func(tx *sql.Tx) error {
+		// A retried transaction starts the count again
+		results = nil
+		for _, rule := range voteRules {
+			ids, err := queryIDs(tx, rule.query, rule.args...)
+			if err != nil {
+				return err
+			}
+			n := 0
+			for _, id := range ids {
+				changed, err := setQuarantined(tx, id, true, rule.reason)
+				if err != nil {
+					return err
+				}
+				if changed {
+					n++
+				}
+			}
+			results = append(results, VoteCheckResult{Reason: rule.reason, Quarantined: n})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// QuarantinedVote is a vote waiting for review
+type QuarantinedVote struct {
+	ID        int
+	ItemType  string
+	ItemID    int
+	VoteType  int    // 0 if the voter has taken the vote back
+	Voter     string // username, or client ID for anonymous voters
+	IPRange   string
+	Reason    string
+	CreatedAt string
+}
+
+// GetQuarantinedVotes lists the quarantined votes, grouped by reason and voter
+func GetQuarantinedVotes(db *sql.DB) ([]QuarantinedVote, error) {
+	rows, err := db.Query(`
+	SELECT v.id, v.item_type, v.item_id, v.vote_type, COALESCE(i.username, v.client_id), v.ip_range, v.flag_reason, v.created_at
+	FROM votes v
+	LEFT JOIN identities i ON i.client_id = v.client_id
+	WHERE v.quarantined = 1
+	ORDER BY v.flag_reason, v.client_id, v.id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var votes []QuarantinedVote
+	for rows.Next() {
+		var v QuarantinedVote
+		if err := rows.Scan(&v.ID, &v.ItemType, &v.ItemID, &v.VoteType, &v.Voter, &v.IPRange, &v.Reason, &v.CreatedAt); err != nil {
+			return nil, err
+		}
+		votes = append(votes, v)
+	}
+	return votes, rows.Err()
+}
+
+// ReleaseVotes ends the quarantine of votes found to be genuine. They count
+// again and are marked reviewed. It returns how many votes were released.
+func ReleaseVotes(db *sql.DB, ids []int) (int, error) {
+	n := 0
+	err := WriteTx(db, func(tx *sql.Tx) error {
+		n = 0
+		for _, id := range ids {
+			changed, err := setQuarantined(tx, id, false, "")
+			if err != nil {
+				return err
+			}
+			if changed {
+				n++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// DiscardVotes deletes quarantined votes found to be manipulation. They
+// already don't count, so no totals change. It returns how many votes were
+// deleted.
+func DiscardVotes(db *sql.DB, ids []int) (int, error) {
+	n := 0
+	err := WriteTx(db, func(tx *sql.Tx) error {
+		n = 0
+		for _, id := range ids {
+			result, err := tx.Exec("DELETE FROM votes WHERE id = ? AND quarantined = 1", id)
+			if err != nil {
+				return err
+			}
+			deleted, err := result.RowsAffected()
+			if err != nil {
+				return err
+			}
+			n += int(deleted)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// setQuarantined quarantines a vote or releases it from quarantine, and
+// takes it out of or puts it back into the item's vote counts and its
+// author's karma. It reports whether the vote changed; votes that were
+// already in that state, or reviewed before, are left alone.
+func setQuarantined(tx *sql.Tx, id int, quarantine bool, reason string) (bool, error) {
+	var itemType string
+	var itemID, voteType int
+	err := tx.QueryRow("SELECT item_type, item_id, vote_type FROM votes WHERE id = ? AND quarantined = ? AND reviewed = 0",
+		id, !quarantine).Scan(&itemType, &itemID, &voteType)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	sign := 1
+	if quarantine {
+		sign = -1
+		_, err = tx.Exec("UPDATE votes SET quarantined = 1, flag_reason = ? WHERE id = ?", reason, id)
+	} else {
+		_, err = tx.Exec("UPDATE votes SET quarantined = 0, reviewed = 1 WHERE id = ?", id)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	votable, ok := votables[itemType]
+	if !ok {
+		return false, ErrNotVotable
+	}
+	if err := countVote(tx, votable, itemID, voteType, sign); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// queryIDs runs a query that returns a column of IDs
+func queryIDs(tx *sql.Tx, query string, args ...interface{}) ([]int, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
@@ -0,0 +1,147 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Votable describes a kind of item that can be voted on. Its votes are
+// rows of the votes table with the kind as item_type, and its table keeps
+// the counts in upvotes and downvotes columns. Making a new kind of item
+// votable takes an entry in votables and those two columns.
+type Votable struct {
+	Table string
+	// KarmaColumn is the identities column the votes add to the karma of
+	// the item's author, through the table's author_id, or "" for none
+	KarmaColumn string
+}
+
+// votables lists the kinds of items that can be voted on, by item_type
+var votables = map[string]Votable{
+	"post":    {Table: "posts", KarmaColumn: "post_karma"},
+	"comment": {Table: "comments", KarmaColumn: "comment_karma"},
+}
+
+// ErrNotVotable is returned for a vote on a kind of item that can't be voted on
+var ErrNotVotable = fmt.Errorf("this kind of item can't be voted on")
+
+// Ballot is a client's vote on an item
+type Ballot struct {
+	ItemType string
+	ItemID   int
+	ClientID string
+	IPRange  string // network the vote comes from, see votecheck.go
+	// Vote is 1 for an upvote, -1 for a downvote or 0 for no vote
+	Vote int
+	// With Toggle, casting the vote the client already has removes it,
+	// as clicking an active vote button does
+	Toggle bool
+}
+
+// VoteResult is an item's vote counts after a vote, and the client's vote
+type VoteResult struct {
+	Upvotes   int
+	Downvotes int
+	Vote      int
+}
+
+// Score is the item's upvotes minus its downvotes
+func (r VoteResult) Score() int {
+	return r.Upvotes - r.Downvotes
+}
+
+// CastVote moves the client's vote on an item from whatever it was (none,
+// up or down) to the ballot's vote. The item's counts and its author's
+// karma change with it, in the same transaction. A quarantined vote
+// doesn't count, so changing it leaves the totals alone; it stays
+// quarantined until an admin reviews it, even when the client takes it
+// back and votes again, as taking it back leaves the row with a vote of 0.
+// CastVote returns sql.ErrNoRows if
+// the item doesn't exist. It should be given the writer from Open, which
+// queues it behind other writes.
+func CastVote(db *sql.DB, b Ballot) (result VoteResult, err error) {
+	votable, ok := votables[b.ItemType]
+	if !ok {
+		return result, ErrNotVotable
+	}
+	if b.Vote < -1 || b.Vote > 1 {
+		return result, fmt.Errorf("invalid vote %d", b.Vote)
+	}
+
+	err = WriteTx(db, func(tx *sql.Tx) error {
+		result = VoteResult{}
+
+		// The item must exist before it can have votes
+		err := tx.QueryRow("SELECT 1 FROM "+votable.Table+" WHERE id = ?", b.ItemID).Scan(new(int))
+		if err != nil {
+			return err
+		}
+
+		// The client's current vote, 0 for none
+		var old int
+		var quarantined bool
+		err = tx.QueryRow("SELECT vote_type, quarantined FROM votes WHERE item_type = ? AND item_id = ? AND client_id = ?",
+			b.ItemType, b.ItemID, b.ClientID).Scan(&old, &quarantined)
+		exists := err == nil
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+
+		vote := b.Vote
+		if b.Toggle && vote == old {
+			vote = 0
+		}
+
+		// Move the vote row from the old state to the new one
+		switch {
+		case vote == old:
+			// Nothing to move
+			err = nil
+		case !exists:
+			_, err = tx.Exec("INSERT INTO votes (item_type, item_id, client_id, vote_type, ip_range) VALUES (?, ?, ?, ?, ?)",
+				b.ItemType, b.ItemID, b.ClientID, vote, b.IPRange)
+		case vote == 0 && !quarantined:
+			_, err = tx.Exec("DELETE FROM votes WHERE item_type = ? AND item_id = ? AND client_id = ?", b.ItemType, b.ItemID, b.ClientID)
+		default:
+			// A quarantined vote taken back keeps its row, and its quarantine
+			_, err = tx.Exec("UPDATE votes SET vote_type = ? WHERE item_type = ? AND item_id = ? AND client_id = ?",
+				vote, b.ItemType, b.ItemID, b.ClientID)
+		}
+		if err != nil {
+			return err
+		}
+
+		// Move the counts and karma by the difference
+		if !quarantined && vote != old {
+			if err := countVote(tx, votable, b.ItemID, old, -1); err != nil {
+				return err
+			}
+			if err := countVote(tx, votable, b.ItemID, vote, 1); err != nil {
+				return err
+			}
+		}
+
+		result.Vote = vote
+		return tx.QueryRow("SELECT upvotes, downvotes FROM "+votable.Table+" WHERE id = ?", b.ItemID).Scan(&result.Upvotes, &result.Downvotes)
+	})
+	return result, err
+}
+
+// countVote adds a vote to an item's counts and its author's karma, or
+// with sign -1 takes it away. A vote of 0 changes nothing.
+func countVote(tx *sql.Tx, votable Votable, itemID, vote, sign int) error {
+	if vote == 0 {
+		return nil
+	}
+	count := "upvotes"
+	if vote < 0 {
+		count = "downvotes"
+	}
+	_, err := tx.Exec("UPDATE "+votable.Table+" SET "+count+" = "+count+" + ? WHERE id = ?", sign, itemID)
+	if err != nil || votable.KarmaColumn == "" {
+		return err
+	}
+	_, err = tx.Exec("UPDATE identities SET "+votable.KarmaColumn+" = "+votable.KarmaColumn+" + ? WHERE id = (SELECT author_id FROM "+votable.Table+" WHERE id = ?)",
+		sign*vote, itemID)
+	return err
+}
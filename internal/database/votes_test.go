@@ -0,0 +1,342 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// openTestDB opens a new database in a temporary directory, with the schema
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	writer, reader, err := Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() {
+		reader.Close()
+		writer.Close()
+	})
+	if err := InitDB(writer); err != nil {
+		t.Fatalf("InitDB: %v", err)
+	}
+	return writer
+}
+
+// voteFixture is a post and a comment on it, each by its own author
+type voteFixture struct {
+	postID, commentID         int
+	postAuthor, commentAuthor int
+}
+
+// nextFixture numbers fixtures, so every fixture has its own authors
+var nextFixture int
+
+// newVoteFixture creates a post and a comment with new authors, who have no karma
+func newVoteFixture(t *testing.T, db *sql.DB) voteFixture {
+	t.Helper()
+	nextFixture++
+	var f voteFixture
+	exec := func(query string, args ...interface{}) int {
+		result, err := db.Exec(query, args...)
+		if err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return int(id)
+	}
+	communityID := exec("INSERT INTO communities (name, name_key) VALUES (?, ?)",
+		fmt.Sprintf("votes%d", nextFixture), fmt.Sprintf("votes%d", nextFixture))
+	f.postAuthor = exec("INSERT INTO identities (client_id) VALUES (?)", fmt.Sprintf("post-author-%d", nextFixture))
+	f.commentAuthor = exec("INSERT INTO identities (client_id) VALUES (?)", fmt.Sprintf("comment-author-%d", nextFixture))
+	f.postID = exec("INSERT INTO posts (title, community_id, author_id) VALUES ('Post', ?, ?)", communityID, f.postAuthor)
+	f.commentID = exec("INSERT INTO comments (content, post_id, author_id) VALUES ('Comment', ?, ?)", f.postID, f.commentAuthor)
+	return f
+}
+
+// item returns the ID of the fixture's item of a type, and its author
+func (f voteFixture) item(itemType string) (id, author int) {
+	if itemType == "comment" {
+		return f.commentID, f.commentAuthor
+	}
+	return f.postID, f.postAuthor
+}
+
+// totals is what a vote changes: an item's counts and its author's karma
+type totals struct {
+	upvotes, downvotes, karma int
+}
+
+// getTotals reads the counts of an item and the karma of its author
+func getTotals(t *testing.T, db *sql.DB, itemType string, itemID, authorID int) totals {
+	t.Helper()
+	votable := votables[itemType]
+	var got totals
+	err := db.QueryRow("SELECT upvotes, downvotes FROM "+votable.Table+" WHERE id = ?", itemID).Scan(&got.upvotes, &got.downvotes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow("SELECT "+votable.KarmaColumn+" FROM identities WHERE id = ?", authorID).Scan(&got.karma); err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+// totalsFor is the totals of an item with only the given vote
+func totalsFor(vote int) totals {
+	switch vote {
+	case 1:
+		return totals{upvotes: 1, karma: 1}
+	case -1:
+		return totals{downvotes: 1, karma: -1}
+	}
+	return totals{}
+}
+
+// countVoteRows returns the vote rows of an item, and the counts of its
+// votes that aren't quarantined, from the votes table
+func countVoteRows(t *testing.T, db *sql.DB, itemType string, itemID int) (rows, upvotes, downvotes int) {
+	t.Helper()
+	err := db.QueryRow(`
+	SELECT COUNT(*),
+	       COALESCE(SUM(vote_type = 1 AND quarantined = 0), 0),
+	       COALESCE(SUM(vote_type = -1 AND quarantined = 0), 0)
+	FROM votes WHERE item_type = ? AND item_id = ?`, itemType, itemID).Scan(&rows, &upvotes, &downvotes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rows, upvotes, downvotes
+}
+
+func TestCastVoteTransitions(t *testing.T) {
+	db := openTestDB(t)
+	states := []int{0, 1, -1}
+	for _, itemType := range []string{"post", "comment"} {
+		for _, from := range states {
+			for _, to := range states {
+				name := fmt.Sprintf("%s/%d->%d", itemType, from, to)
+				t.Run(name, func(t *testing.T) {
+					f := newVoteFixture(t, db)
+					itemID, author := f.item(itemType)
+					ballot := Ballot{ItemType: itemType, ItemID: itemID, ClientID: "voter", IPRange: "198.51.100.0/24"}
+
+					ballot.Vote = from
+					if _, err := CastVote(db, ballot); err != nil {
+						t.Fatalf("casting %d: %v", from, err)
+					}
+					if got := getTotals(t, db, itemType, itemID, author); got != totalsFor(from) {
+						t.Fatalf("after casting %d: totals = %+v, want %+v", from, got, totalsFor(from))
+					}
+
+					ballot.Vote = to
+					result, err := CastVote(db, ballot)
+					if err != nil {
+						t.Fatalf("casting %d: %v", to, err)
+					}
+					want := totalsFor(to)
+					if got := getTotals(t, db, itemType, itemID, author); got != want {
+						t.Errorf("totals = %+v, want %+v", got, want)
+					}
+					if result.Vote != to || result.Upvotes != want.upvotes || result.Downvotes != want.downvotes {
+						t.Errorf("result = %+v, want vote %d with counts %+v", result, to, want)
+					}
+					rows, _, _ := countVoteRows(t, db, itemType, itemID)
+					if wantRows := to * to; rows != wantRows {
+						t.Errorf("%d vote rows, want %d", rows, wantRows)
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestCastVoteToggle(t *testing.T) {
+	db := openTestDB(t)
+	for _, vote := range []int{1, -1} {
+		f := newVoteFixture(t, db)
+		ballot := Ballot{ItemType: "post", ItemID: f.postID, ClientID: "voter", Vote: vote, Toggle: true}
+		if _, err := CastVote(db, ballot); err != nil {
+			t.Fatal(err)
+		}
+		// The same vote again takes it back
+		result, err := CastVote(db, ballot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Vote != 0 {
+			t.Errorf("voting %d twice: vote = %d, want 0", vote, result.Vote)
+		}
+		if got := getTotals(t, db, "post", f.postID, f.postAuthor); got != (totals{}) {
+			t.Errorf("voting %d twice: totals = %+v, want none", vote, got)
+		}
+	}
+}
+
+func TestCastVoteErrors(t *testing.T) {
+	db := openTestDB(t)
+	if _, err := CastVote(db, Ballot{ItemType: "post", ItemID: 999, ClientID: "voter", Vote: 1}); err != sql.ErrNoRows {
+		t.Errorf("vote on a missing post: err = %v, want sql.ErrNoRows", err)
+	}
+	if _, err := CastVote(db, Ballot{ItemType: "community", ItemID: 1, ClientID: "voter", Vote: 1}); err != ErrNotVotable {
+		t.Errorf("vote on a community: err = %v, want ErrNotVotable", err)
+	}
+	f := newVoteFixture(t, db)
+	if _, err := CastVote(db, Ballot{ItemType: "post", ItemID: f.postID, ClientID: "voter", Vote: 2}); err == nil {
+		t.Errorf("vote of 2: no error")
+	}
+}
+
+// quarantine quarantines a client's vote on an item, as CheckVotes does
+func quarantine(t *testing.T, db *sql.DB, itemType string, itemID int, clientID string) int {
+	t.Helper()
+	var voteID int
+	err := WriteTx(db, func(tx *sql.Tx) error {
+		if err := tx.QueryRow("SELECT id FROM votes WHERE item_type = ? AND item_id = ? AND client_id = ?",
+			itemType, itemID, clientID).Scan(&voteID); err != nil {
+			return err
+		}
+		_, err := setQuarantined(tx, voteID, true, "test")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return voteID
+}
+
+func TestCastVoteQuarantined(t *testing.T) {
+	db := openTestDB(t)
+	for _, itemType := range []string{"post", "comment"} {
+		t.Run(itemType, func(t *testing.T) {
+			f := newVoteFixture(t, db)
+			itemID, author := f.item(itemType)
+			ballot := Ballot{ItemType: itemType, ItemID: itemID, ClientID: "suspect"}
+
+			// A genuine vote from someone else keeps counting throughout
+			genuine := Ballot{ItemType: itemType, ItemID: itemID, ClientID: "genuine", Vote: 1}
+			if _, err := CastVote(db, genuine); err != nil {
+				t.Fatal(err)
+			}
+			base := totals{upvotes: 1, karma: 1}
+
+			ballot.Vote = 1
+			if _, err := CastVote(db, ballot); err != nil {
+				t.Fatal(err)
+			}
+			voteID := quarantine(t, db, itemType, itemID, "suspect")
+			if got := getTotals(t, db, itemType, itemID, author); got != base {
+				t.Fatalf("after quarantine: totals = %+v, want %+v", got, base)
+			}
+
+			// Changing a quarantined vote leaves the totals alone, and so does
+			// taking it back and voting again
+			for _, vote := range []int{-1, 1, 0, 1, 0, -1} {
+				ballot.Vote = vote
+				if _, err := CastVote(db, ballot); err != nil {
+					t.Fatal(err)
+				}
+				if got := getTotals(t, db, itemType, itemID, author); got != base {
+					t.Errorf("changing a quarantined vote to %d: totals = %+v, want %+v", vote, got, base)
+				}
+			}
+			var quarantined bool
+			if err := db.QueryRow("SELECT quarantined FROM votes WHERE id = ?", voteID).Scan(&quarantined); err != nil {
+				t.Fatal(err)
+			}
+			if !quarantined {
+				t.Errorf("the vote left quarantine when it changed")
+			}
+
+			// Released, the vote counts as it is now: a downvote
+			if n, err := ReleaseVotes(db, []int{voteID}); err != nil || n != 1 {
+				t.Fatalf("ReleaseVotes = %d, %v", n, err)
+			}
+			want := totals{upvotes: 1, downvotes: 1, karma: 0}
+			if got := getTotals(t, db, itemType, itemID, author); got != want {
+				t.Errorf("after release: totals = %+v, want %+v", got, want)
+			}
+
+			// A new quarantined vote taken back changes nothing either, nor
+			// does voting again after taking it back
+			second := Ballot{ItemType: itemType, ItemID: itemID, ClientID: "suspect2", Vote: 1}
+			if _, err := CastVote(db, second); err != nil {
+				t.Fatal(err)
+			}
+			secondID := quarantine(t, db, itemType, itemID, "suspect2")
+			second.Vote = 0
+			if _, err := CastVote(db, second); err != nil {
+				t.Fatal(err)
+			}
+			if got := getTotals(t, db, itemType, itemID, author); got != want {
+				t.Errorf("after taking back a quarantined vote: totals = %+v, want %+v", got, want)
+			}
+			second.Vote = 1
+			result, err := CastVote(db, second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Vote != 1 {
+				t.Errorf("voting again after taking back: vote = %d, want 1", result.Vote)
+			}
+			if got := getTotals(t, db, itemType, itemID, author); got != want {
+				t.Errorf("voting again after taking back a quarantined vote: totals = %+v, want %+v", got, want)
+			}
+			if err := db.QueryRow("SELECT quarantined FROM votes WHERE id = ?", secondID).Scan(&quarantined); err != nil {
+				t.Fatal(err)
+			}
+			if !quarantined {
+				t.Errorf("the vote left quarantine when it was taken back and cast again")
+			}
+		})
+	}
+}
+
+func TestCastVoteConcurrent(t *testing.T) {
+	db := openTestDB(t)
+	f := newVoteFixture(t, db)
+	const voters = 20
+	const votesEach = 10
+
+	var wg sync.WaitGroup
+	errs := make(chan error, voters)
+	for i := 0; i < voters; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// Each voter moves through every state, ending on a different one
+			for j := 0; j < votesEach+i%3; j++ {
+				ballot := Ballot{
+					ItemType: "post",
+					ItemID:   f.postID,
+					ClientID: fmt.Sprintf("voter-%d", i),
+					Vote:     []int{1, -1, 0}[(i+j)%3],
+					Toggle:   j%4 == 3,
+				}
+				if _, err := CastVote(db, ballot); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("CastVote: %v", err)
+	}
+
+	_, upvotes, downvotes := countVoteRows(t, db, "post", f.postID)
+	got := getTotals(t, db, "post", f.postID, f.postAuthor)
+	want := totals{upvotes: upvotes, downvotes: downvotes, karma: upvotes - downvotes}
+	if got != want {
+		t.Errorf("totals = %+v, but the votes table has %+v", got, want)
+	}
+	if upvotes+downvotes == 0 {
+		t.Errorf("no votes were left to check")
+	}
+}
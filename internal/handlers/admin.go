@@ -0,0 +1,697 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"hubcorner/internal/database"
+	"hubcorner/internal/models"
+)
+
+// maxAnnouncementLength bounds the length of an announcement, in characters
+const maxAnnouncementLength = 1000
+
+// recentLogEntries is how many moderation log entries the admin dashboard shows
+const recentLogEntries = 10
+
+// Admin handles the admin console under /admin, for site admins only:
+//
+//	/admin                               site stats and recent moderation
+//	/admin/communities                   all communities
+//	/admin/communities/{id}/{action}     lock, unlock, quarantine, unquarantine or delete one
+//	/admin/bans                          site-wide bans, and the form to add one
+//	/admin/bans/{id}/delete              lift a ban
+//	/admin/announcements                 announcements, and the form to post one
+//	/admin/announcements/{id}/delete     remove an announcement
+//	/admin/log                           the moderation log of every community
+func (h *Handler) Admin(w http.ResponseWriter, r *http.Request) {
+	identity, err := h.currentIdentity(w, r)
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to get identity"))
+		return
+	}
+	if !identity.IsAdmin {
+		h.renderError(w, r, Forbidden("Only site admins can use the admin console."))
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	section := ""
+	if len(parts) > 1 {
+		section = parts[1]
+	}
+	var id int
+	if len(parts) == 4 {
+		if id, err = strconv.Atoi(parts[2]); err != nil {
+			h.renderError(w, r, NotFound("The page you were looking for does not exist."))
+			return
+		}
+	}
+
+	switch {
+	case len(parts) == 1:
+		h.adminDashboard(w, r)
+	case len(parts) == 2 && section == "communities":
+		h.adminCommunities(w, r)
+	case len(parts) == 4 && section == "communities" && parts[3] == "delete":
+		h.adminDeleteCommunity(w, r, identity, id)
+	case len(parts) == 4 && section == "communities":
+		h.adminModerateCommunity(w, r, identity, id, parts[3])
+	case len(parts) == 2 && section == "bans":
+		h.adminBans(w, r, identity)
+	case len(parts) == 4 && section == "bans" && parts[3] == "delete":
+		h.adminLiftBan(w, r, identity, id)
+	case len(parts) == 2 && section == "announcements":
+		h.adminAnnouncements(w, r, identity)
+	case len(parts) == 4 && section == "announcements" && parts[3] == "delete":
+		h.adminRemoveAnnouncement(w, r, identity, id)
+	case len(parts) == 2 && section == "log":
+		h.adminLog(w, r)
+	default:
+		h.renderError(w, r, NotFound("The page you were looking for does not exist."))
+	}
+}
+
+// adminDashboard shows the site's stats and its latest moderation actions
+func (h *Handler) adminDashboard(w http.ResponseWriter, r *http.Request) {
+	var identities, accounts, communities, quarantined, locked int
+	var posts, postsToday, comments, commentsToday, votes, flaggedVotes, bans int
+	err := h.Reads.QueryRow(`
+	SELECT
+		(SELECT COUNT(*) FROM identities),
+		(SELECT COUNT(*) FROM identities WHERE username IS NOT NULL),
+		(SELECT COUNT(*) FROM communities),
+		(SELECT COUNT(*) FROM communities WHERE quarantined = 1),
+		(SELECT COUNT(*) FROM communities WHERE locked = 1),
+		(SELECT COUNT(*) FROM posts),
+		(SELECT COUNT(*) FROM posts WHERE created_at > datetime('now', '-1 day')),
+		(SELECT COUNT(*) FROM comments),
+		(SELECT COUNT(*) FROM comments WHERE created_at > datetime('now', '-1 day')),
+		(SELECT COUNT(*) FROM votes),
+		(SELECT COUNT(*) FROM votes WHERE quarantined = 1),
+		(SELECT COUNT(*) FROM site_bans WHERE `+activeBan+`)`).
+		Scan(&identities, &accounts, &communities, &quarantined, &locked,
+			&posts, &postsToday, &comments, &commentsToday, &votes, &flaggedVotes, &bans)
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to get site stats"))
+		return
+	}
+
+	entries, _, err := h.getModLog("", "", 1)
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to get moderation log"))
+		return
+	}
+	if len(entries) > recentLogEntries {
+		entries = entries[:recentLogEntries]
+	}
+
+	data := map[string]interface{}{
+		"Title":   "Admin",
+		"Section": "dashboard",
+		"Stats": []map[string]interface{}{
+			{"label": "Identities", "value": identities, "detail": fmt.Sprintf("%d with a username", accounts)},
+			{"label": "Communities", "value": communities, "detail": fmt.Sprintf("%d quarantined, %d locked", quarantined, locked)},
+			{"label": "Posts", "value": posts, "detail": fmt.Sprintf("%d in the last day", postsToday)},
+			{"label": "Comments", "value": comments, "detail": fmt.Sprintf("%d in the last day", commentsToday)},
+			{"label": "Votes", "value": votes, "detail": fmt.Sprintf("%d quarantined", flaggedVotes)},
+			{"label": "Bans", "value": bans, "detail": "in force"},
+		},
+		"FlaggedVotes": flaggedVotes,
+		"Log":          entries,
+	}
+	h.render(w, r, http.StatusOK, "admin.html", data)
+}
+
+// adminCommunities lists every community, with its status and size, a page at a time
+func (h *Handler) adminCommunities(w http.ResponseWriter, r *http.Request) {
+	page := pageNumber(r)
+	rows, err := h.Reads.Query(`
+	SELECT c.id, c.name, c.type, c.post_count, c.locked, c.quarantined, c.created_at,
+	       (SELECT COUNT(*) FROM subscriptions s WHERE s.community_id = c.id)
+	FROM communities c
+	ORDER BY c.name ASC
+	LIMIT ? OFFSET ?
+	`, perPage+1, (page-1)*perPage)
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to get communities"))
+		return
+	}
+	defer rows.Close()
+
+	var communities []map[string]interface{}
+	for rows.Next() {
+		var id, postCount, subscribers int
+		var name, communityType, createdAt string
+		var locked, quarantined bool
+		if err := rows.Scan(&id, &name, &communityType, &postCount, &locked, &quarantined, &createdAt, &subscribers); err != nil {
+			h.renderError(w, r, Internal(err, "Failed to get communities"))
+			return
+		}
+		communities = append(communities, map[string]interface{}{
+			"id":          id,
+			"name":        name,
+			"type":        communityType,
+			"post_count":  postCount,
+			"subscribers": subscribers,
+			"locked":      locked,
+			"quarantined": quarantined,
+			"created_at":  createdAt,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		h.renderError(w, r, Internal(err, "Failed to get communities"))
+		return
+	}
+
+	hasMore := len(communities) > perPage
+	if hasMore {
+		communities = communities[:perPage]
+	}
+	data := map[string]interface{}{
+		"Title":       "Admin: Communities",
+		"Section":     "communities",
+		"Communities": communities,
+	}
+	if page > 1 {
+		data["PrevPage"] = page - 1
+	}
+	if hasMore {
+		data["NextPage"] = page + 1
+	}
+	h.render(w, r, http.StatusOK, "admin_communities.html", data)
+}
+
+// communityActions maps the actions on a community to the update they make
+var communityActions = map[string]string{
+	"lock":         "UPDATE communities SET locked = 1 WHERE id = ?",
+	"unlock":       "UPDATE communities SET locked = 0 WHERE id = ?",
+	"quarantine":   "UPDATE communities SET quarantined = 1 WHERE id = ?",
+	"unquarantine": "UPDATE communities SET quarantined = 0 WHERE id = ?",
+}
+
+// adminModerateCommunity handles the POST requests that lock, unlock,
+// quarantine and unquarantine a community
+func (h *Handler) adminModerateCommunity(w http.ResponseWriter, r *http.Request, identity *models.Identity, id int, action string) {
+	query, ok := communityActions[action]
+	if !ok {
+		h.renderError(w, r, NotFound("The page you were looking for does not exist."))
+		return
+	}
+	if r.Method != http.MethodPost {
+		h.renderError(w, r, MethodNotAllowed())
+		return
+	}
+
+	community, err := h.getCommunityByID(id)
+	if err == sql.ErrNoRows {
+		h.renderError(w, r, NotFound("This community does not exist."))
+		return
+	}
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to get community"))
+		return
+	}
+
+	err = database.WriteTx(h.DB, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(query, id); err != nil {
+			return err
+		}
+		return logModAction(tx, identity, modLogEntry{
+			CommunityID:   community.ID,
+			CommunityName: community.Name,
+			Action:        action + "-community",
+			Target:        "c/" + community.Name,
+			Link:          "/c/" + url.PathEscape(community.Name),
+		})
+	})
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to update community"))
+		return
+	}
+	// Quarantine decides whether the community is in the list and its posts
+	// in c/all; the community list also feeds the post form
+	h.Cache.Invalidate(communitiesKey)
+	h.Cache.Invalidate(postsPrefix)
+
+	if wantsJSON(r) {
+		community, err = h.getCommunityByID(id)
+		if err != nil {
+			h.renderError(w, r, Internal(err, "Failed to get community"))
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"locked":      community.Locked,
+			"quarantined": community.Quarantined,
+		})
+		return
+	}
+	http.Redirect(w, r, adminReturnPath(r, "/admin/communities"), http.StatusSeeOther)
+}
+
+// adminDeleteCommunity shows what deleting a community would delete, and
+// on POST deletes it, once the admin has typed its name to confirm
+func (h *Handler) adminDeleteCommunity(w http.ResponseWriter, r *http.Request, identity *models.Identity, id int) {
+	community, err := h.getCommunityByID(id)
+	if err == sql.ErrNoRows {
+		h.renderError(w, r, NotFound("This community does not exist."))
+		return
+	}
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to get community"))
+		return
+	}
+
+	var comments, subscribers int
+	err = h.Reads.QueryRow(`
+	SELECT
+		(SELECT COUNT(*) FROM comments c JOIN posts p ON c.post_id = p.id WHERE p.community_id = ?),
+		(SELECT COUNT(*) FROM subscriptions WHERE community_id = ?)`, id, id).Scan(&comments, &subscribers)
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to count comments"))
+		return
+	}
+	var posts int
+	if err := h.Reads.QueryRow("SELECT post_count FROM communities WHERE id = ?", id).Scan(&posts); err != nil {
+		h.renderError(w, r, Internal(err, "Failed to count posts"))
+		return
+	}
+
+	data := map[string]interface{}{
+		"Title":       fmt.Sprintf("Delete c/%s", community.Name),
+		"Section":     "communities",
+		"Community":   community,
+		"Posts":       posts,
+		"Comments":    comments,
+		"Subscribers": subscribers,
+		"Form":        map[string]string{},
+		"Errors":      map[string]string{},
+	}
+
+	if r.Method == http.MethodGet {
+		h.render(w, r, http.StatusOK, "admin_delete.html", data)
+		return
+	}
+	if r.Method != http.MethodPost {
+		h.renderError(w, r, MethodNotAllowed())
+		return
+	}
+
+	if r.FormValue("confirm") != community.Name {
+		h.renderForm(w, r, "admin_delete.html", data, Validation("Please fix the errors below.", map[string]string{
+			"confirm": fmt.Sprintf("Type %s to confirm", community.Name),
+		}))
+		return
+	}
+
+	err = database.WriteTx(h.DB, func(tx *sql.Tx) error {
+		if err := database.DeleteCommunity(tx, id); err != nil {
+			return err
+		}
+		return logModAction(tx, identity, modLogEntry{
+			CommunityID:   community.ID,
+			CommunityName: community.Name,
+			Action:        "delete-community",
+			Target:        "c/" + community.Name,
+		})
+	})
+	if err == sql.ErrNoRows {
+		h.renderError(w, r, NotFound("This community does not exist."))
+		return
+	}
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to delete community"))
+		return
+	}
+	h.Cache.Invalidate(communitiesKey)
+	h.Cache.Invalidate(postsPrefix)
+
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"deleted": id})
+		return
+	}
+	http.Redirect(w, r, "/admin/communities", http.StatusSeeOther)
+}
+
+// adminBans lists the bans in force, and on POST adds one. The target is a
+// username, an IP address or a network such as 203.0.113.0/24.
+func (h *Handler) adminBans(w http.ResponseWriter, r *http.Request, identity *models.Identity) {
+	bans, err := h.getBans()
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to get bans"))
+		return
+	}
+
+	data := map[string]interface{}{
+		"Title":   "Admin: Bans",
+		"Section": "bans",
+		"Bans":    bans,
+		"Form":    map[string]string{},
+		"Errors":  map[string]string{},
+	}
+
+	if r.Method == http.MethodGet {
+		h.render(w, r, http.StatusOK, "admin_bans.html", data)
+		return
+	}
+	if r.Method != http.MethodPost {
+		h.renderError(w, r, MethodNotAllowed())
+		return
+	}
+
+	target := strings.TrimSpace(r.FormValue("target"))
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	duration, ok := banDurations[r.FormValue("duration")]
+	fields := make(map[string]string)
+	if target == "" {
+		fields["target"] = "Enter a username, an IP address or a network"
+	}
+	if !ok {
+		fields["duration"] = "Invalid ban length"
+	}
+	if len(fields) > 0 {
+		h.renderForm(w, r, "admin_bans.html", data, Validation("Please fix the errors below.", fields))
+		return
+	}
+
+	ipRange, identityID, err := h.parseBanTarget(target)
+	if e, ok := err.(*Error); ok && e.Kind == KindValidation {
+		h.renderForm(w, r, "admin_bans.html", data, e)
+		return
+	}
+	if err != nil {
+		h.renderError(w, r, err)
+		return
+	}
+
+	var expires interface{}
+	if duration > 0 {
+		expires = fmt.Sprintf("+%d seconds", int(duration.Seconds()))
+	}
+	var bannedID, bannedRange interface{}
+	if identityID != 0 {
+		bannedID = identityID
+	} else {
+		bannedRange = ipRange
+	}
+
+	display := ipRange
+	if identityID != 0 {
+		display = "u/" + target
+	}
+
+	// Bans that have run out make way for a new ban of the same target
+	err = database.WriteTx(h.DB, func(tx *sql.Tx) error {
+		if _, err := tx.Exec("DELETE FROM site_bans WHERE NOT " + activeBan); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`
+		INSERT INTO site_bans (identity_id, ip_range, reason, created_by, expires_at)
+		VALUES (?, ?, ?, ?, CASE WHEN ? IS NULL THEN NULL ELSE datetime('now', ?) END)`,
+			bannedID, bannedRange, reason, identity.ID, expires, expires)
+		if err != nil {
+			return err
+		}
+		return logModAction(tx, identity, modLogEntry{Action: "ban", Target: display})
+	})
+	if isUniqueViolation(err) {
+		e := Conflict("Please fix the errors below.")
+		e.Fields = map[string]string{"target": target + " is already banned"}
+		h.renderForm(w, r, "admin_bans.html", data, e)
+		return
+	}
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to save ban"))
+		return
+	}
+
+	http.Redirect(w, r, "/admin/bans", http.StatusSeeOther)
+}
+
+// getBans retrieves the bans in force, newest first
+func (h *Handler) getBans() ([]map[string]interface{}, error) {
+	rows, err := h.Reads.Query(`
+	SELECT b.id, b.identity_id, i.username, b.ip_range, b.reason, a.username, b.created_at, b.expires_at
+	FROM site_bans b
+	LEFT JOIN identities i ON b.identity_id = i.id
+	LEFT JOIN identities a ON b.created_by = a.id
+	WHERE ` + activeBan + `
+	ORDER BY b.id DESC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var bans []map[string]interface{}
+	for rows.Next() {
+		var id int
+		var identityID sql.NullInt64
+		var username, ipRange, bannedBy sql.NullString
+		var reason, createdAt string
+		var expiresAt sql.NullTime
+		if err := rows.Scan(&id, &identityID, &username, &ipRange, &reason, &bannedBy, &createdAt, &expiresAt); err != nil {
+			return nil, err
+		}
+		ban := map[string]interface{}{
+			"id":          id,
+			"identity_id": int(identityID.Int64),
+			"username":    username.String,
+			"ip_range":    ipRange.String,
+			"reason":      reason,
+			"banned_by":   bannedBy.String,
+			"created_at":  createdAt,
+			"expires_at":  nil,
+		}
+		if expiresAt.Valid {
+			ban["expires_at"] = expiresAt.Time
+		}
+		bans = append(bans, ban)
+	}
+	return bans, rows.Err()
+}
+
+// adminLiftBan handles the POST request that lifts a ban
+func (h *Handler) adminLiftBan(w http.ResponseWriter, r *http.Request, identity *models.Identity, id int) {
+	if r.Method != http.MethodPost {
+		h.renderError(w, r, MethodNotAllowed())
+		return
+	}
+
+	var username, ipRange sql.NullString
+	err := h.Reads.QueryRow(`
+	SELECT i.username, b.ip_range
+	FROM site_bans b LEFT JOIN identities i ON b.identity_id = i.id
+	WHERE b.id = ?`, id).Scan(&username, &ipRange)
+	if err == sql.ErrNoRows {
+		h.renderError(w, r, NotFound("This ban does not exist."))
+		return
+	}
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to get ban"))
+		return
+	}
+
+	target := ipRange.String
+	if username.Valid {
+		target = "u/" + username.String
+	}
+	err = database.WriteTx(h.DB, func(tx *sql.Tx) error {
+		if _, err := tx.Exec("DELETE FROM site_bans WHERE id = ?", id); err != nil {
+			return err
+		}
+		return logModAction(tx, identity, modLogEntry{Action: "unban", Target: target})
+	})
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to lift ban"))
+		return
+	}
+
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"deleted": id})
+		return
+	}
+	http.Redirect(w, r, "/admin/bans", http.StatusSeeOther)
+}
+
+// getAnnouncements retrieves the site's announcements, oldest first,
+// through the cache. The result is shared and must not be modified.
+func (h *Handler) getAnnouncements() ([]map[string]interface{}, error) {
+	v, err := h.Cache.Get(announcementsKey, func() (interface{}, error) {
+		return h.queryAnnouncements()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]map[string]interface{}), nil
+}
+
+// queryAnnouncements retrieves the site's announcements from the database
+func (h *Handler) queryAnnouncements() ([]map[string]interface{}, error) {
+	rows, err := h.Reads.Query("SELECT id, message, created_at FROM announcements ORDER BY id ASC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var announcements []map[string]interface{}
+	for rows.Next() {
+		var id int
+		var message, createdAt string
+		if err := rows.Scan(&id, &message, &createdAt); err != nil {
+			return nil, err
+		}
+		announcements = append(announcements, map[string]interface{}{
+			"id":         id,
+			"message":    message,
+			"created_at": createdAt,
+		})
+	}
+	return announcements, rows.Err()
+}
+
+// adminAnnouncements lists the announcements, and on POST posts a new one.
+// Announcements are shown above every page until they are removed.
+func (h *Handler) adminAnnouncements(w http.ResponseWriter, r *http.Request, identity *models.Identity) {
+	data := map[string]interface{}{
+		"Title":   "Admin: Announcements",
+		"Section": "announcements",
+		"Form":    map[string]string{},
+		"Errors":  map[string]string{},
+	}
+
+	if r.Method == http.MethodGet {
+		h.render(w, r, http.StatusOK, "admin_announcements.html", data)
+		return
+	}
+	if r.Method != http.MethodPost {
+		h.renderError(w, r, MethodNotAllowed())
+		return
+	}
+
+	message := strings.TrimSpace(r.FormValue("message"))
+	if message == "" || utf8.RuneCountInString(message) > maxAnnouncementLength {
+		h.renderForm(w, r, "admin_announcements.html", data, Validation("Please fix the errors below.", map[string]string{
+			"message": fmt.Sprintf("Announcements are 1 to %d characters long", maxAnnouncementLength),
+		}))
+		return
+	}
+
+	err := database.WriteTx(h.DB, func(tx *sql.Tx) error {
+		if _, err := tx.Exec("INSERT INTO announcements (message, created_by) VALUES (?, ?)", message, identity.ID); err != nil {
+			return err
+		}
+		return logModAction(tx, identity, modLogEntry{Action: "announce", Target: message})
+	})
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to post announcement"))
+		return
+	}
+	h.Cache.Invalidate(announcementsKey)
+
+	http.Redirect(w, r, "/admin/announcements", http.StatusSeeOther)
+}
+
+// adminRemoveAnnouncement handles the POST request that removes an announcement
+func (h *Handler) adminRemoveAnnouncement(w http.ResponseWriter, r *http.Request, identity *models.Identity, id int) {
+	if r.Method != http.MethodPost {
+		h.renderError(w, r, MethodNotAllowed())
+		return
+	}
+
+	var message string
+	err := h.Reads.QueryRow("SELECT message FROM announcements WHERE id = ?", id).Scan(&message)
+	if err == sql.ErrNoRows {
+		h.renderError(w, r, NotFound("This announcement does not exist."))
+		return
+	}
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to get announcement"))
+		return
+	}
+
+	err = database.WriteTx(h.DB, func(tx *sql.Tx) error {
+		if _, err := tx.Exec("DELETE FROM announcements WHERE id = ?", id); err != nil {
+			return err
+		}
+		return logModAction(tx, identity, modLogEntry{Action: "unannounce", Target: message})
+	})
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to remove announcement"))
+		return
+	}
+	h.Cache.Invalidate(announcementsKey)
+
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"deleted": id})
+		return
+	}
+	http.Redirect(w, r, "/admin/announcements", http.StatusSeeOther)
+}
+
+// adminLog shows the moderation log of every community, and the site-wide
+// actions of admins, a page at a time. ?community= and ?action= narrow it
+// down to one community or one kind of action.
+func (h *Handler) adminLog(w http.ResponseWriter, r *http.Request) {
+	community := strings.TrimPrefix(strings.TrimSpace(r.URL.Query().Get("community")), "c/")
+	action := r.URL.Query().Get("action")
+	page := pageNumber(r)
+
+	entries, hasMore, err := h.getModLog(community, action, page)
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to get moderation log"))
+		return
+	}
+
+	if wantsJSON(r) {
+		if entries == nil {
+			entries = []map[string]interface{}{}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"entries":  entries,
+			"page":     page,
+			"has_more": hasMore,
+		})
+		return
+	}
+
+	// Pagination links keep the filter
+	query := url.Values{}
+	if community != "" {
+		query.Set("community", community)
+	}
+	if action != "" {
+		query.Set("action", action)
+	}
+	data := map[string]interface{}{
+		"Title":     "Admin: Moderation Log",
+		"Section":   "log",
+		"Log":       entries,
+		"Actions":   modActions,
+		"Community": community,
+		"Action":    action,
+	}
+	if page > 1 {
+		query.Set("page", strconv.Itoa(page-1))
+		data["PrevPage"] = "?" + query.Encode()
+	}
+	if hasMore {
+		query.Set("page", strconv.Itoa(page+1))
+		data["NextPage"] = "?" + query.Encode()
+	}
+	h.render(w, r, http.StatusOK, "admin_log.html", data)
+}
+
+// adminReturnPath returns the admin page a form was posted from, so that
+// acting on a community from the second page of the list goes back there
+func adminReturnPath(r *http.Request, fallback string) string {
+	if referer, err := url.Parse(r.Referer()); err == nil && referer.Host == r.Host && strings.HasPrefix(referer.Path, "/admin") {
+		return referer.RequestURI()
+	}
+	return fallback
+}
@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"hubcorner/internal/models"
+)
+
+// activeBan is the condition on site_bans rows that are still in force
+const activeBan = "(expires_at IS NULL OR expires_at > CURRENT_TIMESTAMP)"
+
+// checkBanned returns a forbidden error if the identity, or the network the
+// request comes from, is banned from the site. Admins are exempt, so a ban
+// of a network never locks them out.
+func (h *Handler) checkBanned(r *http.Request, identity *models.Identity) error {
+	if identity.IsAdmin {
+		return nil
+	}
+
+	rows, err := h.Reads.Query("SELECT ip_range, reason, expires_at FROM site_bans WHERE (identity_id = ? OR ip_range IS NOT NULL) AND "+activeBan, identity.ID)
+	if err != nil {
+		return Internal(err, "Failed to check bans")
+	}
+	defer rows.Close()
+
+	ip := clientIP(r)
+	for rows.Next() {
+		var ipRange sql.NullString
+		var reason string
+		var expiresAt sql.NullTime
+		if err := rows.Scan(&ipRange, &reason, &expiresAt); err != nil {
+			return Internal(err, "Failed to check bans")
+		}
+		if ipRange.Valid {
+			_, network, err := net.ParseCIDR(ipRange.String)
+			if err != nil || ip == nil || !network.Contains(ip) {
+				continue
+			}
+		}
+		return Forbidden(banMessage(reason, expiresAt))
+	}
+	if err := rows.Err(); err != nil {
+		return Internal(err, "Failed to check bans")
+	}
+	return nil
+}
+
+// banMessage tells a banned client why and for how long
+func banMessage(reason string, expiresAt sql.NullTime) string {
+	message := "You are banned from posting, commenting and voting on HubCorner"
+	if expiresAt.Valid {
+		message += " until " + expiresAt.Time.UTC().Format("2 January 2006 15:04 MST")
+	}
+	message += "."
+	if reason != "" {
+		message += " Reason: " + reason
+	}
+	return message
+}
+
+// parseBanTarget reads what the ban form's target field names: an IP
+// address or network, returned as a network in CIDR notation, or else a
+// username, returned as the identity's ID
+func (h *Handler) parseBanTarget(target string) (ipRange string, identityID int, err error) {
+	if _, network, err := net.ParseCIDR(target); err == nil {
+		return network.String(), 0, nil
+	}
+	if ip := net.ParseIP(target); ip != nil {
+		bits := 128
+		if ip.To4() != nil {
+			bits = 32
+		}
+		return (&net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}).String(), 0, nil
+	}
+
+	var isAdmin bool
+	err = h.Reads.QueryRow("SELECT id, is_admin FROM identities WHERE username = ?", target).Scan(&identityID, &isAdmin)
+	if err == sql.ErrNoRows {
+		return "", 0, Validation("Please fix the errors below.", map[string]string{
+			"target": fmt.Sprintf("There is no user named %s, and it is not an IP address or network", target),
+		})
+	}
+	if err != nil {
+		return "", 0, Internal(err, "Failed to get user")
+	}
+	if isAdmin {
+		return "", 0, Validation("Please fix the errors below.", map[string]string{
+			"target": "Admins can't be banned. Revoke their admin rights first.",
+		})
+	}
+	return "", identityID, nil
+}
+
+// banDurations are the lengths of bans the ban form offers, by form value;
+// "" is a permanent ban
+var banDurations = map[string]time.Duration{
+	"1d":  24 * time.Hour,
+	"7d":  7 * 24 * time.Hour,
+	"30d": 30 * 24 * time.Hour,
+	"":    0,
+}
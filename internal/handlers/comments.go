@@ -0,0 +1,231 @@
+package handlers
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"hubcorner/internal/models"
+)
+
+// Comment sort orders, chosen with ?sort= on a post page
+const (
+	commentSortBest          = "best"
+	commentSortTop           = "top"
+	commentSortNew           = "new"
+	commentSortOld           = "old"
+	commentSortControversial = "controversial"
+	commentSortQA            = "qa"
+)
+
+// commentSort is a comment sort order as offered on the post page
+type commentSort struct {
+	Value string
+	Label string
+}
+
+// commentSorts lists the comment sort orders, the default first
+var commentSorts = []commentSort{
+	{commentSortBest, "Best"},
+	{commentSortTop, "Top"},
+	{commentSortNew, "New"},
+	{commentSortOld, "Old"},
+	{commentSortControversial, "Controversial"},
+	{commentSortQA, "Q&A"},
+}
+
+// Limits on the comments a post page shows
+const (
+	DefaultCommentDepth   = 8  // levels of replies, before "continue this thread" links
+	DefaultCommentReplies = 10 // replies to each comment, before "load more" links
+	commentsPerPage       = 50 // top-level comments, before a "load more" link
+	maxCommentContext     = 8  // parent comments above a comment permalink
+)
+
+// parseCommentSort returns the comment sort order asked for with ?sort=,
+// falling back to the default for a missing or unknown order
+func parseCommentSort(r *http.Request) string {
+	value := r.URL.Query().Get("sort")
+	for _, s := range commentSorts {
+		if s.Value == value {
+			return value
+		}
+	}
+	return commentSortBest
+}
+
+// parseCommentContext returns the number of parent comments asked for with
+// ?context= on a comment permalink
+func parseCommentContext(r *http.Request) int {
+	context, err := strconv.Atoi(r.URL.Query().Get("context"))
+	if err != nil || context < 0 {
+		return 0
+	}
+	if context > maxCommentContext {
+		return maxCommentContext
+	}
+	return context
+}
+
+// parseCommentLimit returns the number of top-level comments asked for with
+// ?limit= on a post page, a multiple of commentsPerPage
+func parseCommentLimit(r *http.Request) int {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit < commentsPerPage {
+		return commentsPerPage
+	}
+	return limit - limit%commentsPerPage
+}
+
+// wilsonScore is the lower bound of the Wilson score interval for the share
+// of upvotes, at 80% confidence. It ranks a comment by how sure we can be
+// that it is good, so a few early upvotes don't beat many later ones.
+func wilsonScore(upvotes, downvotes int) float64 {
+	n := float64(upvotes + downvotes)
+	if n == 0 {
+		return 0
+	}
+	const z = 1.281551565545
+	p := float64(upvotes) / n
+	return (p + z*z/(2*n) - z*math.Sqrt((p*(1-p)+z*z/(4*n))/n)) / (1 + z*z/n)
+}
+
+// controversy is high for comments with many votes split evenly between up and down
+func controversy(upvotes, downvotes int) float64 {
+	if upvotes <= 0 || downvotes <= 0 {
+		return 0
+	}
+	balance := float64(downvotes) / float64(upvotes)
+	if upvotes < downvotes {
+		balance = float64(upvotes) / float64(downvotes)
+	}
+	return math.Pow(float64(upvotes+downvotes), balance)
+}
+
+// sortComments sorts a comment tree in place, replies included. Ties are
+// broken by age, oldest first, so the order is the same on every page load.
+func sortComments(comments []*models.Comment, order string) {
+	// In Q&A mode, the post author's comments come first, then the
+	// comments the post author has answered
+	answered := func(c *models.Comment) bool {
+		for _, reply := range c.Replies {
+			if reply.IsOP {
+				return true
+			}
+		}
+		return false
+	}
+
+	less := func(a, b *models.Comment) (bool, bool) {
+		switch order {
+		case commentSortTop:
+			if a.Score != b.Score {
+				return a.Score > b.Score, true
+			}
+		case commentSortNew:
+			return a.ID > b.ID, true
+		case commentSortOld:
+			return a.ID < b.ID, true
+		case commentSortControversial:
+			if ca, cb := controversy(a.Upvotes, a.Downvotes), controversy(b.Upvotes, b.Downvotes); ca != cb {
+				return ca > cb, true
+			}
+		case commentSortQA:
+			if a.IsOP != b.IsOP {
+				return a.IsOP, true
+			}
+			if ansA, ansB := answered(a), answered(b); ansA != ansB {
+				return ansA, true
+			}
+		}
+		if wa, wb := wilsonScore(a.Upvotes, a.Downvotes), wilsonScore(b.Upvotes, b.Downvotes); wa != wb {
+			return wa > wb, true
+		}
+		return false, false
+	}
+
+	sort.SliceStable(comments, func(i, j int) bool {
+		if result, decided := less(comments[i], comments[j]); decided {
+			return result
+		}
+		return comments[i].ID < comments[j].ID
+	})
+
+	for _, comment := range comments {
+		sortComments(comment.Replies, order)
+	}
+}
+
+// commentPath returns the comments from the top of a comment tree down to
+// the comment with the given ID, or nil if the tree doesn't contain it
+func commentPath(comments []*models.Comment, commentID int) []*models.Comment {
+	for _, comment := range comments {
+		if comment.ID == commentID {
+			return []*models.Comment{comment}
+		}
+		if path := commentPath(comment.Replies, commentID); path != nil {
+			return append([]*models.Comment{comment}, path...)
+		}
+	}
+	return nil
+}
+
+// commentThread cuts a comment tree down to one comment and its replies,
+// below up to context of its parents. It also reports whether the comment
+// has parents above the ones shown. The tree is changed in place.
+func commentThread(comments []*models.Comment, commentID, context int) ([]*models.Comment, bool) {
+	path := commentPath(comments, commentID)
+	if path == nil {
+		return nil, false
+	}
+	start := len(path) - 1 - context
+	if start < 0 {
+		start = 0
+	}
+	// Each parent shows only the reply leading to the comment
+	for i := start; i < len(path)-1; i++ {
+		path[i].Replies = []*models.Comment{path[i+1]}
+	}
+	return []*models.Comment{path[start]}, start > 0
+}
+
+// limitComments cuts a sorted comment tree down to what a page shows:
+// replies go at most h.CommentDepth levels deep, below which a comment
+// links to its own thread, and each comment shows at most
+// h.CommentReplies replies. The replies of focusID, the comment of a
+// permalink, are all shown, and the depth is counted again from it. The
+// parents above focusID are never cut, however much context is asked for.
+func (h *Handler) limitComments(comments []*models.Comment, focusID int) {
+	parents := make(map[int]bool)
+	if path := commentPath(comments, focusID); path != nil {
+		for _, parent := range path[:len(path)-1] {
+			parents[parent.ID] = true
+		}
+	}
+
+	var limit func(c *models.Comment, depth int)
+	limit = func(c *models.Comment, depth int) {
+		if c.ID == focusID {
+			depth = 0
+		}
+		if len(c.Replies) == 0 {
+			return
+		}
+		if depth+1 >= h.CommentDepth && !parents[c.ID] {
+			c.Replies = nil
+			c.ContinueThread = true
+			return
+		}
+		if c.ID != focusID && len(c.Replies) > h.CommentReplies {
+			c.MoreReplies = len(c.Replies) - h.CommentReplies
+			c.Replies = c.Replies[:h.CommentReplies]
+		}
+		for _, reply := range c.Replies {
+			limit(reply, depth+1)
+		}
+	}
+	for _, comment := range comments {
+		limit(comment, 0)
+	}
+}
@@ -0,0 +1,206 @@
+package handlers
+
+import (
+	"reflect"
+	"testing"
+
+	"hubcorner/internal/models"
+)
+
+// ids returns the IDs of comments, in order
+func ids(comments []*models.Comment) []int {
+	result := []int{}
+	for _, c := range comments {
+		result = append(result, c.ID)
+	}
+	return result
+}
+
+// chain returns a thread of n comments with IDs 1 to n, each replying to
+// the one before, and the comments by ID
+func chain(n int) ([]*models.Comment, map[int]*models.Comment) {
+	byID := make(map[int]*models.Comment)
+	var root, last *models.Comment
+	for id := 1; id <= n; id++ {
+		c := &models.Comment{ID: id}
+		byID[id] = c
+		if last == nil {
+			root = c
+		} else {
+			last.Replies = []*models.Comment{c}
+		}
+		last = c
+	}
+	return []*models.Comment{root}, byID
+}
+
+func TestSortComments(t *testing.T) {
+	tests := []struct {
+		order string
+		want  []int
+	}{
+		// Best: 1 has the most votes at the best ratio; 4 and 5 are tied
+		// without votes and keep their age order
+		{commentSortBest, []int{1, 3, 2, 4, 5}},
+		{commentSortTop, []int{1, 3, 2, 4, 5}},
+		{commentSortNew, []int{5, 4, 3, 2, 1}},
+		{commentSortOld, []int{1, 2, 3, 4, 5}},
+		// Controversial: 2 is split evenly, and 3 is closer to even than 1
+		{commentSortControversial, []int{2, 3, 1, 4, 5}},
+		// Q&A: the author's comment, then the one the author answered
+		{commentSortQA, []int{4, 5, 1, 3, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.order, func(t *testing.T) {
+			comments := []*models.Comment{
+				{ID: 1, Upvotes: 50, Downvotes: 2, Score: 48},
+				{ID: 2, Upvotes: 20, Downvotes: 20, Score: 0},
+				{ID: 3, Upvotes: 5, Downvotes: 1, Score: 4},
+				{ID: 4, IsOP: true},
+				{ID: 5, Replies: []*models.Comment{{ID: 7, IsOP: true}, {ID: 6, Upvotes: 3, Score: 3}}},
+			}
+			sortComments(comments, tt.order)
+			if got := ids(comments); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("order = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// Replies are sorted too
+	comments := []*models.Comment{{ID: 1, Replies: []*models.Comment{{ID: 2}, {ID: 3}}}}
+	sortComments(comments, commentSortNew)
+	if got := ids(comments[0].Replies); !reflect.DeepEqual(got, []int{3, 2}) {
+		t.Errorf("replies = %v, want [3 2]", got)
+	}
+}
+
+func TestCommentThread(t *testing.T) {
+	tests := []struct {
+		name        string
+		commentID   int
+		context     int
+		wantRoot    int
+		wantMore    bool
+		wantMissing bool
+	}{
+		{name: "no context", commentID: 4, context: 0, wantRoot: 4, wantMore: true},
+		{name: "some context", commentID: 4, context: 2, wantRoot: 2, wantMore: true},
+		{name: "all parents", commentID: 4, context: 3, wantRoot: 1},
+		{name: "more context than parents", commentID: 4, context: 8, wantRoot: 1},
+		{name: "top-level comment", commentID: 1, context: 8, wantRoot: 1},
+		{name: "missing comment", commentID: 99, context: 8, wantMissing: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			comments, _ := chain(6)
+			// A sibling of 3 that the thread must leave out
+			comments[0].Replies[0].Replies = append(comments[0].Replies[0].Replies, &models.Comment{ID: 50})
+
+			thread, more := commentThread(comments, tt.commentID, tt.context)
+			if tt.wantMissing {
+				if thread != nil || more {
+					t.Fatalf("got %v, %v for a missing comment", ids(thread), more)
+				}
+				return
+			}
+			if len(thread) != 1 || thread[0].ID != tt.wantRoot {
+				t.Fatalf("thread = %v, want [%d]", ids(thread), tt.wantRoot)
+			}
+			if more != tt.wantMore {
+				t.Errorf("more = %v, want %v", more, tt.wantMore)
+			}
+
+			// Down to the comment, each parent has only the reply on the way
+			c := thread[0]
+			for c.ID != tt.commentID {
+				if len(c.Replies) != 1 {
+					t.Fatalf("comment %d has replies %v, want only the next parent", c.ID, ids(c.Replies))
+				}
+				c = c.Replies[0]
+			}
+			// The comment keeps its replies
+			if tt.commentID < 6 && len(c.Replies) != 1 {
+				t.Errorf("comment %d lost its replies", c.ID)
+			}
+		})
+	}
+}
+
+func TestLimitCommentsDepth(t *testing.T) {
+	h := &Handler{CommentDepth: 3, CommentReplies: DefaultCommentReplies}
+	comments, byID := chain(5)
+	h.limitComments(comments, 0)
+
+	// Comments at depths 0, 1 and 2 are shown; 3 links to its thread
+	if !byID[3].ContinueThread || byID[3].Replies != nil {
+		t.Errorf("comment 3: ContinueThread = %v, replies = %v; want its replies cut", byID[3].ContinueThread, ids(byID[3].Replies))
+	}
+	for _, id := range []int{1, 2} {
+		if byID[id].ContinueThread || len(byID[id].Replies) != 1 {
+			t.Errorf("comment %d was cut", id)
+		}
+	}
+}
+
+func TestLimitCommentsReplies(t *testing.T) {
+	h := &Handler{CommentDepth: DefaultCommentDepth, CommentReplies: 2}
+	replies := []*models.Comment{{ID: 2}, {ID: 3}, {ID: 4}, {ID: 5}}
+	comments := []*models.Comment{{ID: 1, Replies: replies}}
+	h.limitComments(comments, 0)
+	if got := ids(comments[0].Replies); !reflect.DeepEqual(got, []int{2, 3}) {
+		t.Errorf("replies = %v, want [2 3]", got)
+	}
+	if comments[0].MoreReplies != 2 {
+		t.Errorf("MoreReplies = %d, want 2", comments[0].MoreReplies)
+	}
+
+	// The comment of a permalink shows all its replies
+	comments = []*models.Comment{{ID: 1, Replies: []*models.Comment{{ID: 2}, {ID: 3}, {ID: 4}}}}
+	h.limitComments(comments, 1)
+	if got := ids(comments[0].Replies); len(got) != 3 || comments[0].MoreReplies != 0 {
+		t.Errorf("permalinked comment's replies = %v, MoreReplies = %d; want all 3", got, comments[0].MoreReplies)
+	}
+}
+
+func TestLimitCommentsFocus(t *testing.T) {
+	h := &Handler{CommentDepth: 3, CommentReplies: DefaultCommentReplies}
+
+	// A permalink to comment 5 with no context: the depth counts from 5, so
+	// 5, 6 and 7 are shown and 7 links to its thread
+	comments, byID := chain(10)
+	thread, _ := commentThread(comments, 5, 0)
+	h.limitComments(thread, 5)
+	if !byID[7].ContinueThread {
+		t.Errorf("comment 7 should link to its thread")
+	}
+	if byID[5].ContinueThread || byID[6].ContinueThread {
+		t.Errorf("comments above the depth limit were cut")
+	}
+}
+
+// With as much context as the depth limit, or more, the parents take up the
+// whole depth, but the permalinked comment and its replies must be shown
+func TestLimitCommentsContextAtDepth(t *testing.T) {
+	for _, context := range []int{DefaultCommentDepth - 1, DefaultCommentDepth, maxCommentContext} {
+		h := &Handler{CommentDepth: DefaultCommentDepth, CommentReplies: DefaultCommentReplies}
+		comments, byID := chain(20)
+		focus := 12
+		thread, _ := commentThread(comments, focus, context)
+		h.limitComments(thread, focus)
+
+		c := thread[0]
+		for c.ID != focus {
+			if c.ContinueThread || len(c.Replies) != 1 {
+				t.Fatalf("context=%d: parent %d was cut before reaching comment %d", context, c.ID, focus)
+			}
+			c = c.Replies[0]
+		}
+		if c.ContinueThread || len(c.Replies) != 1 || c.Replies[0].ID != focus+1 {
+			t.Errorf("context=%d: comment %d lost its replies", context, focus)
+		}
+		// Below the comment, the depth limit applies as usual
+		if last := focus + DefaultCommentDepth - 1; !byID[last].ContinueThread {
+			t.Errorf("context=%d: comment %d should link to its thread", context, last)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"hubcorner/internal/cache"
+	"hubcorner/internal/security"
+)
+
+// isRead reports whether a request only reads, so its response can be cached
+func isRead(r *http.Request) bool {
+	return r.Method == http.MethodGet || r.Method == http.MethodHead
+}
+
+// Conditional wraps the handler of a page or API route so that browsers and
+// proxies can keep its responses. Successful responses to GET and HEAD
+// requests get an ETag, a hash of the response, and a request whose
+// If-None-Match has that ETag gets 304 Not Modified without the body.
+//
+// With a versions store, responses also get a Last-Modified date, so
+// clients that only send If-Modified-Since can get 304 too. Nothing in the
+// database dates every change to a page, such as a vote, so the date is
+// when this server first served the response's ETag for the request, which
+// versions keeps. If-None-Match takes precedence when a client sends both.
+//
+// Responses depend on the client_id cookie and, for pages that are also
+// JSON, on how the client asks for JSON, so they vary on those headers.
+// Responses to clients with a cookie are private, and browsers revalidate
+// them every time. A client without a cookie is a visitor, who sees what
+// every other visitor sees, so shared caches such as nginx may keep those
+// responses for the shared duration; with 0 they are revalidated every time
+// too.
+func Conditional(shared time.Duration, versions cache.Store, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isRead(r) {
+			next(w, r)
+			return
+		}
+
+		rec := &recorder{header: make(http.Header), status: http.StatusOK}
+		next(rec, r)
+
+		header := w.Header()
+		for k, v := range rec.header {
+			header[k] = v
+		}
+		header.Add("Vary", "Cookie, Accept, X-Requested-With")
+		if rec.status != http.StatusOK {
+			w.WriteHeader(rec.status)
+			w.Write(rec.body.Bytes())
+			return
+		}
+
+		if header.Get("Cache-Control") == "" {
+			_, err := r.Cookie(clientIDCookie)
+			switch {
+			case err == nil || header.Get("Set-Cookie") != "":
+				// Never share a response meant for one client
+				header.Set("Cache-Control", "private, no-cache")
+			case shared > 0:
+				header.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(shared.Seconds())))
+			default:
+				header.Set("Cache-Control", "no-cache")
+			}
+		}
+		if header.Get("ETag") == "" {
+			// Weak, so that the ETag still holds for a compressed response.
+			// The script nonce is new in every response, so it is left out.
+			body := rec.body.Bytes()
+			if nonce := security.Nonce(r); nonce != "" {
+				body = bytes.ReplaceAll(body, []byte(nonce), nil)
+			}
+			sum := sha256.Sum256(body)
+			header.Set("ETag", `W/"`+hex.EncodeToString(sum[:16])+`"`)
+		}
+
+		if header.Get("Last-Modified") == "" && versions != nil {
+			setLastModified(header, versions, r)
+		}
+
+		if notModified(r, header) {
+			// A 304 carries the headers of the response it stands for, but no
+			// body. The client keeps the policy it has, whose nonce matches
+			// the page it has, as headers left out of a 304 aren't updated.
+			header.Del("Content-Type")
+			header.Del("Content-Length")
+			header.Del("Content-Security-Policy")
+			header.Del("Content-Security-Policy-Report-Only")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.WriteHeader(rec.status)
+		w.Write(rec.body.Bytes())
+	}
+}
+
+// versionKey is what versions keeps the ETag of a response under: the
+// request's URL and the headers the response varies on
+func versionKey(r *http.Request) string {
+	return strings.Join([]string{r.URL.RequestURI(), r.Header.Get("Cookie"), r.Header.Get("Accept"), r.Header.Get("X-Requested-With")}, "\n")
+}
+
+// setLastModified sets the Last-Modified date of a response from when its
+// ETag was first served for the request. Dates are whole seconds, so the
+// date is only sent once its second is over: a response that changes again
+// within that second then still gets a later date than the one sent.
+func setLastModified(header http.Header, versions cache.Store, r *http.Request) {
+	key := versionKey(r)
+	etag := header.Get("ETag")
+	version, ok := versions.Get(key)
+	if !ok || version.Value != etag {
+		version = cache.Entry{Value: etag, Loaded: time.Now()}
+		versions.Set(key, version)
+	}
+	modified := version.Loaded.Truncate(time.Second)
+	if modified.Before(time.Now().Truncate(time.Second)) {
+		header.Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+}
+
+// notModified reports whether the client already has the response, going
+// by If-None-Match, or by If-Modified-Since if there is no If-None-Match
+func notModified(r *http.Request, header http.Header) bool {
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		return etagMatches(ifNoneMatch, header.Get("ETag"))
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(header.Get("Last-Modified"))
+	return err == nil && !modified.After(since)
+}
+
+// etagMatches reports whether an If-None-Match header lists etag, comparing
+// ETags weakly as RFC 9110 asks for If-None-Match
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// recorder buffers a response, so that its ETag can be worked out before
+// anything is sent
+type recorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+	wrote  bool
+}
+
+func (rec *recorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *recorder) WriteHeader(status int) {
+	if !rec.wrote {
+		rec.status = status
+		rec.wrote = true
+	}
+}
+
+func (rec *recorder) Write(b []byte) (int, error) {
+	rec.wrote = true
+	return rec.body.Write(b)
+}
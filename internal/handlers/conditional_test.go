@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"hubcorner/internal/cache"
+)
+
+// serve sends a GET request with headers to handler
+func serve(handler http.HandlerFunc, headers map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "/c/golang", nil)
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func TestConditionalETag(t *testing.T) {
+	body := "first"
+	handler := Conditional(0, nil, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	})
+
+	w := serve(handler, nil)
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" {
+		t.Fatalf("status %d, ETag %q; want 200 with an ETag", w.Code, etag)
+	}
+	if w.Header().Get("Last-Modified") != "" {
+		t.Errorf("Last-Modified sent without a versions store")
+	}
+	if w := serve(handler, map[string]string{"If-None-Match": etag}); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("same ETag: status %d with %d bytes, want 304 without a body", w.Code, w.Body.Len())
+	}
+
+	body = "second"
+	if w := serve(handler, map[string]string{"If-None-Match": etag}); w.Code != http.StatusOK || w.Body.String() != "second" {
+		t.Errorf("changed response: status %d, body %q; want 200 with the new body", w.Code, w.Body.String())
+	}
+}
+
+func TestConditionalLastModified(t *testing.T) {
+	body := "first"
+	handler := Conditional(0, cache.NewLRU(10), func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	})
+
+	// The date is only sent once the second the response was first seen in
+	// is over
+	w := serve(handler, nil)
+	if got := w.Header().Get("Last-Modified"); got != "" {
+		t.Errorf("Last-Modified = %q for a response first seen this second, want none", got)
+	}
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+	w = serve(handler, nil)
+	modified := w.Header().Get("Last-Modified")
+	if modified == "" {
+		t.Fatalf("no Last-Modified once the second is over")
+	}
+	if got := serve(handler, nil).Header().Get("Last-Modified"); got != modified {
+		t.Errorf("Last-Modified moved from %q to %q while the response stayed the same", modified, got)
+	}
+
+	if w := serve(handler, map[string]string{"If-Modified-Since": modified}); w.Code != http.StatusNotModified {
+		t.Errorf("If-Modified-Since the date: status %d, want 304", w.Code)
+	}
+	// If-None-Match takes precedence
+	if w := serve(handler, map[string]string{"If-Modified-Since": modified, "If-None-Match": `"other"`}); w.Code != http.StatusOK {
+		t.Errorf("If-None-Match of another ETag: status %d, want 200", w.Code)
+	}
+	// Another client's response is dated on its own
+	if w := serve(handler, map[string]string{"Cookie": clientIDCookie + "=abc"}); w.Header().Get("Last-Modified") != "" {
+		t.Errorf("a new client's response got the date of a visitor's")
+	}
+
+	// Once the response changes, the old date doesn't get a 304
+	body = "second"
+	if w := serve(handler, map[string]string{"If-Modified-Since": modified}); w.Code != http.StatusOK || w.Body.String() != "second" {
+		t.Errorf("changed response: status %d, body %q; want 200 with the new body", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,203 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"hubcorner/internal/database"
+	"hubcorner/internal/models"
+)
+
+// getCrossposts retrieves the crossposts of an original post, oldest first.
+// Crossposts in private communities are left out.
+func (h *Handler) getCrossposts(originalID int) ([]map[string]interface{}, error) {
+	rows, err := h.Reads.Query(`
+	SELECT p.id, p.title, p.community_id, c.name, p.created_at, p.upvotes, p.downvotes
+	FROM posts p
+	JOIN communities c ON p.community_id = c.id
+	WHERE p.crosspost_parent_id = ? AND c.type != 'private'
+	ORDER BY p.created_at ASC
+	`, originalID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var crossposts []map[string]interface{}
+	for rows.Next() {
+		var id, communityID, upvotes, downvotes int
+		var title, communityName, createdAt string
+		if err := rows.Scan(&id, &title, &communityID, &communityName, &createdAt, &upvotes, &downvotes); err != nil {
+			return nil, err
+		}
+		crossposts = append(crossposts, map[string]interface{}{
+			"id":             id,
+			"title":          title,
+			"community_id":   communityID,
+			"community_name": communityName,
+			"created_at":     createdAt,
+			"score":          upvotes - downvotes,
+		})
+	}
+	return crossposts, rows.Err()
+}
+
+// Crosspost handles /posts/{id}/crosspost: the form for sharing a post in
+// another community, and the POST request that creates the crosspost. A
+// crosspost is a new post with its own score and comments that links back
+// to the original. Crossposting a crosspost shares the original.
+func (h *Handler) Crosspost(w http.ResponseWriter, r *http.Request, postID int) {
+	original, err := h.getPost(postID)
+	if err == sql.ErrNoRows {
+		h.renderError(w, r, NotFound("This post does not exist or has been removed."))
+		return
+	}
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to get post"))
+		return
+	}
+	if parentID := original["crosspost_parent_id"].(int); parentID != 0 {
+		original, err = h.getPost(parentID)
+		if err != nil {
+			h.renderError(w, r, Internal(err, "Failed to get original post"))
+			return
+		}
+	}
+	originalID := original["id"].(int)
+
+	// Only posts everyone can see can be shared
+	identity, err := h.currentIdentity(w, r)
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to get identity"))
+		return
+	}
+	source, err := h.getCommunityByID(original["community_id"].(int))
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to get community"))
+		return
+	}
+	if err := h.checkCanView(source, identity); err != nil {
+		h.renderError(w, r, err)
+		return
+	}
+	if source.Type == models.CommunityPrivate {
+		h.renderError(w, r, Forbidden("Posts from private communities cannot be crossposted."))
+		return
+	}
+
+	crossposts, err := h.getCrossposts(originalID)
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to get crossposts"))
+		return
+	}
+	communities, err := h.getCommunities()
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to get communities"))
+		return
+	}
+
+	data := map[string]interface{}{
+		"Title":       "Crosspost",
+		"Post":        original,
+		"Crossposts":  crossposts,
+		"Communities": communities,
+		"Form":        map[string]string{"title": original["title"].(string)},
+		"Errors":      map[string]string{},
+	}
+
+	if r.Method == http.MethodGet {
+		h.render(w, r, http.StatusOK, "crosspost.html", data)
+		return
+	}
+	if r.Method != http.MethodPost {
+		h.renderError(w, r, MethodNotAllowed())
+		return
+	}
+
+	title := strings.TrimSpace(r.FormValue("title"))
+	fields := make(map[string]string)
+	if title == "" {
+		fields["title"] = "Post title is required"
+	}
+
+	var target *models.Community
+	communityID, err := strconv.Atoi(r.FormValue("community_id"))
+	if err != nil {
+		fields["community_id"] = "Please select a community"
+	} else if target, err = h.getCommunityByID(communityID); err == sql.ErrNoRows {
+		fields["community_id"] = "This community does not exist"
+	} else if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to get community"))
+		return
+	} else if target.ID == source.ID {
+		fields["community_id"] = fmt.Sprintf("This post is already in c/%s", target.Name)
+	}
+	if len(fields) > 0 {
+		h.renderForm(w, r, "crosspost.html", data, Validation("Please fix the errors below.", fields))
+		return
+	}
+
+	// Enforce the target community's posting restrictions. A crosspost of a
+	// link post counts as a link post.
+	link := original["url"].(string)
+	if err := h.checkCanPost(target, identity, link); err != nil {
+		if e, ok := err.(*Error); ok && e.Kind != KindInternal {
+			h.renderForm(w, r, "crosspost.html", data, e)
+			return
+		}
+		h.renderError(w, r, err)
+		return
+	}
+	if err := h.checkBanned(r, identity); err != nil {
+		h.renderError(w, r, err)
+		return
+	}
+	if err := h.checkRateLimit(postRateLimit, identity); err != nil {
+		h.renderError(w, r, err)
+		return
+	}
+
+	var crosspostID int64
+	err = database.WriteTx(h.DB, func(tx *sql.Tx) error {
+		// A post is crossposted to each community at most once, private ones
+		// included. Checked in the transaction, two submits can't both pass.
+		var exists int
+		err := tx.QueryRow("SELECT 1 FROM posts WHERE crosspost_parent_id = ? AND community_id = ?", originalID, target.ID).Scan(&exists)
+		if err == nil {
+			e := Conflict("Please fix the errors below.")
+			e.Fields = map[string]string{"community_id": fmt.Sprintf("This post has already been crossposted to c/%s", target.Name)}
+			return e
+		}
+		if err != sql.ErrNoRows {
+			return err
+		}
+
+		result, err := tx.Exec(`
+		INSERT INTO posts (title, content, url, community_id, author_id, crosspost_parent_id)
+		VALUES (?, '', ?, ?, ?, ?)`, title, link, target.ID, identity.ID, originalID)
+		if err != nil {
+			return err
+		}
+		crosspostID, err = result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("UPDATE communities SET post_count = post_count + 1 WHERE id = ?", target.ID)
+		return err
+	})
+	if e, ok := err.(*Error); ok && e.Kind == KindConflict {
+		h.renderForm(w, r, "crosspost.html", data, e)
+		return
+	}
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to create crosspost"))
+		return
+	}
+	h.Cache.Invalidate(postsPrefix)
+	h.Cache.Invalidate(communitiesKey)
+
+	http.Redirect(w, r, fmt.Sprintf("/posts/%d", crosspostID), http.StatusSeeOther)
+}
@@ -0,0 +1,222 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"hubcorner/internal/database"
+	"hubcorner/internal/security"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// ErrorKind classifies errors returned to the client
+type ErrorKind int
+
+const (
+	// KindInternal is an unexpected failure; its details are logged, not shown
+	KindInternal ErrorKind = iota
+	// KindNotFound means the requested page or item does not exist
+	KindNotFound
+	// KindValidation means the request had missing or invalid input
+	KindValidation
+	// KindConflict means the request clashes with existing data
+	KindConflict
+	// KindForbidden means the client may not perform the request
+	KindForbidden
+	// KindMethodNotAllowed means the route does not accept the request method
+	KindMethodNotAllowed
+	// KindTooManyRequests means the client has hit a rate limit
+	KindTooManyRequests
+	// KindUnavailable means the server is too busy to handle the request now
+	KindUnavailable
+)
+
+// Error is an error with a message that is safe to show to the client
+type Error struct {
+	Kind    ErrorKind
+	Message string
+	// Fields holds per-field messages for validation errors, keyed by form field name
+	Fields map[string]string
+	// Err is the underlying cause. It is logged but never shown.
+	Err error
+}
+
+// Error implements the error interface
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+// Unwrap returns the underlying cause
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Status returns the HTTP status code for the error
+func (e *Error) Status() int {
+	switch e.Kind {
+	case KindNotFound:
+		return http.StatusNotFound
+	case KindValidation:
+		return http.StatusBadRequest
+	case KindConflict:
+		return http.StatusConflict
+	case KindForbidden:
+		return http.StatusForbidden
+	case KindMethodNotAllowed:
+		return http.StatusMethodNotAllowed
+	case KindTooManyRequests:
+		return http.StatusTooManyRequests
+	case KindUnavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// Title returns a short heading for the error page
+func (e *Error) Title() string {
+	switch e.Kind {
+	case KindNotFound:
+		return "Page not found"
+	case KindValidation:
+		return "Invalid request"
+	case KindConflict:
+		return "Conflict"
+	case KindForbidden:
+		return "Forbidden"
+	case KindMethodNotAllowed:
+		return "Method not allowed"
+	case KindTooManyRequests:
+		return "Slow down"
+	case KindUnavailable:
+		return "Busy"
+	default:
+		return "Something went wrong"
+	}
+}
+
+// NotFound creates a not found error
+func NotFound(message string) *Error {
+	return &Error{Kind: KindNotFound, Message: message}
+}
+
+// Validation creates a validation error with optional per-field messages
+func Validation(message string, fields map[string]string) *Error {
+	return &Error{Kind: KindValidation, Message: message, Fields: fields}
+}
+
+// Conflict creates a conflict error
+func Conflict(message string) *Error {
+	return &Error{Kind: KindConflict, Message: message}
+}
+
+// Forbidden creates a forbidden error
+func Forbidden(message string) *Error {
+	return &Error{Kind: KindForbidden, Message: message}
+}
+
+// Internal wraps an unexpected error. message describes what failed.
+func Internal(err error, message string) *Error {
+	return &Error{Kind: KindInternal, Message: message, Err: err}
+}
+
+// TooManyRequests creates an error for a client that has hit a rate limit
+func TooManyRequests(message string) *Error {
+	return &Error{Kind: KindTooManyRequests, Message: message}
+}
+
+// MethodNotAllowed creates an error for a request with the wrong method
+func MethodNotAllowed() *Error {
+	return &Error{Kind: KindMethodNotAllowed, Message: "Method not allowed"}
+}
+
+// wantsJSON reports whether the client expects a JSON response rather than a page:
+// API routes and fetch requests from main.js
+func wantsJSON(r *http.Request) bool {
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		return true
+	}
+	if r.Header.Get("X-Requested-With") == "XMLHttpRequest" {
+		return true
+	}
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html")
+}
+
+// writeJSON writes v as a JSON response with the given status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error writing JSON response: %v", err)
+	}
+}
+
+// renderError writes err as an error page for browsers, or as JSON for API and fetch requests.
+// Errors that are not an *Error are treated as internal errors.
+func (h *Handler) renderError(w http.ResponseWriter, r *http.Request, err error) {
+	var e *Error
+	if !errors.As(err, &e) {
+		e = Internal(err, "Something went wrong")
+	}
+	if e.Kind == KindInternal {
+		log.Printf("%s %s: %v", r.Method, r.URL.Path, e)
+		// A database that stayed locked is a passing overload, not a bug
+		if database.IsBusy(e.Err) {
+			e = &Error{Kind: KindUnavailable, Message: "The site is busy right now. Please try again in a moment.", Err: e.Err}
+		}
+	}
+	if e.Kind == KindUnavailable {
+		w.Header().Set("Retry-After", "1")
+	}
+
+	if wantsJSON(r) {
+		response := map[string]interface{}{
+			"error": e.Message,
+		}
+		if len(e.Fields) > 0 {
+			response["fields"] = e.Fields
+		}
+		writeJSON(w, e.Status(), response)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Title":   e.Title(),
+		"Message": e.Message,
+		"Nonce":   security.Nonce(r),
+	}
+	h.Tmpl.Render(w, e.Status(), "error.html", data)
+}
+
+// renderForm re-renders a form page after a validation error, keeping the
+// user's input. API and fetch requests get the JSON error instead.
+func (h *Handler) renderForm(w http.ResponseWriter, r *http.Request, page string, data map[string]interface{}, e *Error) {
+	if wantsJSON(r) {
+		h.renderError(w, r, e)
+		return
+	}
+
+	form := make(map[string]string)
+	for key := range r.PostForm {
+		form[key] = r.PostForm.Get(key)
+	}
+	data["Form"] = form
+	data["Errors"] = e.Fields
+	data["ErrorMessage"] = e.Message
+	h.render(w, r, e.Status(), page, data)
+}
+
+// isUniqueViolation reports whether err is a SQLite UNIQUE or PRIMARY KEY constraint failure
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) &&
+		(sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique || sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey)
+}
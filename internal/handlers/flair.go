@@ -0,0 +1,329 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"hubcorner/internal/database"
+	"hubcorner/internal/models"
+)
+
+// Limits for flair
+const (
+	maxFlairs      = 30 // flair templates per community
+	maxFlairLength = 64 // characters of flair text
+)
+
+// defaultFlairColor is used when a moderator does not pick a colour
+const defaultFlairColor = "#e0e0e0"
+
+// flairColorPattern matches the #rrggbb colours used for flair
+var flairColorPattern = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// getFlairs retrieves the flair templates of a community in the order they were added
+func (h *Handler) getFlairs(communityID int) ([]models.Flair, error) {
+	rows, err := h.Reads.Query("SELECT id, community_id, text, color, mod_only FROM flair_templates WHERE community_id = ? ORDER BY id ASC", communityID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var flairs []models.Flair
+	for rows.Next() {
+		var f models.Flair
+		if err := rows.Scan(&f.ID, &f.CommunityID, &f.Text, &f.Color, &f.ModOnly); err != nil {
+			return nil, err
+		}
+		flairs = append(flairs, f)
+	}
+	return flairs, rows.Err()
+}
+
+// getFlair retrieves a single flair template by ID
+func (h *Handler) getFlair(id int) (*models.Flair, error) {
+	f := &models.Flair{}
+	err := h.Reads.QueryRow("SELECT id, community_id, text, color, mod_only FROM flair_templates WHERE id = ?", id).
+		Scan(&f.ID, &f.CommunityID, &f.Text, &f.Color, &f.ModOnly)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// getFlairChoices retrieves the flair an identity can pick for new posts,
+// grouped by community. Mod-only flair is included for the identity's own communities.
+func (h *Handler) getFlairChoices(identityID int) ([]map[string]interface{}, error) {
+	rows, err := h.Reads.Query(`
+	SELECT f.id, f.community_id, c.name, f.text, f.color, f.mod_only
+	FROM flair_templates f
+	JOIN communities c ON f.community_id = c.id
+	WHERE f.mod_only = 0
+	   OR f.community_id IN (SELECT community_id FROM community_moderators WHERE identity_id = ?)
+	ORDER BY c.name ASC, f.id ASC
+	`, identityID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var groups []map[string]interface{}
+	for rows.Next() {
+		var f models.Flair
+		var communityName string
+		if err := rows.Scan(&f.ID, &f.CommunityID, &communityName, &f.Text, &f.Color, &f.ModOnly); err != nil {
+			return nil, err
+		}
+		if len(groups) == 0 || groups[len(groups)-1]["community_id"] != f.CommunityID {
+			groups = append(groups, map[string]interface{}{
+				"community_id":   f.CommunityID,
+				"community_name": communityName,
+				"flairs":         []models.Flair{},
+			})
+		}
+		group := groups[len(groups)-1]
+		group["flairs"] = append(group["flairs"].([]models.Flair), f)
+	}
+	return groups, rows.Err()
+}
+
+// checkPostFlair returns an error if the identity may not give a post in the
+// community the flair with the given ID
+func (h *Handler) checkPostFlair(c *models.Community, identity *models.Identity, flairID int) error {
+	flair, err := h.getFlair(flairID)
+	if err == sql.ErrNoRows || err == nil && flair.CommunityID != c.ID {
+		return Validation("Please fix the errors below.", map[string]string{
+			"flair_id": fmt.Sprintf("This flair is not available in c/%s", c.Name),
+		})
+	}
+	if err != nil {
+		return Internal(err, "Failed to get flair")
+	}
+	if !flair.ModOnly {
+		return nil
+	}
+	isMod, err := h.isModerator(c.ID, identity)
+	if err != nil {
+		return Internal(err, "Failed to check moderator status")
+	}
+	if !isMod {
+		return Validation("Please fix the errors below.", map[string]string{
+			"flair_id": "Only moderators can use this flair",
+		})
+	}
+	return nil
+}
+
+// getUserFlair retrieves an identity's flair in a community, or "" if it has none
+func (h *Handler) getUserFlair(communityID, identityID int) (string, error) {
+	var text string
+	err := h.Reads.QueryRow("SELECT text FROM user_flair WHERE community_id = ? AND identity_id = ?", communityID, identityID).Scan(&text)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return text, err
+}
+
+// FlairSettings handles the flair page of the community settings, where
+// moderators list and add flair templates
+func (h *Handler) FlairSettings(w http.ResponseWriter, r *http.Request, community *models.Community) {
+	identity, err := h.currentIdentity(w, r)
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to get identity"))
+		return
+	}
+	if err := h.checkModerator(community, identity); err != nil {
+		h.renderError(w, r, err)
+		return
+	}
+
+	flairs, err := h.getFlairs(community.ID)
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to get flair"))
+		return
+	}
+
+	data := map[string]interface{}{
+		"Title":     fmt.Sprintf("c/%s flair", community.Name),
+		"Community": community,
+		"Flairs":    flairs,
+		"Form":      map[string]string{"color": defaultFlairColor},
+		"Errors":    map[string]string{},
+	}
+
+	if r.Method == http.MethodGet {
+		h.render(w, r, http.StatusOK, "community_flair.html", data)
+		return
+	}
+	if r.Method != http.MethodPost {
+		h.renderError(w, r, MethodNotAllowed())
+		return
+	}
+
+	text := strings.TrimSpace(r.FormValue("text"))
+	color := r.FormValue("color")
+	modOnly := r.FormValue("mod_only") == "true"
+	if color == "" {
+		color = defaultFlairColor
+	}
+
+	fields := make(map[string]string)
+	if text == "" {
+		fields["text"] = "Flair text is required"
+	} else if utf8.RuneCountInString(text) > maxFlairLength {
+		fields["text"] = fmt.Sprintf("Flair text can be at most %d characters long", maxFlairLength)
+	}
+	if !flairColorPattern.MatchString(color) {
+		fields["color"] = "Colour must be in the form #rrggbb"
+	}
+	if len(flairs) >= maxFlairs {
+		fields["text"] = fmt.Sprintf("A community can have at most %d flairs", maxFlairs)
+	}
+	if len(fields) > 0 {
+		h.renderForm(w, r, "community_flair.html", data, Validation("Please fix the errors below.", fields))
+		return
+	}
+
+	err = database.WriteTx(h.DB, func(tx *sql.Tx) error {
+		_, err := tx.Exec("INSERT INTO flair_templates (community_id, text, color, mod_only) VALUES (?, ?, ?, ?)",
+			community.ID, text, strings.ToLower(color), modOnly)
+		if err != nil {
+			return err
+		}
+		return logModAction(tx, identity, modLogEntry{
+			CommunityID:   community.ID,
+			CommunityName: community.Name,
+			Action:        "add-flair",
+			Target:        text,
+			Link:          "/c/" + url.PathEscape(community.Name),
+		})
+	})
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to add flair"))
+		return
+	}
+
+	http.Redirect(w, r, "/c/"+url.PathEscape(community.Name)+"/settings/flair", http.StatusSeeOther)
+}
+
+// DeleteFlair handles the POST request to delete a flair template.
+// Posts with the flair keep their place in the community without it.
+func (h *Handler) DeleteFlair(w http.ResponseWriter, r *http.Request, community *models.Community) {
+	if r.Method != http.MethodPost {
+		h.renderError(w, r, MethodNotAllowed())
+		return
+	}
+
+	identity, err := h.currentIdentity(w, r)
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to get identity"))
+		return
+	}
+	if err := h.checkModerator(community, identity); err != nil {
+		h.renderError(w, r, err)
+		return
+	}
+
+	flairID, err := strconv.Atoi(r.FormValue("flair_id"))
+	if err != nil {
+		h.renderError(w, r, Validation("Invalid flair ID", nil))
+		return
+	}
+
+	var text string
+	err = database.WriteTx(h.DB, func(tx *sql.Tx) error {
+		err := tx.QueryRow("SELECT text FROM flair_templates WHERE id = ? AND community_id = ?", flairID, community.ID).Scan(&text)
+		if err == sql.ErrNoRows {
+			return NotFound("This flair does not exist.")
+		}
+		if err != nil {
+			return err
+		}
+
+		// Posts let go of the flair first, as they refer to it
+		if _, err := tx.Exec("UPDATE posts SET flair_id = NULL WHERE flair_id = ? AND community_id = ?", flairID, community.ID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM flair_templates WHERE id = ? AND community_id = ?", flairID, community.ID); err != nil {
+			return err
+		}
+		return logModAction(tx, identity, modLogEntry{
+			CommunityID:   community.ID,
+			CommunityName: community.Name,
+			Action:        "delete-flair",
+			Target:        text,
+		})
+	})
+	if err != nil {
+		if _, ok := err.(*Error); !ok {
+			err = Internal(err, "Failed to delete flair")
+		}
+		h.renderError(w, r, err)
+		return
+	}
+	h.Cache.Invalidate(postsPrefix)
+
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"deleted": flairID})
+		return
+	}
+	http.Redirect(w, r, "/c/"+url.PathEscape(community.Name)+"/settings/flair", http.StatusSeeOther)
+}
+
+// UserFlair handles the POST request to set or clear the client's own flair
+// in a community. Only identities with a username can have flair, since it
+// is shown next to the username.
+func (h *Handler) UserFlair(w http.ResponseWriter, r *http.Request, community *models.Community) {
+	if r.Method != http.MethodPost {
+		h.renderError(w, r, MethodNotAllowed())
+		return
+	}
+
+	identity, err := h.currentIdentity(w, r)
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to get identity"))
+		return
+	}
+	if err := h.checkCanView(community, identity); err != nil {
+		h.renderError(w, r, err)
+		return
+	}
+	if identity.IsAnonymous() {
+		h.renderError(w, r, Forbidden("Choose a username on your account page before setting flair."))
+		return
+	}
+
+	text := strings.TrimSpace(r.FormValue("text"))
+	if utf8.RuneCountInString(text) > maxFlairLength {
+		h.renderError(w, r, Validation("Please fix the errors below.", map[string]string{
+			"text": fmt.Sprintf("Flair text can be at most %d characters long", maxFlairLength),
+		}))
+		return
+	}
+
+	if text == "" {
+		_, err = database.WriteExec(h.DB, "DELETE FROM user_flair WHERE community_id = ? AND identity_id = ?", community.ID, identity.ID)
+	} else {
+		_, err = database.WriteExec(h.DB, `
+		INSERT INTO user_flair (community_id, identity_id, text) VALUES (?, ?, ?)
+		ON CONFLICT (community_id, identity_id) DO UPDATE SET text = excluded.text`,
+			community.ID, identity.ID, text)
+	}
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to update flair"))
+		return
+	}
+	// Listings show the flair next to the author's posts
+	h.Cache.MarkStale(postsPrefix)
+
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"flair": text})
+		return
+	}
+	http.Redirect(w, r, "/c/"+url.PathEscape(community.Name), http.StatusSeeOther)
+}
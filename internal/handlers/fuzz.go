@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"hubcorner/internal/models"
+)
+
+// fuzzPeriod is how long a fuzzed score stays the same, so that reloading
+// a page doesn't average the noise away
+const fuzzPeriod = 5 * time.Minute
+
+// ScoreFuzzer blurs the scores shown on pages and in the JSON API by a few
+// points, so someone manipulating votes can't measure exactly which of
+// their votes count. Ranking always uses the true counts. A nil
+// ScoreFuzzer shows true scores.
+type ScoreFuzzer struct {
+	key []byte
+}
+
+// NewScoreFuzzer creates a ScoreFuzzer with a random key, so the noise
+// can't be worked out from the true counts
+func NewScoreFuzzer() *ScoreFuzzer {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		// crypto/rand only fails if the OS has no entropy source
+		panic(err)
+	}
+	return &ScoreFuzzer{key: key}
+}
+
+// Score returns the score to show for a post or comment. The noise grows
+// by a point for every 20 votes, and changes with every vote on the item,
+// so a voter can't tell whether their own vote moved the score.
+func (f *ScoreFuzzer) Score(kind string, id, upvotes, downvotes int) int {
+	score := upvotes - downvotes
+	if f == nil || upvotes+downvotes == 0 {
+		return score
+	}
+	spread := 1 + (upvotes+downvotes)/20
+
+	mac := hmac.New(sha256.New, f.key)
+	period := time.Now().Unix() / int64(fuzzPeriod/time.Second)
+	fmt.Fprintf(mac, "%s:%d:%d:%d:%d", kind, id, upvotes, downvotes, period)
+	noise := binary.BigEndian.Uint64(mac.Sum(nil)) % uint64(2*spread+1)
+	return score + int(noise) - spread
+}
+
+// Karma returns the karma to show on a user's profile, for the karma of
+// one kind ("post" or "comment"). Like Score, the noise grows with the
+// karma, a point for every 20, and changes whenever a vote moves it.
+func (f *ScoreFuzzer) Karma(kind string, identityID, karma int) int {
+	if f == nil {
+		return karma
+	}
+	magnitude := karma
+	if magnitude < 0 {
+		magnitude = -magnitude
+	}
+	spread := 1 + magnitude/20
+
+	mac := hmac.New(sha256.New, f.key)
+	period := time.Now().Unix() / int64(fuzzPeriod/time.Second)
+	fmt.Fprintf(mac, "karma:%s:%d:%d:%d", kind, identityID, karma, period)
+	noise := binary.BigEndian.Uint64(mac.Sum(nil)) % uint64(2*spread+1)
+	return karma + int(noise) - spread
+}
+
+// fuzzProfile replaces the karma of a profile with fuzzed karma, if scores
+// are fuzzed, so one vote on a user's post can't be measured on their
+// profile either. Only use it on profiles that are shown.
+func (h *Handler) fuzzProfile(profile *models.Profile) {
+	if h.Fuzzer == nil {
+		return
+	}
+	profile.PostKarma = h.Fuzzer.Karma("post", profile.ID, profile.PostKarma)
+	profile.CommentKarma = h.Fuzzer.Karma("comment", profile.ID, profile.CommentKarma)
+	profile.Karma = profile.PostKarma + profile.CommentKarma
+}
+
+// fuzzItem replaces the vote counts of a post or comment in a JSON response
+// with its fuzzed score, if scores are fuzzed
+func (h *Handler) fuzzItem(kind string, id int, item map[string]interface{}) {
+	if h.Fuzzer == nil {
+		return
+	}
+	upvotes, _ := item["upvotes"].(int)
+	downvotes, _ := item["downvotes"].(int)
+	item["score"] = h.Fuzzer.Score(kind, id, upvotes, downvotes)
+	delete(item, "upvotes")
+	delete(item, "downvotes")
+}
+
+// fuzzItems does fuzzItem for a list of posts and comments, which are
+// posts unless their type says otherwise
+func (h *Handler) fuzzItems(items []map[string]interface{}) {
+	for _, item := range items {
+		kind, ok := item["type"].(string)
+		if !ok {
+			kind = "post"
+		}
+		id, _ := item["id"].(int)
+		h.fuzzItem(kind, id, item)
+	}
+}
@@ -2,106 +2,221 @@ package handlers
 
 import (
 	"database/sql"
-	"encoding/json"
 	"fmt"
-	"html/template"
+	"log"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
-	"time"
+
+	"hubcorner/internal/cache"
+	"hubcorner/internal/database"
+	"hubcorner/internal/models"
+	"hubcorner/internal/names"
+	"hubcorner/internal/render"
+	"hubcorner/internal/security"
 )
 
 // Handler holds dependencies for handlers
 type Handler struct {
-	DB     *sql.DB
-	Tmpl   *template.Template
+	// DB takes the writes, one at a time; Reads is a pool of read-only
+	// connections to the same database
+	DB    *sql.DB
+	Reads *sql.DB
+	Tmpl  *render.Renderer
+
+	// Limits on the comments a post page shows
+	CommentDepth   int
+	CommentReplies int
+
+	// Fuzzer blurs the scores shown to clients; nil shows true scores
+	Fuzzer *ScoreFuzzer
+
+	// Cache keeps listings and the community list between requests; nil
+	// reads them from the database every time
+	Cache *cache.Cache
 }
 
 // NewHandler creates a new handler instance
-func NewHandler(db *sql.DB, tmpl *template.Template) *Handler {
+func NewHandler(db *sql.DB, tmpl *render.Renderer) *Handler {
 	return &Handler{
-		DB:   db,
-		Tmpl: tmpl,
+		DB:             db,
+		Reads:          db,
+		Tmpl:           tmpl,
+		CommentDepth:   DefaultCommentDepth,
+		CommentReplies: DefaultCommentReplies,
 	}
 }
 
+// render renders a page with the data every page shares, such as the
+// client's subscriptions for the sidebar, the site's announcements and the
+// nonce for inline scripts
+func (h *Handler) render(w http.ResponseWriter, r *http.Request, status int, page string, data map[string]interface{}) {
+	data["Nonce"] = security.Nonce(r)
+	announcements, err := h.getAnnouncements()
+	if err != nil {
+		log.Printf("Error getting announcements: %v", err)
+	}
+	data["Announcements"] = announcements
+	if _, ok := data["Subscriptions"]; !ok {
+		identity, err := h.currentIdentity(w, r)
+		if err == nil {
+			data["Subscriptions"], err = h.getSubscriptions(identity.ID)
+		}
+		if err != nil {
+			// The sidebar is not essential, so render the page without it
+			log.Printf("Error getting subscriptions: %v", err)
+		}
+	}
+
+	h.Tmpl.Render(w, status, page, data)
+}
+
 // FrontPage handles the front page of the site
 func (h *Handler) FrontPage(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path != "/" {
-		http.NotFound(w, r)
+		h.renderError(w, r, NotFound("The page you were looking for does not exist."))
 		return
 	}
 
-	// Get posts for the front page (all communities)
-	posts, err := h.getPosts(0)
+	identity, err := h.currentIdentity(w, r)
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to get identity"))
+		return
+	}
+	subscriptions, err := h.getSubscriptions(identity.ID)
 	if err != nil {
-		http.Error(w, "Failed to get posts", http.StatusInternalServerError)
+		h.renderError(w, r, Internal(err, "Failed to get subscriptions"))
 		return
 	}
 
-	// Get communities for the sidebar
-	communities, err := h.getCommunities()
+	// Get posts from subscribed communities, or from all communities
+	// until the client subscribes to one
+	var posts []map[string]interface{}
+	if len(subscriptions) > 0 {
+		posts, err = h.getFeedPosts(identity.ID)
+	} else {
+		posts, err = h.getPosts(0, identity.ID)
+	}
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to get posts"))
+		return
+	}
+
+	// Posts pinned by admins go above the feed
+	pinned, err := h.getFrontPinnedPosts(identity.ID)
 	if err != nil {
-		http.Error(w, "Failed to get communities", http.StatusInternalServerError)
+		h.renderError(w, r, Internal(err, "Failed to get pinned posts"))
 		return
 	}
+	posts = withoutPinned(posts, pinned)
 
 	data := map[string]interface{}{
-		"Title":       "HubCorner - Front Page",
-		"Posts":       posts,
-		"Communities": communities,
+		"Title":         "HubCorner - Front Page",
+		"Feed":          "home",
+		"Pinned":        pinned,
+		"Posts":         posts,
+		"Subscriptions": subscriptions,
 	}
 
-	h.Tmpl.ExecuteTemplate(w, "index.html", data)
+	h.render(w, r, http.StatusOK, "index.html", data)
 }
 
 // ListCommunities handles listing all communities
 func (h *Handler) ListCommunities(w http.ResponseWriter, r *http.Request) {
 	communities, err := h.getCommunities()
 	if err != nil {
-		http.Error(w, "Failed to get communities", http.StatusInternalServerError)
+		h.renderError(w, r, Internal(err, "Failed to get communities"))
 		return
 	}
 
+	// Quarantined communities can only be reached by their name
+	var listed []map[string]interface{}
+	for _, community := range communities {
+		if !community["quarantined"].(bool) {
+			listed = append(listed, community)
+		}
+	}
+
 	data := map[string]interface{}{
 		"Title":       "All Communities",
-		"Communities": communities,
+		"Communities": listed,
 	}
 
-	h.Tmpl.ExecuteTemplate(w, "communities.html", data)
+	h.render(w, r, http.StatusOK, "communities.html", data)
 }
 
 // NewCommunity handles the form for creating a new community
 func (h *Handler) NewCommunity(w http.ResponseWriter, r *http.Request) {
 	data := map[string]interface{}{
-		"Title": "Create New Community",
+		"Title":  "Create New Community",
+		"Form":   map[string]string{},
+		"Errors": map[string]string{},
 	}
 
-	h.Tmpl.ExecuteTemplate(w, "new_community.html", data)
+	h.render(w, r, http.StatusOK, "new_community.html", data)
 }
 
 // CreateCommunity handles the POST request to create a new community
 func (h *Handler) CreateCommunity(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		h.renderError(w, r, MethodNotAllowed())
 		return
 	}
 
-	name := r.FormValue("name")
+	name := strings.TrimSpace(r.FormValue("name"))
 	description := r.FormValue("description")
 
-	if name == "" {
-		http.Error(w, "Community name is required", http.StatusBadRequest)
+	formData := map[string]interface{}{
+		"Title": "Create New Community",
+	}
+
+	if err := names.Validate(name); err != nil {
+		h.renderForm(w, r, "new_community.html", formData, Validation("Please fix the errors below.", map[string]string{
+			"name": err.Error(),
+		}))
 		return
 	}
 
-	// Create community in database
-	_, err := h.DB.Exec("INSERT INTO communities (name, description) VALUES (?, ?)", name, description)
+	identity, err := h.currentIdentity(w, r)
 	if err != nil {
-		http.Error(w, "Failed to create community", http.StatusInternalServerError)
+		h.renderError(w, r, Internal(err, "Failed to get identity"))
+		return
+	}
+	if err := h.checkBanned(r, identity); err != nil {
+		h.renderError(w, r, err)
 		return
 	}
 
+	// Create community in database, with its creator as the first moderator and subscriber
+	err = database.WriteTx(h.DB, func(tx *sql.Tx) error {
+		result, err := tx.Exec("INSERT INTO communities (name, name_key, description) VALUES (?, ?, ?)", name, names.Key(name), description)
+		if err != nil {
+			return err
+		}
+		communityID, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("INSERT INTO community_moderators (community_id, identity_id) VALUES (?, ?)", communityID, identity.ID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("INSERT INTO subscriptions (identity_id, community_id) VALUES (?, ?)", identity.ID, communityID)
+		return err
+	})
+	if isUniqueViolation(err) {
+		e := Conflict("Please fix the errors below.")
+		e.Fields = map[string]string{"name": "A community with this name, or one that looks like it, already exists"}
+		h.renderForm(w, r, "new_community.html", formData, e)
+		return
+	}
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to create community"))
+		return
+	}
+	h.Cache.Invalidate(communitiesKey)
+
 	// Redirect to communities list
 	http.Redirect(w, r, "/communities", http.StatusSeeOther)
 }
@@ -110,45 +225,145 @@ func (h *Handler) CreateCommunity(w http.ResponseWriter, r *http.Request) {
 func (h *Handler) ViewCommunity(w http.ResponseWriter, r *http.Request) {
 	pathParts := strings.Split(r.URL.Path, "/")
 	if len(pathParts) < 3 {
-		http.NotFound(w, r)
+		h.renderError(w, r, NotFound("The page you were looking for does not exist."))
 		return
 	}
 
 	communityName := pathParts[2]
-	
+
+	// c/all and c/popular are aggregate feeds, not communities
+	if communityName == "all" || communityName == "popular" {
+		h.viewAggregate(w, r, communityName)
+		return
+	}
+
 	// Get community by name
-	var communityID int
-	var description string
-	err := h.DB.QueryRow("SELECT id, description FROM communities WHERE name = ?", communityName).Scan(&communityID, &description)
+	community, err := h.getCommunityByName(communityName)
+	if err == sql.ErrNoRows {
+		// Redirect differently-cased or lookalike names to the real community
+		var canonicalName string
+		err := h.Reads.QueryRow("SELECT name FROM communities WHERE name_key = ?", names.Key(communityName)).Scan(&canonicalName)
+		if err == nil {
+			pathParts[2] = url.PathEscape(canonicalName)
+			http.Redirect(w, r, strings.Join(pathParts, "/"), http.StatusMovedPermanently)
+			return
+		}
+		h.renderError(w, r, NotFound(fmt.Sprintf("There is no community named c/%s.", communityName)))
+		return
+	}
 	if err != nil {
-		http.NotFound(w, r)
+		h.renderError(w, r, Internal(err, "Failed to get community"))
+		return
+	}
+
+	if len(pathParts) > 3 {
+		switch strings.Join(pathParts[3:], "/") {
+		case "settings":
+			h.CommunitySettings(w, r, community)
+		case "settings/flair":
+			h.FlairSettings(w, r, community)
+		case "settings/flair/delete":
+			h.DeleteFlair(w, r, community)
+		case "flair":
+			h.UserFlair(w, r, community)
+		case "subscribe":
+			h.Subscribe(w, r, community, true)
+		case "unsubscribe":
+			h.Subscribe(w, r, community, false)
+		default:
+			h.renderError(w, r, NotFound("The page you were looking for does not exist."))
+		}
 		return
 	}
 
-	// Get posts for this community
-	posts, err := h.getPosts(communityID)
+	identity, err := h.currentIdentity(w, r)
 	if err != nil {
-		http.Error(w, "Failed to get posts", http.StatusInternalServerError)
+		h.renderError(w, r, Internal(err, "Failed to get identity"))
+		return
+	}
+	if err := h.checkCanView(community, identity); err != nil {
+		h.renderError(w, r, err)
+		return
+	}
+	isModerator, err := h.isModerator(community.ID, identity)
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to check moderator status"))
 		return
 	}
 
-	// Get all communities for the sidebar
-	communities, err := h.getCommunities()
+	isSubscribed, err := h.isSubscribed(identity.ID, community.ID)
 	if err != nil {
-		http.Error(w, "Failed to get communities", http.StatusInternalServerError)
+		h.renderError(w, r, Internal(err, "Failed to check subscription"))
+		return
+	}
+	subscribers, err := h.subscriberCount(community.ID)
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to count subscribers"))
 		return
 	}
 
-	data := map[string]interface{}{
-		"Title":           fmt.Sprintf("c/%s", communityName),
-		"CommunityID":     communityID,
-		"CommunityName":   communityName,
-		"Description":     description,
-		"Posts":           posts,
-		"Communities":     communities,
+	flairs, err := h.getFlairs(community.ID)
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to get flair"))
+		return
+	}
+	userFlair, err := h.getUserFlair(community.ID, identity.ID)
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to get flair"))
+		return
 	}
 
-	h.Tmpl.ExecuteTemplate(w, "community.html", data)
+	// Get posts for this community, optionally only those with one flair
+	var posts []map[string]interface{}
+	var flairFilter *models.Flair
+	if flairParam := r.URL.Query().Get("flair"); flairParam != "" {
+		for i := range flairs {
+			if strconv.Itoa(flairs[i].ID) == flairParam {
+				flairFilter = &flairs[i]
+			}
+		}
+		if flairFilter == nil {
+			h.renderError(w, r, NotFound(fmt.Sprintf("c/%s has no such flair.", community.Name)))
+			return
+		}
+		posts, err = h.getFlairPosts(flairFilter.ID, identity.ID)
+	} else {
+		posts, err = h.getPosts(community.ID, identity.ID)
+	}
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to get posts"))
+		return
+	}
+
+	// Pinned posts go above the sorted listing, unless filtering by flair
+	var pinned []map[string]interface{}
+	if flairFilter == nil {
+		pinned, err = h.getPinnedPosts(community.ID, identity.ID)
+		if err != nil {
+			h.renderError(w, r, Internal(err, "Failed to get pinned posts"))
+			return
+		}
+		posts = withoutPinned(posts, pinned)
+	}
+
+	data := map[string]interface{}{
+		"Title":         fmt.Sprintf("c/%s", community.Name),
+		"Community":     community,
+		"CommunityID":   community.ID,
+		"CommunityName": community.Name,
+		"Description":   community.Description,
+		"IsModerator":   isModerator,
+		"IsSubscribed":  isSubscribed,
+		"Subscribers":   subscribers,
+		"Flairs":        flairs,
+		"FlairFilter":   flairFilter,
+		"Identity":      identity,
+		"UserFlair":     userFlair,
+		"Pinned":        pinned,
+		"Posts":         posts,
+	}
+
+	h.render(w, r, http.StatusOK, "community.html", data)
 }
 
 // NewPost handles the form for creating a new post
@@ -158,53 +373,169 @@ func (h *Handler) NewPost(w http.ResponseWriter, r *http.Request) {
 	// Get all communities for the dropdown
 	communities, err := h.getCommunities()
 	if err != nil {
-		http.Error(w, "Failed to get communities", http.StatusInternalServerError)
+		h.renderError(w, r, Internal(err, "Failed to get communities"))
+		return
+	}
+
+	// Get the flair the client can pick, grouped by community
+	identity, err := h.currentIdentity(w, r)
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to get identity"))
+		return
+	}
+	flairChoices, err := h.getFlairChoices(identity.ID)
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to get flair"))
 		return
 	}
 
 	data := map[string]interface{}{
-		"Title":       "Create New Post",
-		"CommunityID": communityID,
-		"Communities": communities,
+		"Title":         "Create New Post",
+		"CommunityID":   communityID,
+		"Communities":   communities,
+		"FlairChoices":  flairChoices,
+		"PollDurations": pollDurations,
+		"Form":          map[string]string{},
+		"Errors":        map[string]string{},
 	}
 
-	h.Tmpl.ExecuteTemplate(w, "new_post.html", data)
+	h.render(w, r, http.StatusOK, "new_post.html", data)
 }
 
 // CreatePost handles the POST request to create a new post
 func (h *Handler) CreatePost(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		h.renderError(w, r, MethodNotAllowed())
 		return
 	}
 
 	title := r.FormValue("title")
 	content := r.FormValue("content")
+	link := strings.TrimSpace(r.FormValue("url"))
 	communityIDStr := r.FormValue("community_id")
+	flairIDStr := r.FormValue("flair_id")
 
-	if title == "" {
-		http.Error(w, "Post title is required", http.StatusBadRequest)
+	identity, err := h.currentIdentity(w, r)
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to get identity"))
 		return
 	}
 
+	// renderPostForm re-renders the form with the user's input after an error
+	renderPostForm := func(e *Error) {
+		communities, err := h.getCommunities()
+		if err != nil {
+			h.renderError(w, r, Internal(err, "Failed to get communities"))
+			return
+		}
+		flairChoices, err := h.getFlairChoices(identity.ID)
+		if err != nil {
+			h.renderError(w, r, Internal(err, "Failed to get flair"))
+			return
+		}
+		data := map[string]interface{}{
+			"Title":         "Create New Post",
+			"CommunityID":   communityIDStr,
+			"Communities":   communities,
+			"FlairChoices":  flairChoices,
+			"PollDurations": pollDurations,
+		}
+		h.renderForm(w, r, "new_post.html", data, e)
+	}
+
+	fields := make(map[string]string)
+	if title == "" {
+		fields["title"] = "Post title is required"
+	}
+	if link != "" && !validURL(link) {
+		fields["url"] = "Link must be an http or https URL"
+	}
+	poll := parsePollForm(r, fields)
+	if poll != nil && link != "" {
+		fields["poll_options"] = "A poll post cannot also be a link post"
+	}
+
+	var community *models.Community
 	communityID, err := strconv.Atoi(communityIDStr)
 	if err != nil {
-		http.Error(w, "Invalid community ID", http.StatusBadRequest)
+		fields["community_id"] = "Please select a community"
+	} else if community, err = h.getCommunityByID(communityID); err == sql.ErrNoRows {
+		fields["community_id"] = "This community does not exist"
+	} else if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to get community"))
 		return
 	}
 
-	// Create post in database
-	result, err := h.DB.Exec("INSERT INTO posts (title, content, community_id) VALUES (?, ?, ?)", title, content, communityID)
-	if err != nil {
-		http.Error(w, "Failed to create post", http.StatusInternalServerError)
+	if len(fields) > 0 {
+		renderPostForm(Validation("Please fix the errors below.", fields))
 		return
 	}
 
-	postID, err := result.LastInsertId()
+	// Enforce the community's posting restrictions
+	if err := h.checkCanPost(community, identity, link); err != nil {
+		if e, ok := err.(*Error); ok && e.Kind != KindInternal {
+			renderPostForm(e)
+			return
+		}
+		h.renderError(w, r, err)
+		return
+	}
+	if err := h.checkBanned(r, identity); err != nil {
+		h.renderError(w, r, err)
+		return
+	}
+	if err := h.checkRateLimit(postRateLimit, identity); err != nil {
+		h.renderError(w, r, err)
+		return
+	}
+
+	// Check the flair, if one was picked, belongs to the community
+	var flairID *int
+	if flairIDStr != "" {
+		id, err := strconv.Atoi(flairIDStr)
+		if err == nil {
+			err = h.checkPostFlair(community, identity, id)
+		} else {
+			err = Validation("Please fix the errors below.", map[string]string{"flair_id": "Invalid flair"})
+		}
+		if e, ok := err.(*Error); ok && e.Kind != KindInternal {
+			renderPostForm(e)
+			return
+		}
+		if err != nil {
+			h.renderError(w, r, err)
+			return
+		}
+		flairID = &id
+	}
+
+	// Create post in database, together with its poll
+	var postID int64
+	err = database.WriteTx(h.DB, func(tx *sql.Tx) error {
+		result, err := tx.Exec("INSERT INTO posts (title, content, url, community_id, flair_id, author_id) VALUES (?, ?, ?, ?, ?, ?)",
+			title, content, link, communityID, flairID, identity.ID)
+		if err != nil {
+			return err
+		}
+		postID, err = result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("UPDATE communities SET post_count = post_count + 1 WHERE id = ?", communityID)
+		if err != nil {
+			return err
+		}
+		if poll != nil {
+			return createPoll(tx, postID, poll)
+		}
+		return nil
+	})
 	if err != nil {
-		http.Error(w, "Failed to get post ID", http.StatusInternalServerError)
+		h.renderError(w, r, Internal(err, "Failed to create post"))
 		return
 	}
+	h.Cache.Invalidate(postsPrefix)
+	h.Cache.Invalidate(communitiesKey)
 
 	// Redirect to view the new post
 	http.Redirect(w, r, fmt.Sprintf("/posts/%d", postID), http.StatusSeeOther)
@@ -214,65 +545,194 @@ func (h *Handler) CreatePost(w http.ResponseWriter, r *http.Request) {
 func (h *Handler) ViewPost(w http.ResponseWriter, r *http.Request) {
 	pathParts := strings.Split(r.URL.Path, "/")
 	if len(pathParts) < 3 {
-		http.NotFound(w, r)
+		h.renderError(w, r, NotFound("The page you were looking for does not exist."))
 		return
 	}
 
 	postIDStr := pathParts[2]
 	postID, err := strconv.Atoi(postIDStr)
 	if err != nil {
-		http.NotFound(w, r)
+		h.renderError(w, r, NotFound("The page you were looking for does not exist."))
 		return
 	}
 
+	// Comment permalinks: /posts/{id}/comment/{comment_id}
+	if len(pathParts) == 5 && pathParts[3] == "comment" {
+		commentID, err := strconv.Atoi(pathParts[4])
+		if err != nil {
+			h.renderError(w, r, NotFound("The page you were looking for does not exist."))
+			return
+		}
+		h.renderPost(w, r, postID, commentID, http.StatusOK, nil)
+		return
+	}
+
+	if len(pathParts) > 3 {
+		switch strings.Join(pathParts[3:], "/") {
+		case "crosspost":
+			h.Crosspost(w, r, postID)
+		case "pin", "unpin", "frontpin", "frontunpin", "lock", "unlock":
+			h.ModeratePost(w, r, postID, pathParts[3])
+		default:
+			h.renderError(w, r, NotFound("The page you were looking for does not exist."))
+		}
+		return
+	}
+
+	h.renderPost(w, r, postID, 0, http.StatusOK, nil)
+}
+
+// renderPost renders a post page. If commentID is set, only that comment's
+// thread is shown, as on a comment permalink. formErr, if set, is a
+// validation error for the comment form, which is shown with the user's
+// input kept.
+func (h *Handler) renderPost(w http.ResponseWriter, r *http.Request, postID, commentID int, status int, formErr *Error) {
 	// Get post details
 	post, err := h.getPost(postID)
+	if err == sql.ErrNoRows {
+		h.renderError(w, r, NotFound("This post does not exist or has been removed."))
+		return
+	}
 	if err != nil {
-		http.NotFound(w, r)
+		h.renderError(w, r, Internal(err, "Failed to get post"))
+		return
+	}
+
+	// Check the post's community is visible to the client
+	community, err := h.getCommunityByID(post["community_id"].(int))
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to get community"))
+		return
+	}
+	identity, err := h.currentIdentity(w, r)
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to get identity"))
+		return
+	}
+	if err := h.checkCanView(community, identity); err != nil {
+		h.renderError(w, r, err)
 		return
 	}
 
 	// Get comments for this post
-	comments, err := h.getComments(postID)
+	commentSort := parseCommentSort(r)
+	comments, err := h.getComments(postID, commentSort)
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to get comments"))
+		return
+	}
+
+	// A permalink shows one comment's thread, with as many of its parents as
+	// asked for. Otherwise top-level comments are shown a page at a time.
+	context := 0
+	moreContext := false
+	limit := parseCommentLimit(r)
+	moreComments := 0
+	if commentID != 0 {
+		context = parseCommentContext(r)
+		comments, moreContext = commentThread(comments, commentID, context)
+		if comments == nil {
+			h.renderError(w, r, NotFound("This comment does not exist or has been removed."))
+			return
+		}
+	} else if len(comments) > limit {
+		moreComments = len(comments) - limit
+		comments = comments[:limit]
+	}
+	h.limitComments(comments, commentID)
+
+	// Get user's votes on this post and its comments
+	postVotes, commentVotes, err := h.getUserVotes(identity.ClientID, postID)
 	if err != nil {
-		http.Error(w, "Failed to get comments", http.StatusInternalServerError)
+		h.renderError(w, r, Internal(err, "Failed to get user votes"))
 		return
 	}
 
-	// Get all communities for the sidebar
-	communities, err := h.getCommunities()
+	// Get the saved and hidden state of this post and its comments
+	postSaved, savedComments, err := h.getUserMarks("saved_items", identity.ID, postID)
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to get saved comments"))
+		return
+	}
+	postHidden, hiddenComments, err := h.getUserMarks("hidden_items", identity.ID, postID)
 	if err != nil {
-		http.Error(w, "Failed to get communities", http.StatusInternalServerError)
+		h.renderError(w, r, Internal(err, "Failed to get hidden comments"))
 		return
 	}
+	post["saved"] = postSaved
+	post["hidden"] = postHidden
 
-	// Get client ID for voting
-	clientID := h.getClientID(r)
+	poll, err := h.getPoll(postID, identity.ID)
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to get poll"))
+		return
+	}
 
-	// Get user's votes on this post and its comments
-	postVotes, commentVotes, err := h.getUserVotes(clientID, postID)
+	canModerate, err := h.canModerate(community.ID, identity)
 	if err != nil {
-		http.Error(w, "Failed to get user votes", http.StatusInternalServerError)
+		h.renderError(w, r, Internal(err, "Failed to check moderator status"))
 		return
 	}
 
-	data := map[string]interface{}{
-		"Title":         post["title"].(string),
-		"Post":          post,
-		"Comments":      comments,
-		"Communities":   communities,
-		"ClientID":      clientID,
-		"PostVotes":     postVotes,
-		"CommentVotes":  commentVotes,
+	// Show the original of a crosspost, or where an original has been crossposted
+	var crosspostParent map[string]interface{}
+	var crossposts []map[string]interface{}
+	if parentID := post["crosspost_parent_id"].(int); parentID != 0 {
+		crosspostParent, err = h.getPost(parentID)
+		if err == nil {
+			// Leave the original out if it has become hidden from the client
+			if e := h.checkCanViewPost(parentID, identity); e != nil {
+				crosspostParent = nil
+			}
+		} else if err != sql.ErrNoRows {
+			h.renderError(w, r, Internal(err, "Failed to get original post"))
+			return
+		}
+	} else {
+		crossposts, err = h.getCrossposts(postID)
+		if err != nil {
+			h.renderError(w, r, Internal(err, "Failed to get crossposts"))
+			return
+		}
 	}
 
-	h.Tmpl.ExecuteTemplate(w, "post.html", data)
+	data := map[string]interface{}{
+		"Title":           post["title"].(string),
+		"Post":            post,
+		"Poll":            poll,
+		"CrosspostParent": crosspostParent,
+		"Crossposts":      crossposts,
+		"CanModerate":     canModerate,
+		"Community":       community,
+		"Identity":        identity,
+		"Comments":        comments,
+		"CommentSort":     commentSort,
+		"CommentSorts":    commentSorts,
+		"CommentID":       commentID,
+		"MoreContext":     moreContext,
+		"ParentContext":   context + 1,
+		"MoreComments":    moreComments,
+		"NextLimit":       limit + commentsPerPage,
+		"ClientID":        identity.ClientID,
+		"PostVotes":       postVotes,
+		"CommentVotes":    commentVotes,
+		"SavedComments":   savedComments,
+		"HiddenComments":  hiddenComments,
+		"Form":            map[string]string{},
+		"Errors":          map[string]string{},
+	}
+
+	if formErr != nil {
+		h.renderForm(w, r, "post.html", data, formErr)
+		return
+	}
+	h.render(w, r, status, "post.html", data)
 }
 
 // CreateComment handles the POST request to create a new comment
 func (h *Handler) CreateComment(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		h.renderError(w, r, MethodNotAllowed())
 		return
 	}
 
@@ -280,132 +740,187 @@ func (h *Handler) CreateComment(w http.ResponseWriter, r *http.Request) {
 	postIDStr := r.FormValue("post_id")
 	parentIDStr := r.FormValue("parent_id")
 
-	if content == "" {
-		http.Error(w, "Comment content is required", http.StatusBadRequest)
+	postID, err := strconv.Atoi(postIDStr)
+	if err != nil {
+		h.renderError(w, r, Validation("Invalid post ID", nil))
 		return
 	}
 
-	postID, err := strconv.Atoi(postIDStr)
+	// Only those who can see the post can comment on it
+	identity, err := h.currentIdentity(w, r)
 	if err != nil {
-		http.Error(w, "Invalid post ID", http.StatusBadRequest)
+		h.renderError(w, r, Internal(err, "Failed to get identity"))
+		return
+	}
+	if err := h.checkCanViewPost(postID, identity); err != nil {
+		h.renderError(w, r, err)
+		return
+	}
+
+	if content == "" {
+		h.renderPost(w, r, postID, 0, http.StatusBadRequest, Validation("Please fix the errors below.", map[string]string{
+			"content": "Comment content is required",
+		}))
 		return
 	}
 
+	// A reply must be to a comment on the same post
 	var parentID *int
 	if parentIDStr != "" {
 		parentIDInt, err := strconv.Atoi(parentIDStr)
-		if err == nil {
-			parentID = &parentIDInt
+		if err != nil {
+			h.renderError(w, r, Validation("Invalid parent comment ID", nil))
+			return
+		}
+		var parentPostID int
+		err = h.Reads.QueryRow("SELECT post_id FROM comments WHERE id = ?", parentIDInt).Scan(&parentPostID)
+		if err == sql.ErrNoRows || err == nil && parentPostID != postID {
+			h.renderError(w, r, Validation("The comment you are replying to does not exist on this post.", nil))
+			return
+		}
+		if err != nil {
+			h.renderError(w, r, Internal(err, "Failed to get parent comment"))
+			return
 		}
+		parentID = &parentIDInt
 	}
 
-	// Create comment in database
-	_, err = h.DB.Exec("INSERT INTO comments (content, post_id, parent_id) VALUES (?, ?, ?)", content, postID, parentID)
+	// Locked posts, and the posts of locked communities, stay readable but
+	// take no new comments
+	var locked, communityLocked bool
+	var communityName string
+	err = h.Reads.QueryRow("SELECT p.locked, c.locked, c.name FROM posts p JOIN communities c ON p.community_id = c.id WHERE p.id = ?", postID).
+		Scan(&locked, &communityLocked, &communityName)
+	if err == sql.ErrNoRows {
+		h.renderError(w, r, NotFound("This post does not exist or has been removed."))
+		return
+	}
 	if err != nil {
-		http.Error(w, "Failed to create comment", http.StatusInternalServerError)
+		h.renderError(w, r, Internal(err, "Failed to get post"))
 		return
 	}
-
-	// Redirect back to the post
-	http.Redirect(w, r, fmt.Sprintf("/posts/%d", postID), http.StatusSeeOther)
-}
-
-// VotePost handles voting on a post
-func (h *Handler) VotePost(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	if communityLocked {
+		h.renderError(w, r, Forbidden(fmt.Sprintf("c/%s is locked. New comments are not allowed.", communityName)))
 		return
 	}
-
-	postIDStr := r.FormValue("post_id")
-	voteTypeStr := r.FormValue("vote_type")
-	
-	postID, err := strconv.Atoi(postIDStr)
-	if err != nil {
-		http.Error(w, "Invalid post ID", http.StatusBadRequest)
+	if locked {
+		h.renderError(w, r, Forbidden("This post is locked. New comments are not allowed."))
 		return
 	}
 
-	voteType, err := strconv.Atoi(voteTypeStr)
-	if err != nil || (voteType != 1 && voteType != -1) {
-		http.Error(w, "Invalid vote type", http.StatusBadRequest)
+	if err := h.checkBanned(r, identity); err != nil {
+		h.renderError(w, r, err)
 		return
 	}
-
-	// Get client ID
-	clientID := h.getClientID(r)
-
-	// Process the vote
-	err = h.processVote("post", postID, clientID, voteType)
-	if err != nil {
-		http.Error(w, "Failed to process vote", http.StatusInternalServerError)
+	if err := h.checkRateLimit(commentRateLimit, identity); err != nil {
+		h.renderError(w, r, err)
 		return
 	}
 
-	// Return updated vote count
-	var upvotes, downvotes int
-	err = h.DB.QueryRow("SELECT upvotes, downvotes FROM posts WHERE id = ?", postID).Scan(&upvotes, &downvotes)
+	// Create comment in database, and count it in its post
+	var commentID int64
+	err = database.WriteTx(h.DB, func(tx *sql.Tx) error {
+		result, err := tx.Exec("INSERT INTO comments (content, post_id, parent_id, author_id) VALUES (?, ?, ?, ?)", content, postID, parentID, identity.ID)
+		if err != nil {
+			return err
+		}
+		commentID, err = result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("UPDATE posts SET comment_count = comment_count + 1 WHERE id = ?", postID)
+		return err
+	})
 	if err != nil {
-		http.Error(w, "Failed to get updated vote count", http.StatusInternalServerError)
+		h.renderError(w, r, Internal(err, "Failed to create comment"))
 		return
 	}
+	// Listings show comment counts, which can catch up a little later
+	h.Cache.MarkStale(postsPrefix)
 
-	response := map[string]interface{}{
-		"upvotes":   upvotes,
-		"downvotes": downvotes,
-		"score":     upvotes - downvotes,
+	// Redirect back to the post, or for a reply to the thread it is in, so
+	// the reply is shown however deep it is
+	if parentID != nil {
+		http.Redirect(w, r, fmt.Sprintf("/posts/%d/comment/%d#comment-%d", postID, *parentID, commentID), http.StatusSeeOther)
+		return
 	}
+	http.Redirect(w, r, fmt.Sprintf("/posts/%d#comment-%d", postID, commentID), http.StatusSeeOther)
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+// VotePost handles voting on a post
+func (h *Handler) VotePost(w http.ResponseWriter, r *http.Request) {
+	h.vote(w, r, "post")
 }
 
 // VoteComment handles voting on a comment
 func (h *Handler) VoteComment(w http.ResponseWriter, r *http.Request) {
+	h.vote(w, r, "comment")
+}
+
+// vote handles the POST request that votes on a post or comment, with the
+// item in post_id or comment_id and vote_type 1 or -1. Voting the same way
+// again takes the vote back, as does vote_type 0. It responds with the
+// item's new score and the client's vote.
+func (h *Handler) vote(w http.ResponseWriter, r *http.Request, itemType string) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		h.renderError(w, r, MethodNotAllowed())
 		return
 	}
 
-	commentIDStr := r.FormValue("comment_id")
-	voteTypeStr := r.FormValue("vote_type")
-	
-	commentID, err := strconv.Atoi(commentIDStr)
+	itemID, err := strconv.Atoi(r.FormValue(itemType + "_id"))
 	if err != nil {
-		http.Error(w, "Invalid comment ID", http.StatusBadRequest)
+		h.renderError(w, r, Validation("Invalid "+itemType+" ID", nil))
 		return
 	}
 
-	voteType, err := strconv.Atoi(voteTypeStr)
-	if err != nil || (voteType != 1 && voteType != -1) {
-		http.Error(w, "Invalid vote type", http.StatusBadRequest)
+	voteType, err := strconv.Atoi(r.FormValue("vote_type"))
+	if err != nil || voteType < -1 || voteType > 1 {
+		h.renderError(w, r, Validation("Invalid vote type", nil))
 		return
 	}
 
-	// Get client ID
-	clientID := h.getClientID(r)
-
-	// Process the vote
-	err = h.processVote("comment", commentID, clientID, voteType)
+	identity, err := h.currentIdentity(w, r)
 	if err != nil {
-		http.Error(w, "Failed to process vote", http.StatusInternalServerError)
+		h.renderError(w, r, Internal(err, "Failed to get identity"))
+		return
+	}
+	if err := h.checkCanViewItem(itemType, itemID, identity); err != nil {
+		h.renderError(w, r, err)
+		return
+	}
+	if err := h.checkBanned(r, identity); err != nil {
+		h.renderError(w, r, err)
 		return
 	}
 
-	// Return updated vote count
-	var upvotes, downvotes int
-	err = h.DB.QueryRow("SELECT upvotes, downvotes FROM comments WHERE id = ?", commentID).Scan(&upvotes, &downvotes)
+	result, err := database.CastVote(h.DB, database.Ballot{
+		ItemType: itemType,
+		ItemID:   itemID,
+		ClientID: identity.ClientID,
+		IPRange:  clientIPRange(r),
+		Vote:     voteType,
+		Toggle:   true,
+	})
+	if err == sql.ErrNoRows {
+		h.renderError(w, r, NotFound("This "+itemType+" does not exist or has been removed."))
+		return
+	}
 	if err != nil {
-		http.Error(w, "Failed to get updated vote count", http.StatusInternalServerError)
+		h.renderError(w, r, Internal(err, "Failed to process vote"))
 		return
 	}
+	// Listings are ranked by score, but can catch up with votes a little later
+	if itemType == "post" {
+		h.Cache.MarkStale(postsPrefix)
+	}
 
 	response := map[string]interface{}{
-		"upvotes":   upvotes,
-		"downvotes": downvotes,
-		"score":     upvotes - downvotes,
+		"upvotes":   result.Upvotes,
+		"downvotes": result.Downvotes,
+		"score":     result.Score(),
+		"vote":      result.Vote,
 	}
+	h.fuzzItem(itemType, itemID, response)
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	writeJSON(w, http.StatusOK, response)
 }
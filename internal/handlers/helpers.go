@@ -2,18 +2,38 @@ package handlers
 
 import (
 	"database/sql"
-	"net/http"
-	"strconv"
-	"time"
+	"fmt"
+
+	"hubcorner/internal/models"
 )
 
 // Helper methods for handlers
 
-// getCommunities retrieves all communities from the database
+// Cache keys, and the prefix of every cached listing. Writes that change
+// listings invalidate postsPrefix, or mark it stale if the change can show
+// up a little later, such as a new vote.
+const (
+	communitiesKey   = "communities"
+	announcementsKey = "announcements"
+	postsPrefix      = "posts:"
+)
+
+// getCommunities retrieves all communities, through the cache. The result
+// is shared and must not be modified.
 func (h *Handler) getCommunities() ([]map[string]interface{}, error) {
-	rows, err := h.DB.Query(`
-	SELECT id, name, description, created_at,
-	       (SELECT COUNT(*) FROM posts WHERE community_id = communities.id) as post_count
+	v, err := h.Cache.Get(communitiesKey, func() (interface{}, error) {
+		return h.queryCommunities()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]map[string]interface{}), nil
+}
+
+// queryCommunities retrieves all communities from the database
+func (h *Handler) queryCommunities() ([]map[string]interface{}, error) {
+	rows, err := h.Reads.Query(`
+	SELECT id, name, description, created_at, post_count, locked, quarantined
 	FROM communities
 	ORDER BY name ASC
 	`)
@@ -28,7 +48,8 @@ func (h *Handler) getCommunities() ([]map[string]interface{}, error) {
 		var name, description string
 		var createdAt string
 		var postCount int
-		if err := rows.Scan(&id, &name, &description, &createdAt, &postCount); err != nil {
+		var locked, quarantined bool
+		if err := rows.Scan(&id, &name, &description, &createdAt, &postCount, &locked, &quarantined); err != nil {
 			return nil, err
 		}
 		communities = append(communities, map[string]interface{}{
@@ -37,39 +58,178 @@ func (h *Handler) getCommunities() ([]map[string]interface{}, error) {
 			"description": description,
 			"created_at":  createdAt,
 			"post_count":  postCount,
+			"locked":      locked,
+			"quarantined": quarantined,
 		})
 	}
 	return communities, nil
 }
 
-// getPosts retrieves posts with optional filtering by community
-func (h *Handler) getPosts(communityID int) ([]map[string]interface{}, error) {
-	var query string
-	var args []interface{}
+// sitewideCondition selects the posts of the communities that site-wide
+// listings show: not private or quarantined ones
+const sitewideCondition = "c.type != 'private' AND c.quarantined = 0"
 
+// getPosts retrieves posts with optional filtering by community, as seen by
+// an identity. Without a community, posts from private and quarantined
+// communities are left out.
+func (h *Handler) getPosts(communityID, identityID int) ([]map[string]interface{}, error) {
 	if communityID > 0 {
-		query = `
-		SELECT p.id, p.title, p.content, p.community_id, p.created_at, p.upvotes, p.downvotes, 
-		       c.name as community_name,
-		       (SELECT COUNT(*) FROM comments WHERE post_id = p.id) as comment_count
-		FROM posts p
-		JOIN communities c ON p.community_id = c.id
-		WHERE p.community_id = ?
-		ORDER BY (p.upvotes - p.downvotes) DESC, p.created_at DESC
-		`
-		args = append(args, communityID)
-	} else {
-		query = `
-		SELECT p.id, p.title, p.content, p.community_id, p.created_at, p.upvotes, p.downvotes, 
-		       c.name as community_name,
-		       (SELECT COUNT(*) FROM comments WHERE post_id = p.id) as comment_count
+		return h.cachedPosts(fmt.Sprintf("%scommunity:%d", postsPrefix, communityID), identityID, "p.community_id = ?", communityID)
+	}
+	return h.cachedPosts(postsPrefix+"all", identityID, sitewideCondition)
+}
+
+// getFeedPosts retrieves posts from the communities an identity subscribes to.
+// Private communities are included only for their moderators.
+func (h *Handler) getFeedPosts(identityID int) ([]map[string]interface{}, error) {
+	return h.queryPosts(identityID, `
+		p.community_id IN (SELECT community_id FROM subscriptions WHERE identity_id = ?)
+		AND (c.type != 'private' OR p.community_id IN (SELECT community_id FROM community_moderators WHERE identity_id = ?))`,
+		identityID, identityID)
+}
+
+// getPopularPosts retrieves the highest scoring posts of the last week
+func (h *Handler) getPopularPosts(identityID int) ([]map[string]interface{}, error) {
+	return h.cachedPosts(postsPrefix+"popular", identityID, sitewideCondition+" AND p.created_at >= datetime('now', '-7 days')")
+}
+
+// getPinnedPosts retrieves the posts pinned in a community
+func (h *Handler) getPinnedPosts(communityID, identityID int) ([]map[string]interface{}, error) {
+	return h.cachedPosts(fmt.Sprintf("%spinned:%d", postsPrefix, communityID), identityID, "p.community_id = ? AND p.pinned_at IS NOT NULL", communityID)
+}
+
+// getFrontPinnedPosts retrieves the posts admins have pinned on the front page
+func (h *Handler) getFrontPinnedPosts(identityID int) ([]map[string]interface{}, error) {
+	return h.cachedPosts(postsPrefix+"front-pinned", identityID, "p.front_pinned_at IS NOT NULL AND "+sitewideCondition)
+}
+
+// withoutPinned marks pinned posts as pinned for the listing they are shown
+// above, and removes them from posts so they are not listed twice
+func withoutPinned(posts, pinned []map[string]interface{}) []map[string]interface{} {
+	pinnedIDs := make(map[int]bool, len(pinned))
+	for _, post := range pinned {
+		post["pinned"] = true
+		pinnedIDs[post["id"].(int)] = true
+	}
+	var rest []map[string]interface{}
+	for _, post := range posts {
+		if !pinnedIDs[post["id"].(int)] {
+			rest = append(rest, post)
+		}
+	}
+	return rest
+}
+
+// getFlairPosts retrieves the posts of a community that have a flair
+func (h *Handler) getFlairPosts(flairID, identityID int) ([]map[string]interface{}, error) {
+	return h.cachedPosts(fmt.Sprintf("%sflair:%d", postsPrefix, flairID), identityID, "p.flair_id = ?", flairID)
+}
+
+// cachedPosts retrieves the posts matching a condition, as queryPosts does,
+// through the cache. The posts are cached as a client with nothing saved or
+// hidden sees them, and the identity's saved and hidden posts are applied
+// to a copy.
+func (h *Handler) cachedPosts(key string, identityID int, condition string, args ...interface{}) ([]map[string]interface{}, error) {
+	if h.Cache == nil {
+		return h.queryPosts(identityID, condition, args...)
+	}
+	v, err := h.Cache.Get(key, func() (interface{}, error) {
+		return h.queryPosts(0, condition, args...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	saved, hidden, err := h.getMarkedPosts(identityID)
+	if err != nil {
+		return nil, err
+	}
+
+	var posts []map[string]interface{}
+	for _, cached := range v.([]map[string]interface{}) {
+		id := cached["id"].(int)
+		if hidden[id] {
+			continue
+		}
+		post := make(map[string]interface{}, len(cached))
+		for k, v := range cached {
+			post[k] = v
+		}
+		post["saved"] = saved[id]
+		posts = append(posts, post)
+	}
+	return posts, nil
+}
+
+// getMarkedPosts retrieves the IDs of the posts an identity has saved and hidden
+func (h *Handler) getMarkedPosts(identityID int) (saved, hidden map[int]bool, err error) {
+	rows, err := h.Reads.Query(`
+	SELECT 'saved', item_id FROM saved_items WHERE identity_id = ? AND item_type = 'post'
+	UNION ALL
+	SELECT 'hidden', item_id FROM hidden_items WHERE identity_id = ? AND item_type = 'post'`, identityID, identityID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	saved, hidden = make(map[int]bool), make(map[int]bool)
+	for rows.Next() {
+		var mark string
+		var id int
+		if err := rows.Scan(&mark, &id); err != nil {
+			return nil, nil, err
+		}
+		if mark == "saved" {
+			saved[id] = true
+		} else {
+			hidden[id] = true
+		}
+	}
+	return saved, hidden, rows.Err()
+}
+
+// queryPosts retrieves the posts matching a condition, highest score first.
+// Posts the identity has hidden are left out, and saved posts are marked.
+func (h *Handler) queryPosts(identityID int, condition string, args ...interface{}) ([]map[string]interface{}, error) {
+	return h.selectPosts(identityID, condition, "(p.upvotes - p.downvotes) DESC, p.created_at DESC", args...)
+}
+
+// queryPostPage retrieves one page of the posts matching a condition, newest
+// first, and whether there are more pages
+func (h *Handler) queryPostPage(identityID int, condition string, page int, args ...interface{}) ([]map[string]interface{}, bool, error) {
+	args = append(args, perPage+1, (page-1)*perPage)
+	posts, err := h.selectPosts(identityID, condition, "p.created_at DESC, p.id DESC LIMIT ? OFFSET ?", args...)
+	if err != nil {
+		return nil, false, err
+	}
+	hasMore := len(posts) > perPage
+	if hasMore {
+		posts = posts[:perPage]
+	}
+	return posts, hasMore, nil
+}
+
+// selectPosts retrieves the posts matching a condition in the given order,
+// as seen by an identity. The order can end with a LIMIT clause.
+func (h *Handler) selectPosts(identityID int, condition, order string, args ...interface{}) ([]map[string]interface{}, error) {
+	query := `
+		SELECT p.id, p.title, p.content, p.url, p.community_id, p.created_at, p.upvotes, p.downvotes, 
+		       c.name as community_name, f.id, f.text, f.color, a.username, uf.text,
+		       p.crosspost_parent_id, oc.name as crosspost_community, p.locked, p.comment_count,
+		       EXISTS (SELECT 1 FROM polls WHERE post_id = p.id) as is_poll,
+		       EXISTS (SELECT 1 FROM saved_items WHERE identity_id = ? AND item_type = 'post' AND item_id = p.id) as saved
 		FROM posts p
 		JOIN communities c ON p.community_id = c.id
-		ORDER BY (p.upvotes - p.downvotes) DESC, p.created_at DESC
-		`
-	}
+		LEFT JOIN flair_templates f ON p.flair_id = f.id
+		LEFT JOIN identities a ON p.author_id = a.id
+		LEFT JOIN user_flair uf ON uf.community_id = p.community_id AND uf.identity_id = p.author_id
+		LEFT JOIN posts op ON p.crosspost_parent_id = op.id
+		LEFT JOIN communities oc ON op.community_id = oc.id
+		WHERE p.id NOT IN (SELECT item_id FROM hidden_items WHERE identity_id = ? AND item_type = 'post')
+		  AND (` + condition + `)
+		ORDER BY ` + order
+	args = append([]interface{}{identityID, identityID}, args...)
 
-	rows, err := h.DB.Query(query, args...)
+	rows, err := h.Reads.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -78,21 +238,37 @@ func (h *Handler) getPosts(communityID int) ([]map[string]interface{}, error) {
 	var posts []map[string]interface{}
 	for rows.Next() {
 		var id, communityID, upvotes, downvotes, commentCount int
-		var title, content, createdAt, communityName string
-		if err := rows.Scan(&id, &title, &content, &communityID, &createdAt, &upvotes, &downvotes, &communityName, &commentCount); err != nil {
+		var title, content, url, createdAt, communityName string
+		var locked, isPoll, saved bool
+		var flairID, crosspostParentID sql.NullInt64
+		var flairText, flairColor, author, authorFlair, crosspostCommunity sql.NullString
+		if err := rows.Scan(&id, &title, &content, &url, &communityID, &createdAt, &upvotes, &downvotes, &communityName,
+			&flairID, &flairText, &flairColor, &author, &authorFlair, &crosspostParentID, &crosspostCommunity, &locked,
+			&commentCount, &isPoll, &saved); err != nil {
 			return nil, err
 		}
 		posts = append(posts, map[string]interface{}{
-			"id":             id,
-			"title":          title,
-			"content":        content,
-			"community_id":   communityID,
-			"community_name": communityName,
-			"created_at":     createdAt,
-			"upvotes":        upvotes,
-			"downvotes":      downvotes,
-			"score":          upvotes - downvotes,
-			"comment_count":  commentCount,
+			"id":                  id,
+			"title":               title,
+			"content":             content,
+			"url":                 url,
+			"community_id":        communityID,
+			"community_name":      communityName,
+			"flair_id":            int(flairID.Int64),
+			"flair_text":          flairText.String,
+			"flair_color":         flairColor.String,
+			"author":              author.String,
+			"author_flair":        authorFlair.String,
+			"created_at":          createdAt,
+			"upvotes":             upvotes,
+			"downvotes":           downvotes,
+			"score":               upvotes - downvotes,
+			"comment_count":       commentCount,
+			"crosspost_parent_id": int(crosspostParentID.Int64),
+			"crosspost_community": crosspostCommunity.String,
+			"locked":              locked,
+			"is_poll":             isPoll,
+			"saved":               saved,
 		})
 	}
 	return posts, nil
@@ -100,105 +276,121 @@ func (h *Handler) getPosts(communityID int) ([]map[string]interface{}, error) {
 
 // getPost retrieves a single post by ID
 func (h *Handler) getPost(id int) (map[string]interface{}, error) {
-	var title, content, createdAt, communityName string
+	var title, content, url, createdAt, communityName string
 	var communityID, upvotes, downvotes int
-	err := h.DB.QueryRow(`
-	SELECT p.title, p.content, p.created_at, p.community_id, p.upvotes, p.downvotes, c.name as community_name
+	var flairID, crosspostParentID sql.NullInt64
+	var flairText, flairColor, author, authorFlair, crosspostCommunity sql.NullString
+	var pinned, frontPinned, locked bool
+	err := h.Reads.QueryRow(`
+	SELECT p.title, p.content, p.url, p.created_at, p.community_id, p.upvotes, p.downvotes, c.name as community_name,
+	       f.id, f.text, f.color, a.username, uf.text, p.crosspost_parent_id, oc.name as crosspost_community,
+	       p.pinned_at IS NOT NULL, p.front_pinned_at IS NOT NULL, p.locked
 	FROM posts p
 	JOIN communities c ON p.community_id = c.id
-	WHERE p.id = ?`, id).Scan(&title, &content, &createdAt, &communityID, &upvotes, &downvotes, &communityName)
+	LEFT JOIN flair_templates f ON p.flair_id = f.id
+	LEFT JOIN identities a ON p.author_id = a.id
+	LEFT JOIN user_flair uf ON uf.community_id = p.community_id AND uf.identity_id = p.author_id
+	LEFT JOIN posts op ON p.crosspost_parent_id = op.id
+	LEFT JOIN communities oc ON op.community_id = oc.id
+	WHERE p.id = ?`, id).Scan(&title, &content, &url, &createdAt, &communityID, &upvotes, &downvotes, &communityName,
+		&flairID, &flairText, &flairColor, &author, &authorFlair, &crosspostParentID, &crosspostCommunity,
+		&pinned, &frontPinned, &locked)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"id":                  id,
+		"title":               title,
+		"content":             content,
+		"url":                 url,
+		"created_at":          createdAt,
+		"community_id":        communityID,
+		"community_name":      communityName,
+		"flair_id":            int(flairID.Int64),
+		"flair_text":          flairText.String,
+		"flair_color":         flairColor.String,
+		"author":              author.String,
+		"author_flair":        authorFlair.String,
+		"crosspost_parent_id": int(crosspostParentID.Int64),
+		"crosspost_community": crosspostCommunity.String,
+		"pinned":              pinned,
+		"front_pinned":        frontPinned,
+		"locked":              locked,
+		"upvotes":             upvotes,
+		"downvotes":           downvotes,
+		"score":               upvotes - downvotes,
+	}, nil
+}
+
+// getComment retrieves a single comment by ID, with the title of its post
+func (h *Handler) getComment(id int) (map[string]interface{}, error) {
+	var postID, upvotes, downvotes int
+	var content, createdAt, postTitle, communityName string
+	err := h.Reads.QueryRow(`
+	SELECT c.content, c.post_id, c.created_at, c.upvotes, c.downvotes, p.title, co.name
+	FROM comments c
+	JOIN posts p ON c.post_id = p.id
+	JOIN communities co ON p.community_id = co.id
+	WHERE c.id = ?`, id).Scan(&content, &postID, &createdAt, &upvotes, &downvotes, &postTitle, &communityName)
 	if err != nil {
 		return nil, err
 	}
 	return map[string]interface{}{
 		"id":             id,
-		"title":          title,
 		"content":        content,
-		"created_at":     createdAt,
-		"community_id":   communityID,
+		"post_id":        postID,
+		"post_title":     postTitle,
 		"community_name": communityName,
+		"created_at":     createdAt,
 		"upvotes":        upvotes,
 		"downvotes":      downvotes,
 		"score":          upvotes - downvotes,
 	}, nil
 }
 
-// getComments retrieves comments for a post and organizes them into a tree structure
-func (h *Handler) getComments(postID int) ([]map[string]interface{}, error) {
-	rows, err := h.DB.Query(`
-	SELECT id, content, post_id, parent_id, created_at, upvotes, downvotes
-	FROM comments
-	WHERE post_id = ?
-	ORDER BY created_at ASC
+// getComments retrieves comments for a post and organizes them into a tree
+// structure, sorted in the given comment sort order
+func (h *Handler) getComments(postID int, order string) ([]*models.Comment, error) {
+	rows, err := h.Reads.Query(`
+	SELECT c.id, c.content, c.post_id, c.parent_id, c.created_at, c.upvotes, c.downvotes, a.username, uf.text,
+	       c.author_id IS NOT NULL AND c.author_id = p.author_id
+	FROM comments c
+	JOIN posts p ON c.post_id = p.id
+	LEFT JOIN identities a ON c.author_id = a.id
+	LEFT JOIN user_flair uf ON uf.community_id = p.community_id AND uf.identity_id = c.author_id
+	WHERE c.post_id = ?
+	ORDER BY c.created_at ASC, c.id ASC
 	`, postID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var comments []map[string]interface{}
-	commentMap := make(map[int]map[string]interface{})
-	
-	// First pass: create all comment objects
+	var comments []models.Comment
 	for rows.Next() {
-		var id, postID, upvotes, downvotes int
-		var content, createdAt string
+		var comment models.Comment
 		var parentID sql.NullInt64
-		if err := rows.Scan(&id, &content, &postID, &parentID, &createdAt, &upvotes, &downvotes); err != nil {
+		var author, authorFlair sql.NullString
+		if err := rows.Scan(&comment.ID, &comment.Content, &comment.PostID, &parentID, &comment.CreatedAt,
+			&comment.Upvotes, &comment.Downvotes, &author, &authorFlair, &comment.IsOP); err != nil {
 			return nil, err
 		}
-
-		var parentIDValue interface{}
 		if parentID.Valid {
-			parentIDValue = int(parentID.Int64)
-		} else {
-			parentIDValue = nil
-		}
-
-		comment := map[string]interface{}{
-			"id":         id,
-			"content":    content,
-			"post_id":    postID,
-			"parent_id":  parentIDValue,
-			"created_at": createdAt,
-			"upvotes":    upvotes,
-			"downvotes":  downvotes,
-			"score":      upvotes - downvotes,
-			"replies":    []map[string]interface{}{},
+			id := int(parentID.Int64)
+			comment.ParentID = &id
 		}
-		
-		commentMap[id] = comment
+		comment.Author = author.String
+		comment.AuthorFlair = authorFlair.String
+		comment.Score = comment.Upvotes - comment.Downvotes
+		comments = append(comments, comment)
 	}
-
-	// Second pass: build the tree structure
-	for _, comment := range commentMap {
-		if comment["parent_id"] == nil {
-			// This is a root comment
-			comments = append(comments, comment)
-		} else {
-			// This is a reply
-			parentID := comment["parent_id"].(int)
-			if parent, exists := commentMap[parentID]; exists {
-				replies := parent["replies"].([]map[string]interface{})
-				parent["replies"] = append(replies, comment)
-			}
-		}
-	}
-
-	return comments, nil
-}
-
-// getClientID gets a unique identifier for the client (for voting)
-func (h *Handler) getClientID(r *http.Request) string {
-	// Check for existing cookie
-	cookie, err := r.Cookie("client_id")
-	if err == nil {
-		return cookie.Value
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
 
-	// Generate a new client ID based on IP and timestamp
-	clientID := r.RemoteAddr + "_" + strconv.FormatInt(time.Now().UnixNano(), 10)
-	return clientID
+	tree := models.BuildCommentTree(comments)
+	sortComments(tree, order)
+	return tree, nil
 }
 
 // getUserVotes gets the user's votes for a post and its comments
@@ -206,7 +398,7 @@ func (h *Handler) getUserVotes(clientID string, postID int) (map[int]int, map[in
 	// Get user's vote on the post
 	postVotes := make(map[int]int)
 	var postVoteType int
-	err := h.DB.QueryRow("SELECT vote_type FROM votes WHERE item_type = 'post' AND item_id = ? AND client_id = ?", postID, clientID).Scan(&postVoteType)
+	err := h.Reads.QueryRow("SELECT vote_type FROM votes WHERE item_type = 'post' AND item_id = ? AND client_id = ?", postID, clientID).Scan(&postVoteType)
 	if err == nil {
 		postVotes[postID] = postVoteType
 	} else if err != sql.ErrNoRows {
@@ -215,7 +407,7 @@ func (h *Handler) getUserVotes(clientID string, postID int) (map[int]int, map[in
 
 	// Get user's votes on comments
 	commentVotes := make(map[int]int)
-	rows, err := h.DB.Query(`
+	rows, err := h.Reads.Query(`
 	SELECT item_id, vote_type 
 	FROM votes 
 	WHERE item_type = 'comment' AND client_id = ? AND item_id IN (
@@ -236,112 +428,3 @@ func (h *Handler) getUserVotes(clientID string, postID int) (map[int]int, map[in
 
 	return postVotes, commentVotes, nil
 }
-
-// processVote processes a vote on a post or comment
-func (h *Handler) processVote(itemType string, itemID int, clientID string, voteType int) error {
-	tx, err := h.DB.Begin()
-	if err != nil {
-		return err
-	}
-	defer func() {
-		if err != nil {
-			tx.Rollback()
-			return
-		}
-		err = tx.Commit()
-	}()
-
-	// Check if user already voted on this item
-	var existingVoteType int
-	var voteExists bool
-	err = tx.QueryRow("SELECT vote_type FROM votes WHERE item_type = ? AND item_id = ? AND client_id = ?", itemType, itemID, clientID).Scan(&existingVoteType)
-	if err == nil {
-		voteExists = true
-	} else if err != sql.ErrNoRows {
-		return err
-	}
-
-	if voteExists {
-		// If vote type is the same, remove the vote (toggle off)
-		if existingVoteType == voteType {
-			_, err = tx.Exec("DELETE FROM votes WHERE item_type = ? AND item_id = ? AND client_id = ?", itemType, itemID, clientID)
-			if err != nil {
-				return err
-			}
-
-			// Update item vote counts
-			var updateQuery string
-			if itemType == "post" {
-				if voteType == 1 {
-					updateQuery = "UPDATE posts SET upvotes = upvotes - 1 WHERE id = ?"
-				} else {
-					updateQuery = "UPDATE posts SET downvotes = downvotes - 1 WHERE id = ?"
-				}
-			} else {
-				if voteType == 1 {
-					updateQuery = "UPDATE comments SET upvotes = upvotes - 1 WHERE id = ?"
-				} else {
-					updateQuery = "UPDATE comments SET downvotes = downvotes - 1 WHERE id = ?"
-				}
-			}
-			_, err = tx.Exec(updateQuery, itemID)
-			if err != nil {
-				return err
-			}
-		} else {
-			// If vote type is different, update the vote
-			_, err = tx.Exec("UPDATE votes SET vote_type = ? WHERE item_type = ? AND item_id = ? AND client_id = ?", voteType, itemType, itemID, clientID)
-			if err != nil {
-				return err
-			}
-
-			// Update item vote counts
-			var updateQuery string
-			if itemType == "post" {
-				if voteType == 1 {
-					updateQuery = "UPDATE posts SET upvotes = upvotes + 1, downvotes = downvotes - 1 WHERE id = ?"
-				} else {
-					updateQuery = "UPDATE posts SET upvotes = upvotes - 1, downvotes = downvotes + 1 WHERE id = ?"
-				}
-			} else {
-				if voteType == 1 {
-					updateQuery = "UPDATE comments SET upvotes = upvotes + 1, downvotes = downvotes - 1 WHERE id = ?"
-				} else {
-					updateQuery = "UPDATE comments SET upvotes = upvotes - 1, downvotes = downvotes + 1 WHERE id = ?"
-				}
-			}
-			_, err = tx.Exec(updateQuery, itemID)
-			if err != nil {
-				return err
-			}
-		}
-	} else {
-		// Insert new vote
-		_, err = tx.Exec("INSERT INTO votes (item_type, item_id, client_id, vote_type) VALUES (?, ?, ?, ?)", itemType, itemID, clientID, voteType)
-		if err != nil {
-			return err
-		}
-
-		// Update item vote counts
-		var updateQuery string
-		if itemType == "post" {
-			if voteType == 1 {
-				updateQuery = "UPDATE posts SET upvotes = upvotes + 1 WHERE id = ?"
-			} else {
-				updateQuery = "UPDATE posts SET downvotes = downvotes + 1 WHERE id = ?"
-			}
-		} else {
-			if voteType == 1 {
-				updateQuery = "UPDATE comments SET upvotes = upvotes + 1 WHERE id = ?"
-			} else {
-				updateQuery = "UPDATE comments SET downvotes = downvotes + 1 WHERE id = ?"
-			}
-		}
-		_, err = tx.Exec(updateQuery, itemID)
-		if err != nil {
-			return err
-		}
-	}
-
-	return nil
-}
@@ -0,0 +1,190 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"hubcorner/internal/database"
+	"hubcorner/internal/models"
+	"hubcorner/internal/security"
+)
+
+// clientIDCookie is the cookie that identifies a client
+const clientIDCookie = "client_id"
+
+// usernamePattern is the allowed format of usernames
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{3,20}$`)
+
+// getClientID gets a unique identifier for the client (for voting).
+// A new identifier is generated and stored in a cookie if the client has none.
+func (h *Handler) getClientID(w http.ResponseWriter, r *http.Request) string {
+	// Check for existing cookie
+	cookie, err := r.Cookie(clientIDCookie)
+	if err == nil && cookie.Value != "" {
+		return cookie.Value
+	}
+
+	// Generate a new random client ID
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// crypto/rand only fails if the OS has no entropy source
+		panic(err)
+	}
+	cookie = &http.Cookie{
+		Name:     clientIDCookie,
+		Value:    hex.EncodeToString(b),
+		Path:     "/",
+		Expires:  time.Now().AddDate(10, 0, 0),
+		HttpOnly: true,
+		Secure:   security.IsHTTPS(r),
+		SameSite: http.SameSiteLaxMode,
+	}
+	http.SetCookie(w, cookie)
+
+	// Later calls during this request see the new cookie too
+	r.AddCookie(cookie)
+	return cookie.Value
+}
+
+// clientIPRange returns the network a request comes from: the /24 of an
+// IPv4 address or the /48 of an IPv6 address, which is what the vote
+// analyser compares. Requests from the local machine get an empty range.
+func clientIPRange(r *http.Request) string {
+	ip := clientIP(r)
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String() + "/48"
+}
+
+// clientIP returns the address a request comes from. Behind a reverse proxy
+// on the same machine, the client address is taken from X-Forwarded-For.
+// Requests whose address is still the local machine get nil.
+func clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip != nil && ip.IsLoopback() {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			// The proxy appends the address it saw last
+			hops := strings.Split(forwarded, ",")
+			ip = net.ParseIP(strings.TrimSpace(hops[len(hops)-1]))
+		}
+	}
+	if ip == nil || ip.IsLoopback() {
+		return nil
+	}
+	return ip
+}
+
+// currentIdentity returns the identity of the client, creating it on first use.
+// A client without a cookie that is only reading pages is a visitor, with
+// ID 0, and gets a cookie and an identity when it first writes. That way
+// every new visitor sees the same pages, which shared caches can keep.
+func (h *Handler) currentIdentity(w http.ResponseWriter, r *http.Request) (*models.Identity, error) {
+	if cookie, err := r.Cookie(clientIDCookie); (err != nil || cookie.Value == "") && isRead(r) {
+		return &models.Identity{}, nil
+	}
+	clientID := h.getClientID(w, r)
+
+	// Most requests come from known clients, so only new clients cost a write
+	identity, err := h.getIdentity(clientID)
+	if err == sql.ErrNoRows {
+		if _, err := database.WriteExec(h.DB, "INSERT OR IGNORE INTO identities (client_id) VALUES (?)", clientID); err != nil {
+			return nil, err
+		}
+		identity, err = h.getIdentity(clientID)
+	}
+	return identity, err
+}
+
+// getIdentity retrieves the identity with a client ID
+func (h *Handler) getIdentity(clientID string) (*models.Identity, error) {
+	identity := &models.Identity{ClientID: clientID}
+	var username sql.NullString
+	err := h.Reads.QueryRow("SELECT id, username, is_admin, post_karma, comment_karma, created_at FROM identities WHERE client_id = ?", clientID).
+		Scan(&identity.ID, &username, &identity.IsAdmin, &identity.PostKarma, &identity.CommentKarma, &identity.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	identity.Username = username.String
+	return identity, nil
+}
+
+// Account handles the account page, where an identity can choose a username
+func (h *Handler) Account(w http.ResponseWriter, r *http.Request) {
+	// The page is about the client's identity, so even a visitor gets one
+	h.getClientID(w, r)
+	identity, err := h.currentIdentity(w, r)
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to get identity"))
+		return
+	}
+
+	// Users with a username have a profile, with its privacy settings here
+	var profile *models.Profile
+	if !identity.IsAnonymous() {
+		profile, err = h.getProfile(identity.Username)
+		if err != nil {
+			h.renderError(w, r, Internal(err, "Failed to get profile"))
+			return
+		}
+	}
+
+	data := map[string]interface{}{
+		"Title":    "Your Account",
+		"Identity": identity,
+		"Profile":  profile,
+		"Form":     map[string]string{},
+		"Errors":   map[string]string{},
+	}
+
+	if r.Method == http.MethodGet {
+		h.render(w, r, http.StatusOK, "account.html", data)
+		return
+	}
+	if r.Method != http.MethodPost {
+		h.renderError(w, r, MethodNotAllowed())
+		return
+	}
+
+	if !identity.IsAnonymous() {
+		h.renderError(w, r, Conflict("You have already chosen a username."))
+		return
+	}
+
+	username := r.FormValue("username")
+	if !usernamePattern.MatchString(username) {
+		h.renderForm(w, r, "account.html", data, Validation("Please fix the errors below.", map[string]string{
+			"username": "Usernames are 3 to 20 letters, numbers, underscores or dashes",
+		}))
+		return
+	}
+
+	_, err = database.WriteExec(h.DB, "UPDATE identities SET username = ? WHERE id = ?", username, identity.ID)
+	if isUniqueViolation(err) {
+		e := Conflict("Please fix the errors below.")
+		e.Fields = map[string]string{"username": "This username is already taken"}
+		h.renderForm(w, r, "account.html", data, e)
+		return
+	}
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to save username"))
+		return
+	}
+	// Listings show the username as the author of the client's posts
+	h.Cache.MarkStale(postsPrefix)
+
+	http.Redirect(w, r, "/account", http.StatusSeeOther)
+}
@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+
+	"hubcorner/internal/database"
+	"hubcorner/internal/models"
+)
+
+// Limits on pinned posts
+const (
+	maxPinnedPosts   = 3 // per community
+	maxFrontPagePins = 3
+)
+
+// canModerate reports whether the identity may moderate the community:
+// its moderators and site admins can
+func (h *Handler) canModerate(communityID int, identity *models.Identity) (bool, error) {
+	if identity.IsAdmin {
+		return true, nil
+	}
+	return h.isModerator(communityID, identity)
+}
+
+// ModeratePost handles the POST requests that pin, unpin, lock and unlock a
+// post: /posts/{id}/{action}. Moderators of the post's community and admins
+// can pin posts in the community and lock them; only admins can pin posts
+// on the front page (the frontpin and frontunpin actions).
+func (h *Handler) ModeratePost(w http.ResponseWriter, r *http.Request, postID int, action string) {
+	if r.Method != http.MethodPost {
+		h.renderError(w, r, MethodNotAllowed())
+		return
+	}
+
+	var communityID int
+	var communityName, title string
+	err := h.Reads.QueryRow("SELECT p.community_id, c.name, p.title FROM posts p JOIN communities c ON p.community_id = c.id WHERE p.id = ?", postID).
+		Scan(&communityID, &communityName, &title)
+	if err == sql.ErrNoRows {
+		h.renderError(w, r, NotFound("This post does not exist or has been removed."))
+		return
+	}
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to get post"))
+		return
+	}
+
+	identity, err := h.currentIdentity(w, r)
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to get identity"))
+		return
+	}
+	if action == "frontpin" || action == "frontunpin" {
+		if !identity.IsAdmin {
+			h.renderError(w, r, Forbidden("Only admins can pin posts on the front page."))
+			return
+		}
+	} else {
+		canModerate, err := h.canModerate(communityID, identity)
+		if err != nil {
+			h.renderError(w, r, Internal(err, "Failed to check moderator status"))
+			return
+		}
+		if !canModerate {
+			h.renderError(w, r, Forbidden(fmt.Sprintf("Only moderators of c/%s can do that.", communityName)))
+			return
+		}
+	}
+
+	// Check the pin limits before pinning
+	var pinned int
+	switch action {
+	case "pin":
+		err = h.Reads.QueryRow("SELECT COUNT(*) FROM posts WHERE community_id = ? AND pinned_at IS NOT NULL AND id != ?", communityID, postID).Scan(&pinned)
+		if err == nil && pinned >= maxPinnedPosts {
+			h.renderError(w, r, Conflict(fmt.Sprintf("c/%s already has %d pinned posts. Unpin one first.", communityName, maxPinnedPosts)))
+			return
+		}
+	case "frontpin":
+		err = h.Reads.QueryRow("SELECT COUNT(*) FROM posts WHERE front_pinned_at IS NOT NULL AND id != ?", postID).Scan(&pinned)
+		if err == nil && pinned >= maxFrontPagePins {
+			h.renderError(w, r, Conflict(fmt.Sprintf("The front page already has %d pinned posts. Unpin one first.", maxFrontPagePins)))
+			return
+		}
+	}
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to count pinned posts"))
+		return
+	}
+
+	// Pinning an already pinned post keeps its original pin time
+	var query string
+	switch action {
+	case "pin":
+		query = "UPDATE posts SET pinned_at = COALESCE(pinned_at, CURRENT_TIMESTAMP) WHERE id = ?"
+	case "unpin":
+		query = "UPDATE posts SET pinned_at = NULL WHERE id = ?"
+	case "frontpin":
+		query = "UPDATE posts SET front_pinned_at = COALESCE(front_pinned_at, CURRENT_TIMESTAMP) WHERE id = ?"
+	case "frontunpin":
+		query = "UPDATE posts SET front_pinned_at = NULL WHERE id = ?"
+	case "lock":
+		query = "UPDATE posts SET locked = 1 WHERE id = ?"
+	case "unlock":
+		query = "UPDATE posts SET locked = 0 WHERE id = ?"
+	default:
+		h.renderError(w, r, NotFound("The page you were looking for does not exist."))
+		return
+	}
+	err = database.WriteTx(h.DB, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(query, postID); err != nil {
+			return err
+		}
+		return logModAction(tx, identity, modLogEntry{
+			CommunityID:   communityID,
+			CommunityName: communityName,
+			Action:        action,
+			Target:        title,
+			Link:          fmt.Sprintf("/posts/%d", postID),
+		})
+	})
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to update post"))
+		return
+	}
+	h.Cache.Invalidate(postsPrefix)
+
+	if wantsJSON(r) {
+		post, err := h.getPost(postID)
+		if err != nil {
+			h.renderError(w, r, Internal(err, "Failed to get post"))
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"pinned":       post["pinned"],
+			"front_pinned": post["front_pinned"],
+			"locked":       post["locked"],
+		})
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/posts/%d", postID), http.StatusSeeOther)
+}
@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"database/sql"
+
+	"hubcorner/internal/models"
+)
+
+// modAction is a kind of entry in the moderation log
+type modAction struct {
+	Code  string
+	Name  string // for the log's filter
+	Label string // what the moderator did, followed by the entry's target
+}
+
+// modActions lists the kinds of moderation log entries, in the order the
+// log's filter offers them
+var modActions = []modAction{
+	{"pin", "Pin post", "pinned"},
+	{"unpin", "Unpin post", "unpinned"},
+	{"frontpin", "Pin post on the front page", "pinned on the front page"},
+	{"frontunpin", "Unpin post from the front page", "unpinned from the front page"},
+	{"lock", "Lock post", "locked"},
+	{"unlock", "Unlock post", "unlocked"},
+	{"settings", "Change settings", "changed the settings of"},
+	{"add-flair", "Add flair", "added the flair"},
+	{"delete-flair", "Delete flair", "deleted the flair"},
+	{"lock-community", "Lock community", "locked"},
+	{"unlock-community", "Unlock community", "unlocked"},
+	{"quarantine-community", "Quarantine community", "quarantined"},
+	{"unquarantine-community", "Lift quarantine", "lifted the quarantine on"},
+	{"delete-community", "Delete community", "deleted"},
+	{"ban", "Ban", "banned"},
+	{"unban", "Lift ban", "lifted the ban on"},
+	{"announce", "Post announcement", "posted the announcement"},
+	{"unannounce", "Remove announcement", "removed the announcement"},
+}
+
+// modActionLabel returns the label of an action code, or the code itself
+// for an action this version doesn't know
+func modActionLabel(code string) string {
+	for _, action := range modActions {
+		if action.Code == code {
+			return action.Label
+		}
+	}
+	return code
+}
+
+// modLogEntry is a moderation action to record in the moderation log
+type modLogEntry struct {
+	CommunityID   int // 0 for site-wide actions
+	CommunityName string
+	Action        string // the Code of one of modActions
+	Target        string // what was acted on, as shown in the log
+	Link          string // where the target can be seen, or ""
+}
+
+// logModAction records a moderation action by an identity in the
+// moderation log. It runs in the action's transaction, so an action is
+// never taken without its log entry.
+func logModAction(tx *sql.Tx, identity *models.Identity, entry modLogEntry) error {
+	var communityID interface{}
+	if entry.CommunityID != 0 {
+		communityID = entry.CommunityID
+	}
+	_, err := tx.Exec(`
+	INSERT INTO mod_log (identity_id, community_id, community_name, action, target, link)
+	VALUES (?, ?, ?, ?, ?, ?)`,
+		identity.ID, communityID, entry.CommunityName, entry.Action, entry.Target, entry.Link)
+	return err
+}
+
+// getModLog retrieves one page of the moderation log, newest first,
+// optionally only the entries of one community or of one action
+func (h *Handler) getModLog(communityName, action string, page int) ([]map[string]interface{}, bool, error) {
+	rows, err := h.Reads.Query(`
+	SELECT l.id, l.identity_id, i.username, l.community_name, c.id IS NOT NULL,
+	       l.action, l.target, l.link, l.created_at
+	FROM mod_log l
+	LEFT JOIN identities i ON l.identity_id = i.id
+	LEFT JOIN communities c ON l.community_id = c.id
+	WHERE (? = '' OR l.community_name = ?) AND (? = '' OR l.action = ?)
+	ORDER BY l.id DESC
+	LIMIT ? OFFSET ?
+	`, communityName, communityName, action, action, perPage+1, (page-1)*perPage)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	var entries []map[string]interface{}
+	for rows.Next() {
+		var id, identityID int
+		var username sql.NullString
+		var community, code, target, link, createdAt string
+		var communityExists bool
+		if err := rows.Scan(&id, &identityID, &username, &community, &communityExists, &code, &target, &link, &createdAt); err != nil {
+			return nil, false, err
+		}
+		entries = append(entries, map[string]interface{}{
+			"id":               id,
+			"identity_id":      identityID,
+			"username":         username.String,
+			"community_name":   community,
+			"community_exists": communityExists,
+			"action":           code,
+			"label":            modActionLabel(code),
+			"target":           target,
+			"link":             link,
+			"created_at":       createdAt,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+
+	hasMore := len(entries) > perPage
+	if hasMore {
+		entries = entries[:perPage]
+	}
+	return entries, hasMore, nil
+}
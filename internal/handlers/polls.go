@@ -0,0 +1,288 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"hubcorner/internal/database"
+	"hubcorner/internal/models"
+)
+
+// Limits for polls
+const (
+	minPollOptions      = 2
+	maxPollOptions      = 10
+	maxPollOptionLength = 120
+)
+
+// pollDurations are the choices, in days, for how long a poll stays open
+var pollDurations = []int{1, 3, 7, 14, 30}
+
+// pollForm is the poll part of the new post form
+type pollForm struct {
+	options    []string
+	closesIn   int // days; 0 means the poll never closes
+	visibility string
+}
+
+// parsePollForm reads the poll fields of the new post form. It returns nil
+// if no options were entered, which makes the post an ordinary post.
+func parsePollForm(r *http.Request, fields map[string]string) *pollForm {
+	// One option per line, blank lines ignored
+	var options []string
+	for _, line := range strings.Split(r.FormValue("poll_options"), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			options = append(options, line)
+		}
+	}
+	if len(options) == 0 {
+		return nil
+	}
+
+	form := &pollForm{
+		options:    options,
+		visibility: r.FormValue("poll_results"),
+	}
+	if form.visibility == "" {
+		form.visibility = models.PollResultsAfterVote
+	}
+
+	if len(options) < minPollOptions || len(options) > maxPollOptions {
+		fields["poll_options"] = fmt.Sprintf("A poll must have %d to %d options", minPollOptions, maxPollOptions)
+	}
+	seen := make(map[string]bool)
+	for _, option := range options {
+		if utf8.RuneCountInString(option) > maxPollOptionLength {
+			fields["poll_options"] = fmt.Sprintf("Poll options can be at most %d characters long", maxPollOptionLength)
+		}
+		if seen[strings.ToLower(option)] {
+			fields["poll_options"] = "Poll options must be different from each other"
+		}
+		seen[strings.ToLower(option)] = true
+	}
+
+	if closesIn := r.FormValue("poll_closes_in"); closesIn != "" {
+		days, err := strconv.Atoi(closesIn)
+		valid := false
+		for _, d := range pollDurations {
+			valid = valid || err == nil && d == days
+		}
+		if !valid {
+			fields["poll_closes_in"] = "Invalid poll duration"
+		}
+		form.closesIn = days
+	}
+
+	switch form.visibility {
+	case models.PollResultsAfterVote:
+	case models.PollResultsAfterClose:
+		if form.closesIn == 0 {
+			fields["poll_results"] = "Choose when voting closes to hide the results until then"
+		}
+	default:
+		fields["poll_results"] = "Invalid results setting"
+	}
+	return form
+}
+
+// createPoll adds the poll of a new post within the post's transaction
+func createPoll(tx *sql.Tx, postID int64, form *pollForm) error {
+	var closesAt interface{}
+	if form.closesIn > 0 {
+		closesAt = fmt.Sprintf("+%d days", form.closesIn)
+	}
+	_, err := tx.Exec("INSERT INTO polls (post_id, closes_at, results_visibility) VALUES (?, datetime('now', ?), ?)",
+		postID, closesAt, form.visibility)
+	if err != nil {
+		return err
+	}
+	for i, option := range form.options {
+		if _, err := tx.Exec("INSERT INTO poll_options (post_id, position, text) VALUES (?, ?, ?)", postID, i, option); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getPoll retrieves the poll of a post as seen by an identity, or nil if
+// the post is not a poll. Vote counts are left out until the identity may see them.
+func (h *Handler) getPoll(postID, identityID int) (*models.Poll, error) {
+	poll := &models.Poll{PostID: postID}
+	var closesAt sql.NullTime
+	err := h.Reads.QueryRow(`
+	SELECT closes_at, closes_at IS NOT NULL AND closes_at <= CURRENT_TIMESTAMP, results_visibility
+	FROM polls
+	WHERE post_id = ?`, postID).Scan(&closesAt, &poll.Closed, &poll.ResultsVisibility)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if closesAt.Valid {
+		poll.ClosesAt = &closesAt.Time
+	}
+
+	err = h.Reads.QueryRow("SELECT option_id FROM poll_votes WHERE post_id = ? AND identity_id = ?", postID, identityID).Scan(&poll.VotedOptionID)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	poll.ShowResults = poll.Closed || poll.ResultsVisibility == models.PollResultsAfterVote && poll.VotedOptionID != 0
+
+	rows, err := h.Reads.Query(`
+	SELECT o.id, o.text, (SELECT COUNT(*) FROM poll_votes WHERE option_id = o.id)
+	FROM poll_options o
+	WHERE o.post_id = ?
+	ORDER BY o.position ASC
+	`, postID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var option models.PollOption
+		if err := rows.Scan(&option.ID, &option.Text, &option.Votes); err != nil {
+			return nil, err
+		}
+		if !poll.ShowResults {
+			option.Votes = 0
+		}
+		poll.TotalVotes += option.Votes
+		poll.Options = append(poll.Options, option)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range poll.Options {
+		if poll.TotalVotes > 0 {
+			poll.Options[i].Percent = (poll.Options[i].Votes*100 + poll.TotalVotes/2) / poll.TotalVotes
+		}
+	}
+	return poll, nil
+}
+
+// VotePoll handles the POST request to vote in a poll. Each identity can
+// vote once, and only while the poll is open.
+func (h *Handler) VotePoll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		h.renderError(w, r, MethodNotAllowed())
+		return
+	}
+
+	postID, err := strconv.Atoi(r.FormValue("post_id"))
+	if err != nil {
+		h.renderError(w, r, Validation("Invalid post ID", nil))
+		return
+	}
+	optionID, err := strconv.Atoi(r.FormValue("option_id"))
+	if err != nil {
+		h.renderError(w, r, Validation("Please choose an option", nil))
+		return
+	}
+
+	identity, err := h.currentIdentity(w, r)
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to get identity"))
+		return
+	}
+	if err := h.checkCanViewPost(postID, identity); err != nil {
+		h.renderError(w, r, err)
+		return
+	}
+	if err := h.checkBanned(r, identity); err != nil {
+		h.renderError(w, r, err)
+		return
+	}
+
+	// Record the vote, checking the poll is open and the option is one of its own
+	err = database.WriteTx(h.DB, func(tx *sql.Tx) error {
+		var closed bool
+		err := tx.QueryRow("SELECT closes_at IS NOT NULL AND closes_at <= CURRENT_TIMESTAMP FROM polls WHERE post_id = ?", postID).Scan(&closed)
+		if err == sql.ErrNoRows {
+			return NotFound("This post does not have a poll.")
+		}
+		if err != nil {
+			return err
+		}
+		if closed {
+			return Conflict("This poll is closed.")
+		}
+
+		var exists int
+		err = tx.QueryRow("SELECT 1 FROM poll_options WHERE id = ? AND post_id = ?", optionID, postID).Scan(&exists)
+		if err == sql.ErrNoRows {
+			return Validation("This option is not part of the poll.", nil)
+		}
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("INSERT INTO poll_votes (post_id, identity_id, option_id) VALUES (?, ?, ?)", postID, identity.ID, optionID)
+		return err
+	})
+	if isUniqueViolation(err) {
+		h.renderError(w, r, Conflict("You have already voted in this poll."))
+		return
+	}
+	if err != nil {
+		if _, ok := err.(*Error); !ok {
+			err = Internal(err, "Failed to record vote")
+		}
+		h.renderError(w, r, err)
+		return
+	}
+
+	if wantsJSON(r) {
+		h.writePoll(w, r, postID, identity)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/posts/%d", postID), http.StatusSeeOther)
+}
+
+// PollResults handles GET /api/polls/{post_id}, returning the poll as the client sees it
+func (h *Handler) PollResults(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.renderError(w, r, MethodNotAllowed())
+		return
+	}
+
+	postID, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/api/polls/"))
+	if err != nil {
+		h.renderError(w, r, NotFound("The page you were looking for does not exist."))
+		return
+	}
+
+	identity, err := h.currentIdentity(w, r)
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to get identity"))
+		return
+	}
+	if err := h.checkCanViewPost(postID, identity); err != nil {
+		h.renderError(w, r, err)
+		return
+	}
+
+	h.writePoll(w, r, postID, identity)
+}
+
+// writePoll writes the poll of a post as JSON
+func (h *Handler) writePoll(w http.ResponseWriter, r *http.Request, postID int, identity *models.Identity) {
+	poll, err := h.getPoll(postID, identity.ID)
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to get poll"))
+		return
+	}
+	if poll == nil {
+		h.renderError(w, r, NotFound("This post does not have a poll."))
+		return
+	}
+	// Results change while the poll is open
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, poll)
+}
@@ -0,0 +1,247 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"hubcorner/internal/database"
+	"hubcorner/internal/models"
+)
+
+// visibleCommunity is a query condition on a community c that holds if the
+// identity given as its argument may view the community
+const visibleCommunity = "(c.type != 'private' OR c.id IN (SELECT community_id FROM community_moderators WHERE identity_id = ?))"
+
+// profileTabs are the tabs of a profile page, the default first
+var profileTabs = []string{"posts", "comments", "saved"}
+
+// getProfile retrieves the profile of the user with a username, ignoring case
+func (h *Handler) getProfile(username string) (*models.Profile, error) {
+	profile := &models.Profile{}
+	err := h.Reads.QueryRow(`
+	SELECT i.id, i.username, i.created_at, i.hide_posts, i.hide_comments, i.post_karma, i.comment_karma
+	FROM identities i
+	WHERE i.username = ?`, username).Scan(&profile.ID, &profile.Username, &profile.CreatedAt,
+		&profile.HidePosts, &profile.HideComments, &profile.PostKarma, &profile.CommentKarma)
+	if err != nil {
+		return nil, err
+	}
+	profile.Karma = profile.PostKarma + profile.CommentKarma
+	return profile, nil
+}
+
+// getProfileComments retrieves one page of a user's comments, newest first,
+// as seen by an identity, and whether there are more pages. Comments in
+// communities the identity may not view are left out.
+func (h *Handler) getProfileComments(authorID, identityID, page int) ([]map[string]interface{}, bool, error) {
+	rows, err := h.Reads.Query(`
+	SELECT co.id, co.content, co.post_id, co.created_at, co.upvotes, co.downvotes, p.title, c.name,
+	       EXISTS (SELECT 1 FROM saved_items WHERE identity_id = ? AND item_type = 'comment' AND item_id = co.id)
+	FROM comments co
+	JOIN posts p ON co.post_id = p.id
+	JOIN communities c ON p.community_id = c.id
+	WHERE co.author_id = ? AND `+visibleCommunity+`
+	  AND co.id NOT IN (SELECT item_id FROM hidden_items WHERE identity_id = ? AND item_type = 'comment')
+	ORDER BY co.created_at DESC, co.id DESC
+	LIMIT ? OFFSET ?
+	`, identityID, authorID, identityID, identityID, perPage+1, (page-1)*perPage)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	var comments []map[string]interface{}
+	for rows.Next() {
+		var id, postID, upvotes, downvotes int
+		var content, createdAt, postTitle, communityName string
+		var saved bool
+		if err := rows.Scan(&id, &content, &postID, &createdAt, &upvotes, &downvotes, &postTitle, &communityName, &saved); err != nil {
+			return nil, false, err
+		}
+		comments = append(comments, map[string]interface{}{
+			"type":           "comment",
+			"id":             id,
+			"content":        content,
+			"post_id":        postID,
+			"post_title":     postTitle,
+			"community_name": communityName,
+			"created_at":     createdAt,
+			"upvotes":        upvotes,
+			"downvotes":      downvotes,
+			"score":          upvotes - downvotes,
+			"saved":          saved,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+
+	hasMore := len(comments) > perPage
+	if hasMore {
+		comments = comments[:perPage]
+	}
+	return comments, hasMore, nil
+}
+
+// UserProfile handles the profile pages /u/{username}, /u/{username}/comments
+// and /u/{username}/saved, and the same pages as JSON under /api/u/. Users
+// can keep their posts and comments off their profile, and only the user
+// can see their saved tab.
+func (h *Handler) UserProfile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.renderError(w, r, MethodNotAllowed())
+		return
+	}
+
+	// Path is /u/{username} or /u/{username}/{tab}, maybe under /api
+	path := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api"), "/u/")
+	pathParts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(pathParts) > 2 || pathParts[0] == "" {
+		h.renderError(w, r, NotFound("The page you were looking for does not exist."))
+		return
+	}
+	tab := profileTabs[0]
+	if len(pathParts) == 2 {
+		tab = pathParts[1]
+	}
+	validTab := false
+	for _, t := range profileTabs {
+		validTab = validTab || t == tab
+	}
+	if !validTab {
+		h.renderError(w, r, NotFound("The page you were looking for does not exist."))
+		return
+	}
+
+	profile, err := h.getProfile(pathParts[0])
+	if err == sql.ErrNoRows {
+		h.renderError(w, r, NotFound(fmt.Sprintf("There is no user called %s.", pathParts[0])))
+		return
+	}
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to get profile"))
+		return
+	}
+	h.fuzzProfile(profile)
+
+	// Usernames are case-insensitive; pages use the username as it was chosen
+	if profile.Username != pathParts[0] && !wantsJSON(r) {
+		target := strings.Replace(r.URL.Path, pathParts[0], profile.Username, 1)
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+		return
+	}
+
+	identity, err := h.currentIdentity(w, r)
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to get identity"))
+		return
+	}
+	isOwner := identity.ID == profile.ID
+
+	page := pageNumber(r)
+	var items []map[string]interface{}
+	var hasMore, private bool
+	switch tab {
+	case "posts":
+		if profile.HidePosts && !isOwner {
+			private = true
+			break
+		}
+		items, hasMore, err = h.queryPostPage(identity.ID, "p.author_id = ? AND "+visibleCommunity, page, profile.ID, identity.ID)
+	case "comments":
+		if profile.HideComments && !isOwner {
+			private = true
+			break
+		}
+		items, hasMore, err = h.getProfileComments(profile.ID, identity.ID, page)
+	case "saved":
+		if !isOwner {
+			h.renderError(w, r, Forbidden(fmt.Sprintf("Only %s can see their saved items.", profile.Username)))
+			return
+		}
+		items, hasMore, err = h.getMarkedItems("saved_items", profile.ID, page)
+		for _, item := range items {
+			item["saved"] = true
+		}
+	}
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to get "+tab))
+		return
+	}
+
+	if wantsJSON(r) {
+		if items == nil {
+			items = []map[string]interface{}{}
+		}
+		h.fuzzItems(items)
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"profile":  profile,
+			"tab":      tab,
+			"private":  private,
+			"items":    items,
+			"page":     page,
+			"has_more": hasMore,
+		})
+		return
+	}
+
+	data := map[string]interface{}{
+		"Title":   "u/" + profile.Username,
+		"Profile": profile,
+		"Tab":     tab,
+		"IsOwner": isOwner,
+		"Private": private,
+		"Items":   items,
+		"Page":    page,
+		"HasMore": hasMore,
+	}
+	if page > 1 {
+		data["PrevPage"] = page - 1
+	}
+	if hasMore {
+		data["NextPage"] = page + 1
+	}
+
+	h.render(w, r, http.StatusOK, "profile.html", data)
+}
+
+// ProfilePrivacy handles the POST request from the account page that
+// chooses whether a user's profile shows their posts and comments
+func (h *Handler) ProfilePrivacy(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		h.renderError(w, r, MethodNotAllowed())
+		return
+	}
+
+	identity, err := h.currentIdentity(w, r)
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to get identity"))
+		return
+	}
+	if identity.IsAnonymous() {
+		h.renderError(w, r, Conflict("Choose a username to get a profile first."))
+		return
+	}
+
+	hidePosts := r.FormValue("hide_posts") != ""
+	hideComments := r.FormValue("hide_comments") != ""
+	_, err = database.WriteExec(h.DB, "UPDATE identities SET hide_posts = ?, hide_comments = ? WHERE id = ?", hidePosts, hideComments, identity.ID)
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to save privacy settings"))
+		return
+	}
+
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"hide_posts":    hidePosts,
+			"hide_comments": hideComments,
+		})
+		return
+	}
+	http.Redirect(w, r, "/account", http.StatusSeeOther)
+}
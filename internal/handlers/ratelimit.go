@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"fmt"
+
+	"hubcorner/internal/models"
+)
+
+// rateLimit is how many posts or comments an identity can make in an hour
+type rateLimit struct {
+	noun            string // what is limited, for the error message
+	table           string // posts or comments
+	perHour         int
+	negativePerHour int // for identities with negative karma
+}
+
+// Rate limits on new posts and comments. Identities with negative karma,
+// whose contributions others have voted down, get tighter limits.
+var (
+	postRateLimit    = rateLimit{noun: "posts", table: "posts", perHour: 10, negativePerHour: 2}
+	commentRateLimit = rateLimit{noun: "comments", table: "comments", perHour: 60, negativePerHour: 10}
+)
+
+// checkRateLimit returns an error if the identity has already made as many
+// posts or comments in the last hour as the limit allows. Admins are exempt.
+func (h *Handler) checkRateLimit(limit rateLimit, identity *models.Identity) error {
+	if identity.IsAdmin {
+		return nil
+	}
+	allowed := limit.perHour
+	if identity.Karma() < 0 {
+		allowed = limit.negativePerHour
+	}
+
+	var recent int
+	err := h.Reads.QueryRow("SELECT COUNT(*) FROM "+limit.table+" WHERE author_id = ? AND created_at > datetime('now', '-1 hour')", identity.ID).Scan(&recent)
+	if err != nil {
+		return Internal(err, "Failed to check rate limit")
+	}
+	if recent >= allowed {
+		return TooManyRequests(fmt.Sprintf("You can make at most %d %s an hour. Please try again later.", allowed, limit.noun))
+	}
+	return nil
+}
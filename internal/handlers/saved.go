@@ -0,0 +1,251 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"hubcorner/internal/database"
+)
+
+// perPage is the number of items on a paginated page
+const perPage = 25
+
+// markTables maps save/hide actions to the table that stores them
+var markTables = map[string]string{
+	"save":   "saved_items",
+	"unsave": "saved_items",
+	"hide":   "hidden_items",
+	"unhide": "hidden_items",
+}
+
+// pageNumber returns the 1-based page number from the ?page= query parameter
+func pageNumber(r *http.Request) int {
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		return 1
+	}
+	return page
+}
+
+// MarkItem handles saving, unsaving, hiding and unhiding a post or comment.
+// It serves /posts/{action} with a post_id and /comments/{action} with a comment_id.
+func (h *Handler) MarkItem(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		h.renderError(w, r, MethodNotAllowed())
+		return
+	}
+
+	// Path is /posts/save, /comments/unhide, ...
+	pathParts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(pathParts) != 2 || markTables[pathParts[1]] == "" {
+		h.renderError(w, r, NotFound("The page you were looking for does not exist."))
+		return
+	}
+	itemType := strings.TrimSuffix(pathParts[0], "s")
+	action := pathParts[1]
+	table := markTables[action]
+
+	itemID, err := strconv.Atoi(r.FormValue(itemType + "_id"))
+	if err != nil {
+		h.renderError(w, r, Validation("Invalid "+itemType+" ID", nil))
+		return
+	}
+
+	identity, err := h.currentIdentity(w, r)
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to get identity"))
+		return
+	}
+
+	// Check the item exists and the client can see it
+	if err := h.checkCanViewItem(itemType, itemID, identity); err != nil {
+		h.renderError(w, r, err)
+		return
+	}
+
+	marked := action == "save" || action == "hide"
+	if marked {
+		_, err = database.WriteExec(h.DB, "INSERT OR IGNORE INTO "+table+" (identity_id, item_type, item_id) VALUES (?, ?, ?)", identity.ID, itemType, itemID)
+	} else {
+		_, err = database.WriteExec(h.DB, "DELETE FROM "+table+" WHERE identity_id = ? AND item_type = ? AND item_id = ?", identity.ID, itemType, itemID)
+	}
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to update "+itemType))
+		return
+	}
+
+	if wantsJSON(r) {
+		key := "saved"
+		if table == "hidden_items" {
+			key = "hidden"
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"item_type": itemType,
+			"item_id":   itemID,
+			key:         marked,
+		})
+		return
+	}
+
+	// Without JavaScript, go back to the page the form was on
+	http.Redirect(w, r, refererPath(r, "/"), http.StatusSeeOther)
+}
+
+// refererPath returns the path and query of the page a form was posted
+// from, or fallback if there is none or it is on another site. A path that
+// starts with // would redirect to another host, so it falls back too.
+func refererPath(r *http.Request, fallback string) string {
+	referer, err := url.Parse(r.Referer())
+	if err != nil || referer.Host != r.Host || !strings.HasPrefix(referer.EscapedPath(), "/") || strings.HasPrefix(referer.EscapedPath(), "//") {
+		return fallback
+	}
+	return referer.RequestURI()
+}
+
+// SavedItems handles the /saved page and /api/saved
+func (h *Handler) SavedItems(w http.ResponseWriter, r *http.Request) {
+	h.listMarkedItems(w, r, "saved_items", "Saved")
+}
+
+// HiddenItems handles the /hidden page and /api/hidden
+func (h *Handler) HiddenItems(w http.ResponseWriter, r *http.Request) {
+	h.listMarkedItems(w, r, "hidden_items", "Hidden")
+}
+
+// listMarkedItems renders one page of the client's saved or hidden items, newest first
+func (h *Handler) listMarkedItems(w http.ResponseWriter, r *http.Request, table, title string) {
+	identity, err := h.currentIdentity(w, r)
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to get identity"))
+		return
+	}
+
+	page := pageNumber(r)
+	items, hasMore, err := h.getMarkedItems(table, identity.ID, page)
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to get "+strings.ToLower(title)+" items"))
+		return
+	}
+
+	if wantsJSON(r) {
+		if items == nil {
+			items = []map[string]interface{}{}
+		}
+		h.fuzzItems(items)
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"items":    items,
+			"page":     page,
+			"has_more": hasMore,
+		})
+		return
+	}
+
+	data := map[string]interface{}{
+		"Title":   title,
+		"List":    strings.TrimSuffix(table, "_items"),
+		"Items":   items,
+		"Page":    page,
+		"HasMore": hasMore,
+	}
+	if page > 1 {
+		data["PrevPage"] = page - 1
+	}
+	if hasMore {
+		data["NextPage"] = page + 1
+	}
+
+	h.render(w, r, http.StatusOK, "saved.html", data)
+}
+
+// getMarkedItems retrieves one page of an identity's saved or hidden posts and
+// comments. Each item has a "type" of "post" or "comment".
+func (h *Handler) getMarkedItems(table string, identityID, page int) ([]map[string]interface{}, bool, error) {
+	rows, err := h.Reads.Query(`
+	SELECT item_type, item_id, created_at
+	FROM `+table+`
+	WHERE identity_id = ?
+	ORDER BY created_at DESC, rowid DESC
+	LIMIT ? OFFSET ?
+	`, identityID, perPage+1, (page-1)*perPage)
+	if err != nil {
+		return nil, false, err
+	}
+
+	type markedItem struct {
+		itemType string
+		itemID   int
+		markedAt string
+	}
+	var marked []markedItem
+	for rows.Next() {
+		var m markedItem
+		if err := rows.Scan(&m.itemType, &m.itemID, &m.markedAt); err != nil {
+			rows.Close()
+			return nil, false, err
+		}
+		marked = append(marked, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+
+	hasMore := len(marked) > perPage
+	if hasMore {
+		marked = marked[:perPage]
+	}
+
+	var items []map[string]interface{}
+	for _, m := range marked {
+		var item map[string]interface{}
+		if m.itemType == "comment" {
+			item, err = h.getComment(m.itemID)
+		} else {
+			item, err = h.getPost(m.itemID)
+		}
+		if err == sql.ErrNoRows {
+			// The item has been deleted since it was marked
+			continue
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		item["type"] = m.itemType
+		item["marked_at"] = m.markedAt
+		items = append(items, item)
+	}
+	return items, hasMore, nil
+}
+
+// getUserMarks gets whether the identity saved (or hid) a post, and which of its comments
+func (h *Handler) getUserMarks(table string, identityID, postID int) (bool, map[int]bool, error) {
+	var postMarked bool
+	err := h.Reads.QueryRow("SELECT EXISTS (SELECT 1 FROM "+table+" WHERE identity_id = ? AND item_type = 'post' AND item_id = ?)", identityID, postID).Scan(&postMarked)
+	if err != nil {
+		return false, nil, err
+	}
+
+	commentMarks := make(map[int]bool)
+	rows, err := h.Reads.Query(`
+	SELECT item_id
+	FROM `+table+`
+	WHERE identity_id = ? AND item_type = 'comment' AND item_id IN (
+		SELECT id FROM comments WHERE post_id = ?
+	)`, identityID, postID)
+	if err != nil {
+		return false, nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var commentID int
+		if err := rows.Scan(&commentID); err != nil {
+			return false, nil, err
+		}
+		commentMarks[commentID] = true
+	}
+	return postMarked, commentMarks, rows.Err()
+}
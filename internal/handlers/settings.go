@@ -0,0 +1,344 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"hubcorner/internal/database"
+	"hubcorner/internal/models"
+)
+
+// maxRules is the maximum number of rules a community can have
+const maxRules = 15
+
+// maxKarmaRequirement bounds the minimum karma a community can require, either way
+const maxKarmaRequirement = 1000000
+
+// communityColumns are the columns scanned by scanCommunity
+const communityColumns = `id, name, description, sidebar, banner_url, icon_url, type,
+	allowed_post_types, min_account_age_days, allow_anonymous, min_karma, locked, quarantined, created_at`
+
+// scanCommunity scans a row selected with communityColumns
+func scanCommunity(row *sql.Row) (*models.Community, error) {
+	c := &models.Community{}
+	var description, sidebar, bannerURL, iconURL sql.NullString
+	var minKarma sql.NullInt64
+	err := row.Scan(&c.ID, &c.Name, &description, &sidebar, &bannerURL, &iconURL, &c.Type,
+		&c.AllowedPostTypes, &c.MinAccountAgeDays, &c.AllowAnonymous, &minKarma, &c.Locked, &c.Quarantined, &c.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if minKarma.Valid {
+		k := int(minKarma.Int64)
+		c.MinKarma = &k
+	}
+	c.Description = description.String
+	c.Sidebar = sidebar.String
+	c.BannerURL = bannerURL.String
+	c.IconURL = iconURL.String
+	return c, nil
+}
+
+// getCommunityByName retrieves a community with its settings and rules
+func (h *Handler) getCommunityByName(name string) (*models.Community, error) {
+	c, err := scanCommunity(h.Reads.QueryRow("SELECT "+communityColumns+" FROM communities WHERE name = ?", name))
+	if err != nil {
+		return nil, err
+	}
+	return c, h.loadRules(c)
+}
+
+// getCommunityByID retrieves a community with its settings and rules
+func (h *Handler) getCommunityByID(id int) (*models.Community, error) {
+	c, err := scanCommunity(h.Reads.QueryRow("SELECT "+communityColumns+" FROM communities WHERE id = ?", id))
+	if err != nil {
+		return nil, err
+	}
+	return c, h.loadRules(c)
+}
+
+// loadRules loads the rules of a community in order
+func (h *Handler) loadRules(c *models.Community) error {
+	rows, err := h.Reads.Query("SELECT text FROM community_rules WHERE community_id = ? ORDER BY position ASC", c.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	c.Rules = nil
+	for rows.Next() {
+		var rule string
+		if err := rows.Scan(&rule); err != nil {
+			return err
+		}
+		c.Rules = append(c.Rules, rule)
+	}
+	return rows.Err()
+}
+
+// isModerator reports whether the identity moderates the community
+func (h *Handler) isModerator(communityID int, identity *models.Identity) (bool, error) {
+	var exists int
+	err := h.Reads.QueryRow("SELECT 1 FROM community_moderators WHERE community_id = ? AND identity_id = ?", communityID, identity.ID).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// checkCanView returns a forbidden error if the identity may not view the community
+func (h *Handler) checkCanView(c *models.Community, identity *models.Identity) error {
+	if c.Type != models.CommunityPrivate {
+		return nil
+	}
+	isMod, err := h.isModerator(c.ID, identity)
+	if err != nil {
+		return Internal(err, "Failed to check moderator status")
+	}
+	if !isMod {
+		return Forbidden(fmt.Sprintf("c/%s is a private community.", c.Name))
+	}
+	return nil
+}
+
+// checkCanViewPost returns an error if the post does not exist or the
+// identity may not view its community
+func (h *Handler) checkCanViewPost(postID int, identity *models.Identity) error {
+	var communityID int
+	err := h.Reads.QueryRow("SELECT community_id FROM posts WHERE id = ?", postID).Scan(&communityID)
+	if err == sql.ErrNoRows {
+		return NotFound("This post does not exist or has been removed.")
+	}
+	if err != nil {
+		return Internal(err, "Failed to get post")
+	}
+	c, err := h.getCommunityByID(communityID)
+	if err != nil {
+		return Internal(err, "Failed to get community")
+	}
+	return h.checkCanView(c, identity)
+}
+
+// checkCanViewItem is checkCanViewPost for a post or a comment, which is
+// checked by the post it is on
+func (h *Handler) checkCanViewItem(itemType string, itemID int, identity *models.Identity) error {
+	if itemType != "comment" {
+		return h.checkCanViewPost(itemID, identity)
+	}
+	var postID int
+	err := h.Reads.QueryRow("SELECT post_id FROM comments WHERE id = ?", itemID).Scan(&postID)
+	if err == sql.ErrNoRows {
+		return NotFound("This comment does not exist or has been removed.")
+	}
+	if err != nil {
+		return Internal(err, "Failed to get comment")
+	}
+	return h.checkCanViewPost(postID, identity)
+}
+
+// checkModerator returns a forbidden error if the identity does not moderate the community
+func (h *Handler) checkModerator(c *models.Community, identity *models.Identity) error {
+	isMod, err := h.isModerator(c.ID, identity)
+	if err != nil {
+		return Internal(err, "Failed to check moderator status")
+	}
+	if !isMod {
+		return Forbidden(fmt.Sprintf("Only moderators of c/%s can do that.", c.Name))
+	}
+	return nil
+}
+
+// checkCanPost returns an error if the identity may not submit the post to
+// the community. The error's Fields are set when the post itself is invalid.
+func (h *Handler) checkCanPost(c *models.Community, identity *models.Identity, link string) error {
+	// A locked community is closed to everyone, like a locked post
+	if c.Locked {
+		return Forbidden(fmt.Sprintf("c/%s is locked. New posts are not allowed.", c.Name))
+	}
+
+	isMod, err := h.isModerator(c.ID, identity)
+	if err != nil {
+		return Internal(err, "Failed to check moderator status")
+	}
+	// Moderators are exempt from the posting restrictions
+	if isMod {
+		return nil
+	}
+
+	if c.Type != models.CommunityPublic {
+		return Forbidden(fmt.Sprintf("Only moderators can post in c/%s.", c.Name))
+	}
+	if !c.AllowAnonymous && identity.IsAnonymous() {
+		return Forbidden(fmt.Sprintf("c/%s does not allow anonymous posts. Choose a username on your account page first.", c.Name))
+	}
+	minAge := time.Duration(c.MinAccountAgeDays) * 24 * time.Hour
+	if identity.AccountAge() < minAge {
+		return Forbidden(fmt.Sprintf("Your account must be at least %d days old to post in c/%s.", c.MinAccountAgeDays, c.Name))
+	}
+	if c.MinKarma != nil && identity.Karma() < *c.MinKarma {
+		return Forbidden(fmt.Sprintf("You need at least %d karma to post in c/%s.", *c.MinKarma, c.Name))
+	}
+
+	switch {
+	case c.AllowedPostTypes == models.PostTypesText && link != "":
+		return Validation("Please fix the errors below.", map[string]string{
+			"url": fmt.Sprintf("c/%s only allows text posts", c.Name),
+		})
+	case c.AllowedPostTypes == models.PostTypesLink && link == "":
+		return Validation("Please fix the errors below.", map[string]string{
+			"url": fmt.Sprintf("c/%s only allows link posts", c.Name),
+		})
+	}
+	return nil
+}
+
+// validURL reports whether s is an absolute http or https URL
+func validURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// CommunitySettings handles the settings page of a community, for moderators only
+func (h *Handler) CommunitySettings(w http.ResponseWriter, r *http.Request, community *models.Community) {
+	identity, err := h.currentIdentity(w, r)
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to get identity"))
+		return
+	}
+	if err := h.checkModerator(community, identity); err != nil {
+		h.renderError(w, r, err)
+		return
+	}
+
+	formMinKarma := ""
+	if community.MinKarma != nil {
+		formMinKarma = strconv.Itoa(*community.MinKarma)
+	}
+
+	data := map[string]interface{}{
+		"Title":     fmt.Sprintf("c/%s settings", community.Name),
+		"Community": community,
+		"Form": map[string]string{
+			"description":          community.Description,
+			"sidebar":              community.Sidebar,
+			"rules":                strings.Join(community.Rules, "\n"),
+			"banner_url":           community.BannerURL,
+			"icon_url":             community.IconURL,
+			"type":                 community.Type,
+			"allowed_post_types":   community.AllowedPostTypes,
+			"min_account_age_days": strconv.Itoa(community.MinAccountAgeDays),
+			"allow_anonymous":      strconv.FormatBool(community.AllowAnonymous),
+			"min_karma":            formMinKarma,
+		},
+		"Errors": map[string]string{},
+	}
+
+	if r.Method == http.MethodGet {
+		h.render(w, r, http.StatusOK, "community_settings.html", data)
+		return
+	}
+	if r.Method != http.MethodPost {
+		h.renderError(w, r, MethodNotAllowed())
+		return
+	}
+
+	description := strings.TrimSpace(r.FormValue("description"))
+	sidebar := strings.TrimSpace(r.FormValue("sidebar"))
+	bannerURL := strings.TrimSpace(r.FormValue("banner_url"))
+	iconURL := strings.TrimSpace(r.FormValue("icon_url"))
+	communityType := r.FormValue("type")
+	allowedPostTypes := r.FormValue("allowed_post_types")
+	allowAnonymous := r.FormValue("allow_anonymous") == "true"
+
+	// One rule per line, blank lines ignored
+	var rules []string
+	for _, line := range strings.Split(r.FormValue("rules"), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			rules = append(rules, line)
+		}
+	}
+
+	fields := make(map[string]string)
+	if len(rules) > maxRules {
+		fields["rules"] = fmt.Sprintf("A community can have at most %d rules", maxRules)
+	}
+	if bannerURL != "" && !validURL(bannerURL) {
+		fields["banner_url"] = "Banner must be an http or https URL"
+	}
+	if iconURL != "" && !validURL(iconURL) {
+		fields["icon_url"] = "Icon must be an http or https URL"
+	}
+	switch communityType {
+	case models.CommunityPublic, models.CommunityRestricted, models.CommunityPrivate:
+	default:
+		fields["type"] = "Invalid community type"
+	}
+	switch allowedPostTypes {
+	case models.PostTypesAny, models.PostTypesText, models.PostTypesLink:
+	default:
+		fields["allowed_post_types"] = "Invalid post type"
+	}
+	minAccountAgeDays, err := strconv.Atoi(r.FormValue("min_account_age_days"))
+	if err != nil || minAccountAgeDays < 0 || minAccountAgeDays > 3650 {
+		fields["min_account_age_days"] = "Minimum account age must be between 0 and 3650 days"
+	}
+	// A blank minimum karma means no requirement
+	var minKarma *int
+	if k := strings.TrimSpace(r.FormValue("min_karma")); k != "" {
+		n, err := strconv.Atoi(k)
+		if err != nil || n < -maxKarmaRequirement || n > maxKarmaRequirement {
+			fields["min_karma"] = fmt.Sprintf("Minimum karma must be between %d and %d, or blank for none", -maxKarmaRequirement, maxKarmaRequirement)
+		}
+		minKarma = &n
+	}
+
+	if len(fields) > 0 {
+		h.renderForm(w, r, "community_settings.html", data, Validation("Please fix the errors below.", fields))
+		return
+	}
+
+	// Save settings, replace the rules and log the change in one transaction
+	err = database.WriteTx(h.DB, func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+		UPDATE communities
+		SET description = ?, sidebar = ?, banner_url = ?, icon_url = ?, type = ?,
+		    allowed_post_types = ?, min_account_age_days = ?, allow_anonymous = ?, min_karma = ?
+		WHERE id = ?`,
+			description, sidebar, bannerURL, iconURL, communityType,
+			allowedPostTypes, minAccountAgeDays, allowAnonymous, minKarma, community.ID)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec("DELETE FROM community_rules WHERE community_id = ?", community.ID); err != nil {
+			return err
+		}
+		for i, rule := range rules {
+			if _, err := tx.Exec("INSERT INTO community_rules (community_id, position, text) VALUES (?, ?, ?)", community.ID, i, rule); err != nil {
+				return err
+			}
+		}
+		return logModAction(tx, identity, modLogEntry{
+			CommunityID:   community.ID,
+			CommunityName: community.Name,
+			Action:        "settings",
+			Target:        "c/" + community.Name,
+			Link:          "/c/" + url.PathEscape(community.Name),
+		})
+	})
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to save settings"))
+		return
+	}
+	// The description is in the community list, and the type decides
+	// whether the community's posts are in c/all
+	h.Cache.Invalidate(communitiesKey)
+	h.Cache.Invalidate(postsPrefix)
+
+	http.Redirect(w, r, "/c/"+url.PathEscape(community.Name), http.StatusSeeOther)
+}
@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"hubcorner/internal/database"
+	"hubcorner/internal/models"
+)
+
+// getSubscriptions retrieves the communities an identity subscribes to, for the sidebar
+func (h *Handler) getSubscriptions(identityID int) ([]map[string]interface{}, error) {
+	rows, err := h.Reads.Query(`
+	SELECT c.id, c.name, c.post_count
+	FROM subscriptions s
+	JOIN communities c ON s.community_id = c.id
+	WHERE s.identity_id = ?
+	ORDER BY c.name ASC
+	`, identityID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subscriptions []map[string]interface{}
+	for rows.Next() {
+		var id, postCount int
+		var name string
+		if err := rows.Scan(&id, &name, &postCount); err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, map[string]interface{}{
+			"id":         id,
+			"name":       name,
+			"post_count": postCount,
+		})
+	}
+	return subscriptions, rows.Err()
+}
+
+// isSubscribed reports whether an identity subscribes to a community
+func (h *Handler) isSubscribed(identityID, communityID int) (bool, error) {
+	var count int
+	err := h.Reads.QueryRow("SELECT COUNT(*) FROM subscriptions WHERE identity_id = ? AND community_id = ?", identityID, communityID).Scan(&count)
+	return count > 0, err
+}
+
+// subscriberCount returns the number of subscribers of a community
+func (h *Handler) subscriberCount(communityID int) (int, error) {
+	var count int
+	err := h.Reads.QueryRow("SELECT COUNT(*) FROM subscriptions WHERE community_id = ?", communityID).Scan(&count)
+	return count, err
+}
+
+// Subscribe handles the POST request to subscribe to or unsubscribe from a community
+func (h *Handler) Subscribe(w http.ResponseWriter, r *http.Request, community *models.Community, subscribe bool) {
+	if r.Method != http.MethodPost {
+		h.renderError(w, r, MethodNotAllowed())
+		return
+	}
+
+	identity, err := h.currentIdentity(w, r)
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to get identity"))
+		return
+	}
+	if err := h.checkCanView(community, identity); err != nil {
+		h.renderError(w, r, err)
+		return
+	}
+
+	if subscribe {
+		_, err = database.WriteExec(h.DB, "INSERT OR IGNORE INTO subscriptions (identity_id, community_id) VALUES (?, ?)", identity.ID, community.ID)
+	} else {
+		_, err = database.WriteExec(h.DB, "DELETE FROM subscriptions WHERE identity_id = ? AND community_id = ?", identity.ID, community.ID)
+	}
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to update subscription"))
+		return
+	}
+
+	if wantsJSON(r) {
+		subscribers, err := h.subscriberCount(community.ID)
+		if err != nil {
+			h.renderError(w, r, Internal(err, "Failed to count subscribers"))
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"subscribed":  subscribe,
+			"subscribers": subscribers,
+		})
+		return
+	}
+
+	http.Redirect(w, r, "/c/"+url.PathEscape(community.Name), http.StatusSeeOther)
+}
+
+// viewAggregate handles the aggregate feeds /c/all and /c/popular
+func (h *Handler) viewAggregate(w http.ResponseWriter, r *http.Request, feed string) {
+	identity, err := h.currentIdentity(w, r)
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to get identity"))
+		return
+	}
+
+	var posts []map[string]interface{}
+	if feed == "popular" {
+		posts, err = h.getPopularPosts(identity.ID)
+	} else {
+		posts, err = h.getPosts(0, identity.ID)
+	}
+	if err != nil {
+		h.renderError(w, r, Internal(err, "Failed to get posts"))
+		return
+	}
+
+	data := map[string]interface{}{
+		"Title": fmt.Sprintf("c/%s", feed),
+		"Feed":  feed,
+		"Posts": posts,
+	}
+
+	h.render(w, r, http.StatusOK, "index.html", data)
+}
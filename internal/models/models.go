@@ -4,40 +4,152 @@ import (
 	"time"
 )
 
+// Community types
+const (
+	CommunityPublic     = "public"     // anyone can view and post
+	CommunityRestricted = "restricted" // anyone can view, only moderators can post
+	CommunityPrivate    = "private"    // only moderators can view and post
+)
+
+// Allowed post types in a community
+const (
+	PostTypesAny  = "any"
+	PostTypesText = "text"
+	PostTypesLink = "link"
+)
+
 // Community represents a community in the application
 type Community struct {
-	ID          int       `json:"id"`
-	Name        string    `json:"name"`
-	Description string    `json:"description"`
-	CreatedAt   time.Time `json:"created_at"`
-	PostCount   int       `json:"post_count"`
+	ID                int       `json:"id"`
+	Name              string    `json:"name"`
+	Description       string    `json:"description"`
+	Sidebar           string    `json:"sidebar"`
+	BannerURL         string    `json:"banner_url"`
+	IconURL           string    `json:"icon_url"`
+	Type              string    `json:"type"`
+	AllowedPostTypes  string    `json:"allowed_post_types"`
+	MinAccountAgeDays int       `json:"min_account_age_days"`
+	AllowAnonymous    bool      `json:"allow_anonymous"`
+	MinKarma          *int      `json:"min_karma"` // nil for no karma requirement
+	Rules             []string  `json:"rules"`
+	Locked            bool      `json:"locked"`      // set by admins: no new posts or comments
+	Quarantined       bool      `json:"quarantined"` // set by admins: left out of site-wide lists
+	CreatedAt         time.Time `json:"created_at"`
+	PostCount         int       `json:"post_count"`
 }
 
-// Post represents a post in the application
-type Post struct {
+// Flair is a label moderators define for the posts in their community.
+// Mod-only flair can only be picked by moderators.
+type Flair struct {
+	ID          int    `json:"id"`
+	CommunityID int    `json:"community_id"`
+	Text        string `json:"text"`
+	Color       string `json:"color"`
+	ModOnly     bool   `json:"mod_only"`
+}
+
+// Identity is a client identified by its client_id cookie. It is anonymous
+// until it chooses a username.
+type Identity struct {
 	ID           int       `json:"id"`
-	Title        string    `json:"title"`
-	Content      string    `json:"content"`
-	CommunityID  int       `json:"community_id"`
-	CommunityName string   `json:"community_name"`
+	ClientID     string    `json:"-"`
+	Username     string    `json:"username,omitempty"`
+	IsAdmin      bool      `json:"is_admin,omitempty"`
+	PostKarma    int       `json:"post_karma"`
+	CommentKarma int       `json:"comment_karma"`
 	CreatedAt    time.Time `json:"created_at"`
-	Upvotes      int       `json:"upvotes"`
-	Downvotes    int       `json:"downvotes"`
-	Score        int       `json:"score"`
-	CommentCount int       `json:"comment_count"`
+}
+
+// IsAnonymous reports whether the identity has not chosen a username
+func (i *Identity) IsAnonymous() bool {
+	return i.Username == ""
+}
+
+// Profile is the public profile of an identity with a username, at /u/{username}
+type Profile struct {
+	ID           int       `json:"-"`
+	Username     string    `json:"username"`
+	CreatedAt    time.Time `json:"created_at"`
+	PostKarma    int       `json:"post_karma"`    // score of the user's posts
+	CommentKarma int       `json:"comment_karma"` // score of the user's comments
+	Karma        int       `json:"karma"`
+	HidePosts    bool      `json:"hide_posts"`
+	HideComments bool      `json:"hide_comments"`
+}
+
+// Karma returns the identity's total karma, from votes on its posts and comments
+func (i *Identity) Karma() int {
+	return i.PostKarma + i.CommentKarma
+}
+
+// AccountAge returns how long ago the identity was first seen
+func (i *Identity) AccountAge() time.Duration {
+	return time.Since(i.CreatedAt)
+}
+
+// When poll results are shown to a voter
+const (
+	PollResultsAfterVote  = "after_vote"  // once the voter has voted, or the poll has closed
+	PollResultsAfterClose = "after_close" // only once the poll has closed
+)
+
+// Poll is the poll attached to a poll post. One vote is allowed per identity.
+type Poll struct {
+	PostID            int          `json:"post_id"`
+	Options           []PollOption `json:"options"`
+	ClosesAt          *time.Time   `json:"closes_at,omitempty"`
+	Closed            bool         `json:"closed"`
+	ResultsVisibility string       `json:"results_visibility"`
+	// ShowResults reports whether the vote counts are visible to the viewer.
+	// When false, TotalVotes and the options' Votes are left at zero.
+	ShowResults bool `json:"results_visible"`
+	TotalVotes  int  `json:"total_votes"`
+	// VotedOptionID is the option the viewer voted for, or 0
+	VotedOptionID int `json:"voted_option_id,omitempty"`
+}
+
+// PollOption is one of the 2 to 10 choices of a poll
+type PollOption struct {
+	ID      int    `json:"id"`
+	Text    string `json:"text"`
+	Votes   int    `json:"votes"`
+	Percent int    `json:"percent"`
+}
+
+// Post represents a post in the application
+type Post struct {
+	ID                int       `json:"id"`
+	Title             string    `json:"title"`
+	Content           string    `json:"content"`
+	URL               string    `json:"url,omitempty"`
+	CrosspostParentID *int      `json:"crosspost_parent_id,omitempty"` // the original of a crosspost, nil for other posts
+	CommunityID       int       `json:"community_id"`
+	CommunityName     string    `json:"community_name"`
+	CreatedAt         time.Time `json:"created_at"`
+	Upvotes           int       `json:"upvotes"`
+	Downvotes         int       `json:"downvotes"`
+	Score             int       `json:"score"`
+	CommentCount      int       `json:"comment_count"`
 }
 
 // Comment represents a comment in the application
 type Comment struct {
-	ID        int        `json:"id"`
-	Content   string     `json:"content"`
-	PostID    int        `json:"post_id"`
-	ParentID  *int       `json:"parent_id"`
-	CreatedAt time.Time  `json:"created_at"`
-	Upvotes   int        `json:"upvotes"`
-	Downvotes int        `json:"downvotes"`
-	Score     int        `json:"score"`
-	Replies   []*Comment `json:"replies,omitempty"`
+	ID          int        `json:"id"`
+	Content     string     `json:"content"`
+	PostID      int        `json:"post_id"`
+	ParentID    *int       `json:"parent_id"`
+	Author      string     `json:"author,omitempty"`
+	AuthorFlair string     `json:"author_flair,omitempty"`
+	IsOP        bool       `json:"is_op,omitempty"` // written by the post's author
+	CreatedAt   time.Time  `json:"created_at"`
+	Upvotes     int        `json:"upvotes"`
+	Downvotes   int        `json:"downvotes"`
+	Score       int        `json:"score"`
+	Replies     []*Comment `json:"replies,omitempty"`
+
+	// Set when a page leaves out some of the replies
+	MoreReplies    int  `json:"more_replies,omitempty"`    // replies past the per-comment limit
+	ContinueThread bool `json:"continue_thread,omitempty"` // replies past the depth limit
 }
 
 // Vote represents a vote in the application
@@ -50,7 +162,9 @@ type Vote struct {
 	CreatedAt time.Time `json:"created_at"`
 }
 
-// BuildCommentTree organizes comments into a tree structure
+// BuildCommentTree organizes comments into a tree structure. Siblings keep
+// the order they have in comments, and replies to comments that aren't in
+// comments are left out.
 func BuildCommentTree(comments []Comment) []*Comment {
 	commentMap := make(map[int]*Comment)
 	var rootComments []*Comment
@@ -62,8 +176,10 @@ func BuildCommentTree(comments []Comment) []*Comment {
 		commentMap[comment.ID] = comment
 	}
 
-	// Second pass: build the tree structure
-	for _, comment := range commentMap {
+	// Second pass: build the tree structure, in slice order rather than map
+	// order so that it is the same every time
+	for i := range comments {
+		comment := &comments[i]
 		if comment.ParentID == nil {
 			// This is a root comment
 			rootComments = append(rootComments, comment)
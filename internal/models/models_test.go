@@ -0,0 +1,90 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+)
+
+// reply returns a comment replying to parent, or a top-level comment for 0
+func reply(id, parent int) Comment {
+	c := Comment{ID: id}
+	if parent != 0 {
+		c.ParentID = &parent
+	}
+	return c
+}
+
+// shape describes a tree by ID, as "id(replies...)"
+func shape(comments []*Comment) []interface{} {
+	result := []interface{}{}
+	for _, c := range comments {
+		if len(c.Replies) == 0 {
+			result = append(result, c.ID)
+		} else {
+			result = append(result, map[int][]interface{}{c.ID: shape(c.Replies)})
+		}
+	}
+	return result
+}
+
+func TestBuildCommentTree(t *testing.T) {
+	tests := []struct {
+		name     string
+		comments []Comment
+		want     []interface{}
+	}{
+		{
+			name:     "empty",
+			comments: nil,
+			want:     []interface{}{},
+		},
+		{
+			name:     "top-level comments keep their order",
+			comments: []Comment{reply(3, 0), reply(1, 0), reply(2, 0)},
+			want:     []interface{}{3, 1, 2},
+		},
+		{
+			name:     "replies keep their order under their parent",
+			comments: []Comment{reply(1, 0), reply(5, 1), reply(2, 0), reply(4, 1), reply(3, 2)},
+			want: []interface{}{
+				map[int][]interface{}{1: {5, 4}},
+				map[int][]interface{}{2: {3}},
+			},
+		},
+		{
+			name:     "a reply listed before its parent",
+			comments: []Comment{reply(3, 2), reply(2, 1), reply(1, 0)},
+			want: []interface{}{
+				map[int][]interface{}{1: {map[int][]interface{}{2: {3}}}},
+			},
+		},
+		{
+			name:     "orphans are left out with their replies",
+			comments: []Comment{reply(1, 0), reply(2, 99), reply(3, 2), reply(4, 1)},
+			want: []interface{}{
+				map[int][]interface{}{1: {4}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := shape(BuildCommentTree(tt.comments))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("tree = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildCommentTreeClearsReplies(t *testing.T) {
+	// Comments built into a tree before are built afresh
+	comments := []Comment{reply(1, 0), reply(2, 1)}
+	BuildCommentTree(comments)
+	tree := BuildCommentTree(comments)
+	if len(tree) != 1 || len(tree[0].Replies) != 1 {
+		t.Errorf("tree = %v, want 1 with the single reply 2", shape(tree))
+	}
+	if tree[0].Replies[0].Replies == nil {
+		t.Errorf("a comment without replies has nil Replies, want empty")
+	}
+}
@@ -0,0 +1,143 @@
+// Package names validates community names and maps them to a canonical key
+// used to keep names unique regardless of case and lookalike characters
+package names
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Length limits for community names
+const (
+	MinLength = 3
+	MaxLength = 21
+)
+
+// Validation errors returned by Validate
+var (
+	ErrEmpty      = errors.New("Community name is required")
+	ErrLength     = fmt.Errorf("Community names must be %d to %d characters long", MinLength, MaxLength)
+	ErrChars      = errors.New("Community names can only contain letters, numbers and underscores")
+	ErrUnderscore = errors.New("Community names cannot start with an underscore")
+	ErrReserved   = errors.New("This name is reserved")
+)
+
+// reserved are names that clash with routes or could be used to impersonate the site
+var reserved = map[string]bool{
+	"about":         true,
+	"account":       true,
+	"admin":         true,
+	"administrator": true,
+	"all":           true,
+	"api":           true,
+	"c":             true,
+	"comments":      true,
+	"communities":   true,
+	"create":        true,
+	"edit":          true,
+	"hidden":        true,
+	"home":          true,
+	"hubcorner":     true,
+	"login":         true,
+	"logout":        true,
+	"mod":           true,
+	"moderator":     true,
+	"moderators":    true,
+	"new":           true,
+	"null":          true,
+	"popular":       true,
+	"posts":         true,
+	"random":        true,
+	"saved":         true,
+	"settings":      true,
+	"static":        true,
+	"support":       true,
+	"system":        true,
+	"u":             true,
+	"undefined":     true,
+	"user":          true,
+	"users":         true,
+	"www":           true,
+}
+
+// Validate checks a community name against the allowed character set,
+// length limits and reserved names
+func Validate(name string) error {
+	if name == "" {
+		return ErrEmpty
+	}
+	for _, r := range name {
+		if !isAllowed(r) {
+			return ErrChars
+		}
+	}
+	if len(name) < MinLength || len(name) > MaxLength {
+		return ErrLength
+	}
+	if name[0] == '_' {
+		return ErrUnderscore
+	}
+	if IsReserved(name) {
+		return ErrReserved
+	}
+	return nil
+}
+
+// isAllowed reports whether r may appear in a community name
+func isAllowed(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_'
+}
+
+// reservedKeys holds the keys of the reserved names
+var reservedKeys = func() map[string]bool {
+	keys := make(map[string]bool, len(reserved))
+	for word := range reserved {
+		keys[Key(word)] = true
+	}
+	return keys
+}()
+
+// IsReserved reports whether name, or a lookalike of it, is reserved
+func IsReserved(name string) bool {
+	return reservedKeys[Key(name)]
+}
+
+// confusables maps letters of other scripts to the Latin letter they look
+// like. Latin letters and digits are never folded into each other: fail and
+// fall, or corn and com, are different words that users type on purpose.
+// Names are validated to ASCII, but older rows may contain any character.
+var confusables = map[rune]string{
+	// Cyrillic
+	'а': "a", 'в': "b", 'е': "e", 'ё': "e", 'к': "k", 'м': "m", 'н': "h", 'о': "o",
+	'р': "p", 'с': "c", 'т': "t", 'у': "y", 'х': "x", 'ѕ': "s", 'і': "i", 'ї': "i",
+	'ј': "j", 'ԁ': "d", 'ԛ': "q", 'ԝ': "w", 'һ': "h", 'ӏ': "l",
+	// Greek
+	'α': "a", 'β': "b", 'ε': "e", 'η': "n", 'ι': "i", 'κ': "k", 'ν': "v", 'ο': "o",
+	'ρ': "p", 'τ': "t", 'υ': "u", 'χ': "x",
+	// Latin letters outside ASCII that look like ASCII ones
+	'ɡ': "g", 'ı': "i",
+}
+
+// Key returns the canonical form of a name. Two names with the same key look
+// alike and may not both exist. The key is lower case with letters of other
+// scripts folded into the Latin letters they look like, so it is only used
+// for comparison, never shown.
+func Key(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		// Fold fullwidth forms (Ａ-Ｚ, ａ-ｚ, ０-９) to ASCII
+		if r >= 0xFF01 && r <= 0xFF5E {
+			r = r - 0xFF01 + '!'
+			if r >= 'A' && r <= 'Z' {
+				r += 'a' - 'A'
+			}
+		}
+		if s, ok := confusables[r]; ok {
+			b.WriteString(s)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,82 @@
+package names
+
+import "testing"
+
+func TestKeyLookalikes(t *testing.T) {
+	tests := []struct {
+		a, b string
+	}{
+		{"golang", "GoLang"},
+		{"golang", "ＧＯＬＡＮＧ"},   // fullwidth
+		{"apple", "аррӏе"},     // Cyrillic
+		{"topics", "τoрiсs"},   // Greek and Cyrillic
+		{"admin", "аdmіn"},     // Cyrillic a and i
+		{"hobbies", "һοbbіеs"}, // Cyrillic and Greek
+		{"weather", "ԝеаthеr"}, // Cyrillic we
+		{"sign", "sıɡn"},       // dotless i and script g
+		{"photos", "PHOTOS"},
+	}
+	for _, tt := range tests {
+		if Key(tt.a) != Key(tt.b) {
+			t.Errorf("Key(%q) = %q, Key(%q) = %q; want the same", tt.a, Key(tt.a), tt.b, Key(tt.b))
+		}
+	}
+}
+
+func TestKeyDistinctWords(t *testing.T) {
+	// Latin letters and digits are typed on purpose, and are never folded
+	tests := []struct {
+		a, b string
+	}{
+		{"fail", "fall"},
+		{"bail", "ball"},
+		{"mail", "mall"},
+		{"tail", "tall"},
+		{"corn", "com"},
+		{"vvine", "wine"},
+		{"go_lang", "golang"},
+		{"top10", "topio"},
+		{"web3", "webs"},
+		{"s0up", "soup"},
+	}
+	for _, tt := range tests {
+		if Key(tt.a) == Key(tt.b) {
+			t.Errorf("Key(%q) = Key(%q) = %q; want different keys", tt.a, tt.b, Key(tt.a))
+		}
+	}
+}
+
+func TestIsReserved(t *testing.T) {
+	for _, name := range []string{"admin", "ADMIN", "аdmin", "Static"} {
+		if !IsReserved(name) {
+			t.Errorf("IsReserved(%q) = false, want true", name)
+		}
+	}
+	for _, name := range []string{"admins", "golang", "mall"} {
+		if IsReserved(name) {
+			t.Errorf("IsReserved(%q) = true, want false", name)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		want error
+	}{
+		{"golang", nil},
+		{"Go_Lang2", nil},
+		{"", ErrEmpty},
+		{"go", ErrLength},
+		{"a_name_that_is_far_too_long", ErrLength},
+		{"go-lang", ErrChars},
+		{"gоlang", ErrChars}, // Cyrillic o
+		{"_golang", ErrUnderscore},
+		{"settings", ErrReserved},
+	}
+	for _, tt := range tests {
+		if err := Validate(tt.name); err != tt.want {
+			t.Errorf("Validate(%q) = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package render
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/url"
+	"strings"
+	"time"
+
+	"hubcorner/internal/cache"
+
+	"github.com/yuin/goldmark"
+)
+
+// Funcs returns the template functions available to every page
+func Funcs() template.FuncMap {
+	return template.FuncMap{
+		"dict":      dict,
+		"reltime":   relativeTime,
+		"pluralize": pluralize,
+		"markdown":  markdown,
+		"url":       buildURL,
+		"contrast":  contrast,
+	}
+}
+
+// dict builds a map from key/value pairs, for passing several values to a sub-template:
+// {{ template "comments" dict "Comments" .Replies "PostID" $.PostID }}
+func dict(pairs ...interface{}) (map[string]interface{}, error) {
+	if len(pairs)%2 != 0 {
+		return nil, errors.New("dict: odd number of arguments")
+	}
+	m := make(map[string]interface{}, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		key, ok := pairs[i].(string)
+		if !ok {
+			return nil, fmt.Errorf("dict: key %v is not a string", pairs[i])
+		}
+		m[key] = pairs[i+1]
+	}
+	return m, nil
+}
+
+// timeLayouts are the formats SQLite timestamps come back in
+var timeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05.999999999-07:00",
+}
+
+// parseTime converts a time.Time or a timestamp string to a time.Time
+func parseTime(v interface{}) (time.Time, bool) {
+	switch t := v.(type) {
+	case time.Time:
+		return t, true
+	case string:
+		for _, layout := range timeLayouts {
+			if parsed, err := time.Parse(layout, t); err == nil {
+				return parsed, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// relativeTime formats a timestamp relative to now, e.g. "5 minutes ago"
+func relativeTime(v interface{}) string {
+	t, ok := parseTime(v)
+	if !ok {
+		return fmt.Sprint(v)
+	}
+
+	d := time.Since(t)
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return pluralize(int(d/time.Minute), "minute") + " ago"
+	case d < 24*time.Hour:
+		return pluralize(int(d/time.Hour), "hour") + " ago"
+	case d < 30*24*time.Hour:
+		return pluralize(int(d/(24*time.Hour)), "day") + " ago"
+	case d < 365*24*time.Hour:
+		return pluralize(int(d/(30*24*time.Hour)), "month") + " ago"
+	default:
+		return pluralize(int(d/(365*24*time.Hour)), "year") + " ago"
+	}
+}
+
+// pluralize formats a count with the singular or plural form of a word:
+// {{ pluralize .comment_count "comment" }} gives "1 comment" or "3 comments".
+// An irregular plural can be passed as a third argument.
+func pluralize(n int, singular string, plural ...string) string {
+	if n == 1 || n == -1 {
+		return fmt.Sprintf("%d %s", n, singular)
+	}
+	if len(plural) > 0 {
+		return fmt.Sprintf("%d %s", n, plural[0])
+	}
+	return fmt.Sprintf("%d %ss", n, singular)
+}
+
+// markdown converts user-written markdown to HTML. Raw HTML and dangerous
+// link targets in the input are dropped by goldmark's default settings.
+func markdown(s string) template.HTML {
+	var buf bytes.Buffer
+	if err := goldmark.Convert([]byte(s), &buf); err != nil {
+		return template.HTML(template.HTMLEscapeString(s))
+	}
+	return template.HTML(buf.String())
+}
+
+// CachedMarkdown returns a markdown function that keeps the HTML it renders
+// in c, for use in place of the default one. The HTML is cached under a
+// hash of the markdown, so an edited post or comment never gets old HTML.
+func CachedMarkdown(c *cache.Cache) func(string) template.HTML {
+	return func(s string) template.HTML {
+		sum := sha256.Sum256([]byte(s))
+		html, _ := c.Get("markdown:"+hex.EncodeToString(sum[:]), func() (interface{}, error) {
+			return markdown(s), nil
+		})
+		return html.(template.HTML)
+	}
+}
+
+// buildURL joins path segments into an escaped site path: {{ url "c" .name }} gives "/c/name"
+func buildURL(segments ...interface{}) string {
+	parts := make([]string, 0, len(segments))
+	for _, segment := range segments {
+		parts = append(parts, url.PathEscape(strings.Trim(fmt.Sprint(segment), "/")))
+	}
+	return "/" + strings.Join(parts, "/")
+}
+
+// contrast returns black or white, whichever is easier to read on a #rrggbb
+// background colour: <span style="color: {{ contrast .Color }}">
+func contrast(background string) string {
+	var r, g, b int
+	if _, err := fmt.Sscanf(background, "#%2x%2x%2x", &r, &g, &b); err != nil {
+		return "#000000"
+	}
+	// Perceived brightness, weighted as in ITU-R BT.601
+	if r*299+g*587+b*114 > 128*1000 {
+		return "#000000"
+	}
+	return "#ffffff"
+}
@@ -0,0 +1,175 @@
+// Package render renders pages inside the site layout
+package render
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+)
+
+// layoutName is the base template every page is rendered into
+const layoutName = "layout.html"
+
+// errorPage is rendered when a page fails to render
+const errorPage = "error.html"
+
+// Renderer renders pages inside layout.html. Each page is parsed together with
+// its own copy of the layout, so the "content" blocks of different pages do not
+// overwrite each other. With reload enabled, the templates are re-parsed
+// whenever a file changes on disk.
+type Renderer struct {
+	fsys   fs.FS
+	funcs  template.FuncMap
+	reload bool
+
+	mu       sync.Mutex
+	pages    map[string]*template.Template
+	modified time.Time
+}
+
+// New parses layout.html together with every other *.html template in fsys.
+// funcs is added to the default function map (see Funcs).
+func New(fsys fs.FS, funcs template.FuncMap, reload bool) (*Renderer, error) {
+	r := &Renderer{
+		fsys:   fsys,
+		funcs:  Funcs(),
+		reload: reload,
+	}
+	for name, fn := range funcs {
+		r.funcs[name] = fn
+	}
+	if err := r.parse(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Render renders the named page with data and writes it with the given status.
+// The page is rendered into a buffer first, so a template error results in a
+// 500 error page instead of a half-written response.
+func (r *Renderer) Render(w http.ResponseWriter, status int, name string, data map[string]interface{}) {
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+	if _, ok := data["CurrentYear"]; !ok {
+		data["CurrentYear"] = time.Now().Year()
+	}
+
+	var buf bytes.Buffer
+	if err := r.execute(&buf, name, data); err != nil {
+		log.Printf("Error rendering %s: %v", name, err)
+		r.renderError(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	buf.WriteTo(w)
+}
+
+// renderError writes the 500 error page, falling back to plain text if that fails too
+func (r *Renderer) renderError(w http.ResponseWriter) {
+	data := map[string]interface{}{
+		"Title":       "Something went wrong",
+		"Message":     "Something went wrong while loading this page. Please try again later.",
+		"CurrentYear": time.Now().Year(),
+	}
+
+	var buf bytes.Buffer
+	if err := r.execute(&buf, errorPage, data); err != nil {
+		log.Printf("Error rendering %s: %v", errorPage, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusInternalServerError)
+	buf.WriteTo(w)
+}
+
+// execute renders the named page into buf
+func (r *Renderer) execute(buf *bytes.Buffer, name string, data map[string]interface{}) error {
+	pages, err := r.get()
+	if err != nil {
+		return err
+	}
+	tmpl, ok := pages[name]
+	if !ok {
+		return fmt.Errorf("render: no page named %q", name)
+	}
+	return tmpl.ExecuteTemplate(buf, layoutName, data)
+}
+
+// get returns the parsed pages, re-parsing them first if files have changed
+func (r *Renderer) get() (map[string]*template.Template, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.reload {
+		modified, err := r.lastModified()
+		if err != nil {
+			return nil, err
+		}
+		if modified.After(r.modified) {
+			if err := r.parse(); err != nil {
+				// Keep serving the previous templates until the file is fixed
+				log.Printf("Error reloading templates: %v", err)
+				r.modified = modified
+			}
+		}
+	}
+	return r.pages, nil
+}
+
+// parse (re-)parses every page. The caller must hold r.mu or own r exclusively.
+func (r *Renderer) parse() error {
+	modified, err := r.lastModified()
+	if err != nil {
+		return err
+	}
+	names, err := fs.Glob(r.fsys, "*.html")
+	if err != nil {
+		return err
+	}
+
+	pages := make(map[string]*template.Template)
+	for _, name := range names {
+		if name == layoutName {
+			continue
+		}
+		tmpl, err := template.New(layoutName).Funcs(r.funcs).ParseFS(r.fsys, layoutName, name)
+		if err != nil {
+			return err
+		}
+		pages[path.Base(name)] = tmpl
+	}
+
+	r.pages = pages
+	r.modified = modified
+	return nil
+}
+
+// lastModified returns the newest modification time of the template files
+func (r *Renderer) lastModified() (time.Time, error) {
+	var latest time.Time
+	names, err := fs.Glob(r.fsys, "*.html")
+	if err != nil {
+		return latest, err
+	}
+	for _, name := range names {
+		info, err := fs.Stat(r.fsys, name)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
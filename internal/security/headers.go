@@ -0,0 +1,98 @@
+// Package security sets the security headers of every response, including
+// a Content-Security-Policy with a fresh nonce for each page, and collects
+// the reports browsers send when the policy blocks something
+package security
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ReportPath is where browsers send reports of content the policy blocked
+const ReportPath = "/csp-report"
+
+// policy is the Content-Security-Policy, with {nonce} standing for the
+// nonce of the response. Scripts must come from the site or carry the
+// nonce. Styles may be inline, as flair colours and poll bars are set in
+// style attributes, which nonces don't cover. Images may come from any
+// https URL, as posts and community banners link to them.
+const policy = "default-src 'self'; " +
+	"script-src 'self' 'nonce-{nonce}'; " +
+	"style-src 'self' 'unsafe-inline'; " +
+	"img-src 'self' https:; " +
+	"object-src 'none'; " +
+	"base-uri 'self'; " +
+	"form-action 'self'; " +
+	"frame-ancestors 'none'; " +
+	"report-uri " + ReportPath + "; " +
+	"report-to csp"
+
+// hstsMaxAge is how long browsers should only use HTTPS for the site,
+// once they have seen it over HTTPS: a year
+const hstsMaxAge = "max-age=31536000"
+
+// nonceKey is the request context key of the response's nonce
+type nonceKey struct{}
+
+// Headers wraps next so that every response has the security headers.
+// With reportOnly, the Content-Security-Policy is only reported on, not
+// enforced, so it can be tried out on a live site first.
+func Headers(reportOnly bool, next http.Handler) http.Handler {
+	cspHeader := "Content-Security-Policy"
+	if reportOnly {
+		cspHeader = "Content-Security-Policy-Report-Only"
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nonce := newNonce()
+		header := w.Header()
+		header.Set(cspHeader, strings.Replace(policy, "{nonce}", nonce, 1))
+		header.Set("Reporting-Endpoints", `csp="`+ReportPath+`"`)
+		header.Set("X-Content-Type-Options", "nosniff")
+		header.Set("X-Frame-Options", "DENY")
+		header.Set("Referrer-Policy", "strict-origin-when-cross-origin")
+		header.Set("Permissions-Policy", "camera=(), microphone=(), geolocation=(), payment=(), usb=()")
+		if IsHTTPS(r) {
+			header.Set("Strict-Transport-Security", hstsMaxAge)
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), nonceKey{}, nonce)))
+	})
+}
+
+// Nonce returns the nonce scripts in the response to r must carry, or ""
+// outside Headers
+func Nonce(r *http.Request) string {
+	nonce, _ := r.Context().Value(nonceKey{}).(string)
+	return nonce
+}
+
+// newNonce returns 128 random bits, base64url encoded, which templates
+// leave unescaped in attributes
+func newNonce() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// crypto/rand only fails if the OS has no entropy source
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// IsHTTPS reports whether the client reached the site over HTTPS, directly
+// or through a reverse proxy on the same machine that says so in
+// X-Forwarded-Proto
+func IsHTTPS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback() && r.Header.Get("X-Forwarded-Proto") == "https"
+}
@@ -0,0 +1,147 @@
+package security
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// maxReportSize is the largest report body read
+const maxReportSize = 64 << 10
+
+// maxViolations is how many distinct violations Reports remembers, to log
+// each only once, before it forgets them and starts over
+const maxViolations = 1000
+
+// violation is what a report says the policy blocked
+type violation struct {
+	Document    string
+	Directive   string
+	Blocked     string
+	Source      string
+	Line        int
+	Disposition string // "enforce", or "report" in report-only mode
+}
+
+// Reports collects the violation reports browsers send to ReportPath and
+// logs them. A page with a violation reports it on every view, so each
+// distinct violation is logged once, with later reports only counted.
+type Reports struct {
+	mu   sync.Mutex
+	seen map[violation]int
+}
+
+// NewReports creates an empty report collector
+func NewReports() *Reports {
+	return &Reports{seen: make(map[violation]int)}
+}
+
+// ServeHTTP reads a report, in either the application/csp-report format
+// of report-uri or the application/reports+json format of report-to
+func (rep *Reports) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxReportSize))
+	if err != nil {
+		http.Error(w, "Report too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	violations, err := parseReport(r.Header.Get("Content-Type"), body)
+	if err != nil {
+		http.Error(w, "Invalid report", http.StatusBadRequest)
+		return
+	}
+	for _, v := range violations {
+		rep.log(v)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// log logs a violation the first time it is reported
+func (rep *Reports) log(v violation) {
+	rep.mu.Lock()
+	if len(rep.seen) >= maxViolations {
+		rep.seen = make(map[violation]int)
+	}
+	rep.seen[v]++
+	first := rep.seen[v] == 1
+	rep.mu.Unlock()
+
+	if first {
+		source := ""
+		if v.Source != "" {
+			source = fmt.Sprintf(" in %s:%d", v.Source, v.Line)
+		}
+		log.Printf("CSP violation (%s) on %s: %s blocked %s%s", v.Disposition, v.Document, v.Directive, v.Blocked, source)
+	}
+}
+
+// parseReport reads the violations in a report body
+func parseReport(contentType string, body []byte) ([]violation, error) {
+	if strings.HasPrefix(contentType, "application/reports+json") {
+		var reports []struct {
+			Type string `json:"type"`
+			Body struct {
+				DocumentURL        string `json:"documentURL"`
+				EffectiveDirective string `json:"effectiveDirective"`
+				BlockedURL         string `json:"blockedURL"`
+				SourceFile         string `json:"sourceFile"`
+				LineNumber         int    `json:"lineNumber"`
+				Disposition        string `json:"disposition"`
+			} `json:"body"`
+		}
+		if err := json.Unmarshal(body, &reports); err != nil {
+			return nil, err
+		}
+		var violations []violation
+		for _, report := range reports {
+			if report.Type != "csp-violation" {
+				continue
+			}
+			violations = append(violations, violation{
+				Document:    report.Body.DocumentURL,
+				Directive:   report.Body.EffectiveDirective,
+				Blocked:     report.Body.BlockedURL,
+				Source:      report.Body.SourceFile,
+				Line:        report.Body.LineNumber,
+				Disposition: report.Body.Disposition,
+			})
+		}
+		return violations, nil
+	}
+
+	var report struct {
+		Report struct {
+			DocumentURI        string `json:"document-uri"`
+			ViolatedDirective  string `json:"violated-directive"`
+			EffectiveDirective string `json:"effective-directive"`
+			BlockedURI         string `json:"blocked-uri"`
+			SourceFile         string `json:"source-file"`
+			LineNumber         int    `json:"line-number"`
+			Disposition        string `json:"disposition"`
+		} `json:"csp-report"`
+	}
+	if err := json.Unmarshal(body, &report); err != nil {
+		return nil, err
+	}
+	v := violation{
+		Document:    report.Report.DocumentURI,
+		Directive:   report.Report.EffectiveDirective,
+		Blocked:     report.Report.BlockedURI,
+		Source:      report.Report.SourceFile,
+		Line:        report.Report.LineNumber,
+		Disposition: report.Report.Disposition,
+	}
+	if v.Directive == "" {
+		v.Directive = report.Report.ViolatedDirective
+	}
+	return []violation{v}, nil
+}
@@ -7,6 +7,15 @@ document.addEventListener('DOMContentLoaded', function() {
     
     // Handle reply buttons
     setupReplyButtons();
+
+    // Handle save and hide buttons
+    setupMarkButtons();
+
+    // Handle the flair picker on the new post form
+    setupFlairPicker();
+
+    // Handle poll voting and result updates
+    setupPolls();
 });
 
 /**
@@ -22,7 +31,6 @@ function setupVoting(selector, endpoint, idParam) {
         button.addEventListener('click', function() {
             const itemId = this.getAttribute(`data-${idParam.replace('_', '-')}`);
             const voteType = this.getAttribute('data-vote-type');
-            const isUpvote = voteType === '1';
             
             // Get the vote controls container
             const voteControls = this.closest('.vote-controls');
@@ -37,27 +45,22 @@ function setupVoting(selector, endpoint, idParam) {
             
             fetch(endpoint, {
                 method: 'POST',
+                headers: { 'Accept': 'application/json' },
                 body: formData
             })
-            .then(response => response.json())
+            .then(response => response.json().then(data => {
+                if (!response.ok) {
+                    throw new Error(data.error || response.statusText);
+                }
+                return data;
+            }))
             .then(data => {
                 // Update the score
                 scoreElement.textContent = data.score;
                 
-                // Toggle active state on buttons
-                if (this.classList.contains('active')) {
-                    // If already active, remove active state (toggle off)
-                    this.classList.remove('active');
-                } else {
-                    // Add active state to this button, remove from the other
-                    if (isUpvote) {
-                        upvoteButton.classList.add('active');
-                        downvoteButton.classList.remove('active');
-                    } else {
-                        downvoteButton.classList.add('active');
-                        upvoteButton.classList.remove('active');
-                    }
-                }
+                // Show the vote the server now has for this client
+                upvoteButton.classList.toggle('active', data.vote === 1);
+                downvoteButton.classList.toggle('active', data.vote === -1);
             })
             .catch(error => {
                 console.error('Error voting:', error);
@@ -106,9 +109,141 @@ function setupReplyButtons() {
 }
 
 /**
- * Helper function for the post.html template
- * Creates a dictionary-like object for template rendering
+ * Sets up save/unsave and hide/unhide buttons for posts and comments
+ */
+function setupMarkButtons() {
+    const labels = { save: 'Save', unsave: 'Unsave', hide: 'Hide', unhide: 'Unhide' };
+    const opposites = { save: 'unsave', unsave: 'save', hide: 'unhide', unhide: 'hide' };
+
+    document.querySelectorAll('.mark-btn').forEach(button => {
+        button.addEventListener('click', function() {
+            const itemType = this.getAttribute('data-item-type');
+            const itemId = this.getAttribute('data-item-id');
+            const action = this.getAttribute('data-action');
+
+            const formData = new FormData();
+            formData.append(`${itemType}_id`, itemId);
+
+            fetch(`/${itemType}s/${action}`, {
+                method: 'POST',
+                headers: { 'Accept': 'application/json' },
+                body: formData
+            })
+            .then(response => response.json().then(data => {
+                if (!response.ok) {
+                    throw new Error(data.error || response.statusText);
+                }
+                return data;
+            }))
+            .then(() => {
+                // Remove the item from listings, or flip the button to its opposite action
+                if (this.hasAttribute('data-remove')) {
+                    this.closest('.post-card, .comment').remove();
+                    return;
+                }
+                if (action === 'hide' || action === 'unhide') {
+                    window.location.reload();
+                    return;
+                }
+                this.setAttribute('data-action', opposites[action]);
+                this.textContent = labels[opposites[action]];
+            })
+            .catch(error => {
+                console.error(`Error on ${action}:`, error);
+            });
+        });
+    });
+}
+
+/**
+ * Shows only the flair of the selected community in the new post form
  */
-function dict(obj) {
-    return obj;
+function setupFlairPicker() {
+    const picker = document.getElementById('flair-picker');
+    const communitySelect = document.getElementById('community_id');
+    if (!picker || !communitySelect) {
+        return;
+    }
+    const flairSelect = picker.querySelector('select');
+
+    function update() {
+        let available = false;
+        picker.querySelectorAll('optgroup').forEach(group => {
+            const matches = group.getAttribute('data-community-id') === communitySelect.value;
+            group.hidden = !matches;
+            group.disabled = !matches;
+            available = available || matches;
+        });
+        // Clear a flair that belongs to another community
+        const selected = flairSelect.selectedOptions[0];
+        if (selected && selected.parentElement.disabled) {
+            flairSelect.value = '';
+        }
+        picker.style.display = available ? '' : 'none';
+    }
+
+    communitySelect.addEventListener('change', update);
+    update();
+}
+
+/**
+ * Submits poll votes without leaving the page and keeps the results of
+ * open polls up to date
+ */
+function setupPolls() {
+    document.querySelectorAll('.poll-form').forEach(form => {
+        form.addEventListener('submit', function(event) {
+            event.preventDefault();
+
+            fetch(form.action, {
+                method: 'POST',
+                headers: { 'Accept': 'application/json' },
+                body: new FormData(form)
+            })
+            .then(response => response.json().then(data => {
+                if (!response.ok) {
+                    throw new Error(data.error || response.statusText);
+                }
+                return data;
+            }))
+            .then(() => {
+                // The page shows the results or the voted option from here on
+                window.location.reload();
+            })
+            .catch(error => {
+                console.error('Error voting in poll:', error);
+                alert(error.message);
+            });
+        });
+    });
+
+    // Refresh visible results while the poll is open
+    document.querySelectorAll('.poll[data-live]').forEach(poll => {
+        const postId = poll.getAttribute('data-post-id');
+        const timer = setInterval(() => {
+            fetch(`/api/polls/${postId}`, { headers: { 'Accept': 'application/json' } })
+            .then(response => response.ok ? response.json() : Promise.reject(new Error(response.statusText)))
+            .then(data => {
+                data.options.forEach(option => {
+                    const row = poll.querySelector(`.poll-result[data-option-id="${option.id}"]`);
+                    if (!row) {
+                        return;
+                    }
+                    const votes = option.votes || 0;
+                    row.querySelector('.poll-bar').style.width = `${option.percent || 0}%`;
+                    row.querySelector('.poll-option-votes').textContent =
+                        `${option.percent || 0}% (${votes} ${votes === 1 ? 'vote' : 'votes'})`;
+                });
+                const total = data.total_votes || 0;
+                poll.querySelector('.poll-total').textContent = `${total} ${total === 1 ? 'vote' : 'votes'}`;
+                if (data.closed) {
+                    clearInterval(timer);
+                }
+            })
+            .catch(error => {
+                console.error('Error refreshing poll:', error);
+                clearInterval(timer);
+            });
+        }, 15000);
+    });
 }
@@ -0,0 +1,36 @@
+// Package web contains the HTML templates and static assets, embedded into the binary
+package web
+
+import (
+	"embed"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+//go:embed templates static
+var files embed.FS
+
+// Templates returns the template files, read from ./web/templates when dev is set
+func Templates(dev bool) fs.FS {
+	return sub("templates", dev)
+}
+
+// Static returns the static assets, read from ./web/static when dev is set
+func Static(dev bool) fs.FS {
+	return sub("static", dev)
+}
+
+// sub returns one directory of the embedded files, or the same directory on disk
+func sub(dir string, dev bool) fs.FS {
+	if dev {
+		return os.DirFS(filepath.Join("web", dir))
+	}
+
+	fsys, err := fs.Sub(files, dir)
+	if err != nil {
+		// The directory is embedded above, so this only fails on a broken build
+		panic(err)
+	}
+	return fsys
+}